@@ -0,0 +1,334 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The address index is optional, it is kept up to date only when addrIndexKey is set:
+//
+//	addru-<pubkeyhash><txid><index> → value of an unspent output locked with the pubkey hash
+//	addrtx-<pubkeyhash><height><txid> → AddressTx of a transaction of the chain which touched the pubkey hash
+//
+// The pubkey hash, the height and the ID have fixed lengths, so the keys of one pubkey hash share a prefix
+// and its transactions are ordered by height.
+var (
+	addrIndexKey     = []byte("addrindex")
+	addrUTXOPrefix   = []byte("addru-")
+	addrTxPrefix     = []byte("addrtx-")
+	pubKeyHashLength = 20
+)
+
+// AddressTx is a transaction of the chain which paid to or spent from an address
+type AddressTx struct {
+	TxID     []byte
+	Height   int
+	Received int // the value of the transaction's outputs locked with the address
+	Sent     int // the value of the address's outputs the transaction spent
+}
+
+// Serialize turn AddressTx into bytes
+func (a *AddressTx) Serialize() []byte {
+	e := newEncoder()
+	e.writeBytes(a.TxID)
+	e.writeInt(int64(a.Height))
+	e.writeInt(int64(a.Received))
+	e.writeInt(int64(a.Sent))
+	return e.Bytes()
+}
+
+// DeserializeAddressTx turn bytes back to AddressTx
+func DeserializeAddressTx(data []byte) (AddressTx, error) {
+	var a AddressTx
+	d := newDecoder(data)
+
+	a.TxID = d.readBytes()
+	a.Height = int(d.readInt())
+	a.Received = int(d.readInt())
+	a.Sent = int(d.readInt())
+
+	if err := d.finish(); err != nil {
+		return AddressTx{}, err
+	}
+	return a, nil
+}
+
+// addressOutput is an unspent output of the address index
+type addressOutput struct {
+	TxID  []byte
+	Index int
+	Value int
+}
+
+func addrUTXOKey(pubKeyHash, txID []byte, index int) []byte {
+	key := append(append(append([]byte{}, addrUTXOPrefix...), pubKeyHash...), txID...)
+	return append(key, ToHex(int64(index))[4:]...)
+}
+
+func addrTxKey(pubKeyHash []byte, height int, txID []byte) []byte {
+	key := append(append(append([]byte{}, addrTxPrefix...), pubKeyHash...), ToHex(int64(height))...)
+	return append(key, txID...)
+}
+
+// indexable report whether an output's pubkey hash fits in the fixed length keys of the index
+func indexable(pubKeyHash []byte) bool {
+	return len(pubKeyHash) == pubKeyHashLength
+}
+
+// HasAddressIndex report whether the address index is kept
+func (chain *Blockchain) HasAddressIndex() (bool, error) {
+	var enabled bool
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		enabled, err = hasAddressIndex(txn)
+		return err
+	})
+	return enabled, err
+}
+
+func hasAddressIndex(txn *badger.Txn) (bool, error) {
+	_, err := txn.Get(addrIndexKey)
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// EnableAddressIndex build the address index from the chain and keep it up to date from now on
+func (chain *Blockchain) EnableAddressIndex() error {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(addrIndexKey, []byte{})
+	})
+	if err != nil {
+		return err
+	}
+
+	return chain.ReindexAddresses()
+}
+
+// ReindexAddresses rebuild the address index by replaying the chain from genesis
+func (chain *Blockchain) ReindexAddresses() error {
+	u := UTXOSet{chain}
+	if err := u.DeleteByPrefix(addrUTXOPrefix); err != nil {
+		return err
+	}
+	if err := u.DeleteByPrefix(addrTxPrefix); err != nil {
+		return err
+	}
+
+	// 從最後一個區塊往回收集，再從創世區塊開始重播
+	var blocks []*Block
+	iter := chain.CreateIterator()
+	for len(iter.CurrentHash) != 0 {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+		blocks = append(blocks, block)
+	}
+
+	outputs := make(map[string]SpentOutput)
+	for i := len(blocks) - 1; i >= 0; i-- {
+		block := blocks[i]
+
+		var spent []SpentOutput
+		for _, tx := range block.Transactions {
+			if tx.IsCoinbase() == false {
+				for _, in := range tx.Inputs {
+					key := outpointKey(in)
+					out, ok := outputs[key]
+					if !ok {
+						return fmt.Errorf("%w: output %d of %x of block %x does not exist", ErrInvalidTransaction, in.Out, in.ID, block.Hash)
+					}
+					delete(outputs, key)
+					spent = append(spent, out)
+				}
+			}
+
+			for outIdx, out := range tx.Outputs {
+				outputs[outpointKey(TxInput{tx.ID, outIdx, nil, nil, nil, 0})] = SpentOutput{tx.ID, outIdx, block.Height, tx.IsCoinbase(), out}
+			}
+		}
+
+		err := chain.Database.Update(func(txn *badger.Txn) error {
+			return indexBlock(txn, block, spent)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// indexBlock add the block's transactions to the address index in txn, spent are the outputs
+// spent by the block's inputs in the order of the inputs like the block's undo data
+func indexBlock(txn *badger.Txn, block *Block, spent []SpentOutput) error {
+	type entry struct {
+		pubKeyHash []byte
+		tx         *AddressTx
+	}
+	entries := make(map[string]*entry)
+	touch := func(pubKeyHash []byte, tx *Transaction) *AddressTx {
+		key := hex.EncodeToString(pubKeyHash) + hex.EncodeToString(tx.ID)
+		if e, ok := entries[key]; ok {
+			return e.tx
+		}
+		e := &entry{pubKeyHash, &AddressTx{tx.ID, block.Height, 0, 0}}
+		entries[key] = e
+		return e.tx
+	}
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			if len(spent) < len(tx.Inputs) {
+				return fmt.Errorf("undo data of block %x is missing spent outputs", block.Hash)
+			}
+			for _, s := range spent[:len(tx.Inputs)] {
+				if !indexable(s.Output.PubKeyHash) {
+					continue
+				}
+				if err := txn.Delete(addrUTXOKey(s.Output.PubKeyHash, s.TxID, s.Out)); err != nil {
+					return err
+				}
+				touch(s.Output.PubKeyHash, tx).Sent += s.Output.Value
+			}
+			spent = spent[len(tx.Inputs):]
+		}
+
+		for outIdx, out := range tx.Outputs {
+			if !indexable(out.PubKeyHash) {
+				continue
+			}
+			if err := txn.Set(addrUTXOKey(out.PubKeyHash, tx.ID, outIdx), ToHex(int64(out.Value))); err != nil {
+				return err
+			}
+			touch(out.PubKeyHash, tx).Received += out.Value
+		}
+	}
+
+	for _, e := range entries {
+		if err := txn.Set(addrTxKey(e.pubKeyHash, e.tx.Height, e.tx.TxID), e.tx.Serialize()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexBlock undo indexBlock in txn
+func unindexBlock(txn *badger.Txn, block *Block, spent []SpentOutput) error {
+	// 從最後一筆交易往回處理，同一個區塊裡被花掉的 output 才會先加回再刪除
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		for outIdx, out := range tx.Outputs {
+			if !indexable(out.PubKeyHash) {
+				continue
+			}
+			if err := txn.Delete(addrUTXOKey(out.PubKeyHash, tx.ID, outIdx)); err != nil {
+				return err
+			}
+			if err := txn.Delete(addrTxKey(out.PubKeyHash, block.Height, tx.ID)); err != nil {
+				return err
+			}
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		if len(spent) < len(tx.Inputs) {
+			return fmt.Errorf("undo data of block %x is missing spent outputs", block.Hash)
+		}
+		n := len(spent) - len(tx.Inputs)
+		for _, s := range spent[n:] {
+			if !indexable(s.Output.PubKeyHash) {
+				continue
+			}
+			if err := txn.Set(addrUTXOKey(s.Output.PubKeyHash, s.TxID, s.Out), ToHex(int64(s.Output.Value))); err != nil {
+				return err
+			}
+			if err := txn.Delete(addrTxKey(s.Output.PubKeyHash, block.Height, tx.ID)); err != nil {
+				return err
+			}
+		}
+		spent = spent[:n]
+	}
+
+	return nil
+}
+
+// addressOutputs return the unspent outputs locked with the pubkey hash from the address index in txn
+func addressOutputs(txn *badger.Txn, pubKeyHash []byte) ([]addressOutput, error) {
+	var outputs []addressOutput
+	if !indexable(pubKeyHash) {
+		return outputs, nil
+	}
+
+	prefix := append(append([]byte{}, addrUTXOPrefix...), pubKeyHash...)
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		k := item.KeyCopy(nil)[len(prefix):]
+		if len(k) <= 4 {
+			return nil, fmt.Errorf("invalid address index key %x", item.Key())
+		}
+		txID, index := k[:len(k)-4], int(binary.BigEndian.Uint32(k[len(k)-4:]))
+
+		err := item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return fmt.Errorf("invalid address index value of %x", item.Key())
+			}
+			outputs = append(outputs, addressOutput{txID, index, int(binary.BigEndian.Uint64(val))})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return outputs, nil
+}
+
+// AddressHistory return the transactions of the chain which paid to or spent from the pubkey hash,
+// from the lowest height. It returns ErrNoAddressIndex when the address index is not kept.
+func (chain *Blockchain) AddressHistory(pubKeyHash []byte) ([]AddressTx, error) {
+	var history []AddressTx
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		enabled, err := hasAddressIndex(txn)
+		if err != nil {
+			return err
+		}
+		if !enabled {
+			return ErrNoAddressIndex
+		}
+
+		prefix := append(append([]byte{}, addrTxPrefix...), pubKeyHash...)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				entry, err := DeserializeAddressTx(val)
+				if err != nil {
+					return err
+				}
+				history = append(history, entry)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return history, err
+}
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestAddressHistory(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	miner, other := wallet.MakeWallet(), wallet.MakeWallet()
+	hash := wallet.PublicKeyHash(w.PublicKey)
+
+	if _, err := chain.AddressHistory(hash); !errors.Is(err, ErrNoAddressIndex) {
+		t.Fatalf("history without the index returned %v, want %v", err, ErrNoAddressIndex)
+	}
+
+	// 開啟前的區塊由 EnableAddressIndex 建索引，之後的區塊在連接時建
+	genesis := lastBlock(t, chain)
+	coinbase := genesis.Transactions[0]
+	first := &Transaction{nil, []TxInput{{coinbase.ID, 0, nil, w.PublicKey, nil, 0}}, []TxOutput{
+		*NewTXOutput(30, string(other.Address())),
+		*NewTXOutput(coinbase.Outputs[0].Value-31, string(w.Address())),
+	}, 0}
+	if err := first.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(coinbase.ID): *coinbase}); err != nil {
+		t.Fatal(err)
+	}
+	first.ID = first.Hash()
+	acceptOn(t, chain, genesis, string(miner.Address()), first)
+
+	if err := chain.EnableAddressIndex(); err != nil {
+		t.Fatal(err)
+	}
+	second := spend(t, w, first, 1, 1)
+	tip := acceptOn(t, chain, lastBlock(t, chain), string(miner.Address()), second)
+
+	history, err := chain.AddressHistory(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []AddressTx{
+		{coinbase.ID, 0, coinbase.Outputs[0].Value, 0},
+		{first.ID, 1, first.Outputs[1].Value, coinbase.Outputs[0].Value},
+		{second.ID, 2, second.Outputs[0].Value, first.Outputs[1].Value},
+	}
+	if !reflect.DeepEqual(history, want) {
+		t.Errorf("history %+v, want %+v", history, want)
+	}
+	checkIndexedCoins(t, chain, w, []int{second.Outputs[0].Value})
+
+	// 斷開區塊後索引也要還原
+	if _, err := chain.DisconnectBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if history, err = chain.AddressHistory(hash); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(history, want[:2]) {
+		t.Errorf("history after disconnecting block %d: %+v, want %+v", tip.Height, history, want[:2])
+	}
+	checkIndexedCoins(t, chain, w, []int{first.Outputs[1].Value})
+}
+
+// checkIndexedCoins check the coins of w found with the address index are want
+func checkIndexedCoins(t *testing.T, chain *Blockchain, w *wallet.Wallet, want []int) {
+	t.Helper()
+
+	coins, err := UTXOSet{chain}.FindCoins(string(w.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := coinValues(coins); !sameValues(got, want) {
+		t.Errorf("coins %v, want %v", got, want)
+	}
+}
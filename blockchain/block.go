@@ -2,77 +2,170 @@ package blockchain
 
 import (
 	"bytes"
-	"crypto/sha256"
-	"encoding/gob"
+	"context"
+	"fmt"
 	"log"
+	"time"
 )
 
+// BlockVersion is the version of the block format.
+// Blocks of version 2 follow the coinbase maturity rule. Blocks of version 3 only accept low-S signatures,
+// which sign the values of the spent outputs. Blocks of version 4 only accept unlocking scripts which push
+// their values the shortest way and leave one value on the stack. Blocks of version 5 hash the binary encoding of
+// their header, see BlockHeader.Bytes. A block's version is never below its previous block's,
+// nor below the version ChainParams.VersionHeights require from its height.
+const BlockVersion = 5
+
+// BlockHeader is the part of a block that is hashed by the proof of work
+type BlockHeader struct {
+	Version    int
+	Height     int
+	Timestamp  int64 // unix time in seconds
+	PrevHash   []byte
+	MerkleRoot []byte // the root of the block's transactions Merkle tree
+	Bits       uint32 // the target of the proof of work
+	Nonce      int
+}
+
 // Block represent the data of a block
 type Block struct {
+	BlockHeader
 	Hash         []byte
 	Transactions []*Transaction
-	PrevHash     []byte
-	Nonce        int
 }
 
-// HashTransactions hash the block's slice of Transaction
+// Bytes return the header bytes hashed by the proof of work, the binary encoding of version 4 of the fields
+// from block version 5. Older blocks join the fields, where the end of PrevHash and the start of MerkleRoot
+// cannot be told apart, and keep it so their hashes do not change.
+func (h *BlockHeader) Bytes() []byte {
+	if h.Version >= 5 {
+		e := newEncoderVersion(4)
+		e.writeInt(int64(h.Version))
+		e.writeInt(int64(h.Height))
+		e.writeInt(h.Timestamp)
+		e.writeBytes(h.PrevHash)
+		e.writeBytes(h.MerkleRoot)
+		e.writeUint32(h.Bits)
+		e.writeInt(int64(h.Nonce))
+		return e.Bytes()
+	}
+
+	return bytes.Join(
+		[][]byte{
+			ToHex(int64(h.Version)),
+			ToHex(int64(h.Height)),
+			ToHex(h.Timestamp),
+			h.PrevHash,
+			h.MerkleRoot,
+			ToHex(int64(h.Bits)),
+			ToHex(int64(h.Nonce)),
+		}, []byte{})
+}
+
+// HashTransactions return the Merkle root of the block's transactions
 func (b *Block) HashTransactions() []byte {
+	return b.MerkleTree().Root()
+}
+
+// MerkleTree build the Merkle tree whose leaves are the block's tx.ID
+func (b *Block) MerkleTree() *MerkleTree {
 	var txHashes [][]byte
-	var txHash [32]byte
 
-	// txHashes is a slice of all tx.ID in the block
 	for _, tx := range b.Transactions {
 		txHashes = append(txHashes, tx.ID)
 	}
 
-	// txHash is the hash of transaction which is encrypted from txHashes
-	txHash = sha256.Sum256(bytes.Join(txHashes, []byte{}))
-	return txHash[:]
+	return NewMerkleTree(txHashes)
+}
+
+// MerkleProof return the inclusion proof of the transaction with the given ID
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
+	for i, tx := range b.Transactions {
+		if bytes.Equal(tx.ID, txID) {
+			return b.MerkleTree().Proof(i)
+		}
+	}
 
+	return nil, fmt.Errorf("%w: %x is not in the block", ErrTxNotFound, txID)
 }
 
-// CreateBlock create a new Block type
-func CreateBlock(txs []*Transaction, prevHash []byte) *Block {
-	block := &Block{[]byte{}, txs, prevHash, 0}
-	// block.DeriveHash()
+// NewBlock create a Block on top of prevHash at the given height and target bits,
+// the nonce is not searched yet
+func NewBlock(txs []*Transaction, prevHash []byte, height int, bits uint32) *Block {
+	header := BlockHeader{
+		Version:   BlockVersion,
+		Height:    height,
+		Timestamp: time.Now().Unix(),
+		PrevHash:  prevHash,
+		Bits:      bits,
+	}
+	block := &Block{header, []byte{}, txs}
+	block.MerkleRoot = block.HashTransactions()
 
-	pow := NewProof(block)
-	nonce, hash := pow.Run()
+	return block
+}
 
-	block.Hash = hash[:]
-	block.Nonce = nonce
+// CreateBlock create a new Block type on top of prevHash and mine it with every CPU.
+// Without a cancellable context mining always ends with a valid block.
+func CreateBlock(txs []*Transaction, prevHash []byte, height int, bits uint32) *Block {
+	block := NewBlock(txs, prevHash, height, bits)
+
+	NewMiner().MineBlock(context.Background(), block)
 
 	return block
 }
 
-// Genesis create the first block
-func Genesis(coinbase *Transaction) *Block {
-	return CreateBlock([]*Transaction{coinbase}, []byte{})
+// Genesis create the first block with the easiest target of the chain
+func Genesis(coinbase *Transaction, params *ChainParams) *Block {
+	return CreateBlock([]*Transaction{coinbase}, []byte{}, 0, params.PowLimitBits)
 }
 
-// Serialize turn Block into slice of byte for store in BadgerDB
+// Serialize turn Block into slice of byte for store in BadgerDB and send to peers
 func (b *Block) Serialize() []byte {
-	var res bytes.Buffer
-	encoder := gob.NewEncoder(&res)
-
-	err := encoder.Encode(b)
-	Handle(err)
+	e := newEncoder()
+	e.writeInt(int64(b.Version))
+	e.writeInt(int64(b.Height))
+	e.writeInt(b.Timestamp)
+	e.writeBytes(b.PrevHash)
+	e.writeBytes(b.MerkleRoot)
+	e.writeUint32(b.Bits)
+	e.writeInt(int64(b.Nonce))
+	e.writeBytes(b.Hash)
+
+	e.writeUint32(uint32(len(b.Transactions)))
+	for _, tx := range b.Transactions {
+		e.writeTransaction(tx)
+	}
 
-	return res.Bytes()
+	return e.Bytes()
 }
 
 // Deserialize turn slice of byte into Block
-func Deserialize(data []byte) *Block {
+func Deserialize(data []byte) (*Block, error) {
 	var block Block
-	decoder := gob.NewDecoder(bytes.NewReader(data))
-
-	err := decoder.Decode(&block)
-	Handle(err)
+	d := newDecoder(data)
+
+	block.Version = int(d.readInt())
+	block.Height = int(d.readInt())
+	block.Timestamp = d.readInt()
+	block.PrevHash = d.readBytes()
+	block.MerkleRoot = d.readBytes()
+	block.Bits = d.readUint32()
+	block.Nonce = int(d.readInt())
+	block.Hash = d.readBytes()
+
+	n := d.readCount()
+	for i := 0; i < n && d.err == nil; i++ {
+		block.Transactions = append(block.Transactions, d.readTransaction())
+	}
 
-	return &block
+	if err := d.finish(); err != nil {
+		return nil, err
+	}
+	return &block, nil
 }
 
-// Handle handle error simply
+// Handle panic on errors which can only come from a bug, like failing to encode our own types
 func Handle(err error) {
 	if err != nil {
 		log.Panic(err)
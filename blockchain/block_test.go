@@ -0,0 +1,54 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestProofOfWorkHashesHeader(t *testing.T) {
+	address := string(wallet.MakeWallet().Address())
+	block := CreateBlock([]*Transaction{CoinbaseTx(address, "", 20)}, bytes.Repeat([]byte{1}, 32), 1, testParams().PowLimitBits)
+
+	pow := NewProof(block)
+	if !pow.Validate() {
+		t.Fatal("the mined block does not meet its target")
+	}
+	hash := sha256.Sum256(block.BlockHeader.Bytes())
+	if !bytes.Equal(block.Hash, hash[:]) || !bytes.Equal(pow.Hash(), hash[:]) {
+		t.Fatalf("block hash %x, want the hash of the header %x", block.Hash, hash)
+	}
+
+	// 只有 header 被 hash，交易要透過 Merkle root 改變 hash
+	block.Transactions = append(block.Transactions, CoinbaseTx(address, "", 20))
+	if !bytes.Equal(pow.Hash(), hash[:]) {
+		t.Error("changing the transactions without the Merkle root changed the hash")
+	}
+	block.MerkleRoot = block.HashTransactions()
+	if bytes.Equal(pow.Hash(), hash[:]) {
+		t.Error("changing the Merkle root did not change the hash")
+	}
+}
+
+func TestHeaderFieldsChangeHash(t *testing.T) {
+	header := BlockHeader{BlockVersion, 7, 1600000000, bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32), 0x207fffff, 42}
+	changes := map[string]func(h *BlockHeader){
+		"Version":    func(h *BlockHeader) { h.Version++ },
+		"Height":     func(h *BlockHeader) { h.Height++ },
+		"Timestamp":  func(h *BlockHeader) { h.Timestamp++ },
+		"PrevHash":   func(h *BlockHeader) { h.PrevHash = bytes.Repeat([]byte{3}, 32) },
+		"MerkleRoot": func(h *BlockHeader) { h.MerkleRoot = bytes.Repeat([]byte{3}, 32) },
+		"Bits":       func(h *BlockHeader) { h.Bits++ },
+		"Nonce":      func(h *BlockHeader) { h.Nonce++ },
+	}
+
+	for name, change := range changes {
+		changed := header
+		change(&changed)
+		if bytes.Equal(changed.Bytes(), header.Bytes()) {
+			t.Errorf("changing %s did not change the header bytes", name)
+		}
+	}
+}
@@ -2,19 +2,17 @@ package blockchain
 
 import (
 	"bytes"
+	"context"
 	"crypto/ecdsa"
 	"encoding/hex"
-	"errors"
 	"fmt"
 	"os"
-	"runtime"
+	"path/filepath"
 
 	"github.com/dgraph-io/badger"
 )
 
 const (
-	dbPath = "./tmp/blocks"
-	dbFile = "./tmp/blocks/MANIFEST"
 	// GenesisData is the data of the first block
 	genesisData = "First Transaction from Genesis" // genesis arbitrary data for input
 )
@@ -23,6 +21,11 @@ const (
 type Blockchain struct {
 	LastHash []byte
 	Database *badger.DB
+	Params   *ChainParams
+	Miner    *Miner
+	Options  Options
+
+	subscribers []func(TipChange)
 }
 
 // Iterator ...
@@ -31,84 +34,172 @@ type Iterator struct {
 	Database    *badger.DB
 }
 
-// InitBlockchain init the first Blockchain
-func InitBlockchain(address string) *Blockchain {
-	if DBexists() {
-		fmt.Println("Blockchain already exists")
-		runtime.Goexit()
+// InitBlockchain init the first Blockchain in opts.DBPath(), it returns ErrChainExists when there is already one
+func InitBlockchain(address string, opts Options) (*Blockchain, error) {
+	if err := checkAddress(address); err != nil {
+		return nil, err
+	}
+	if DBexists(opts.DBPath()) {
+		return nil, ErrChainExists
 	}
 
-	opts := badger.DefaultOptions(dbPath)
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
-
-	db, err := badger.Open(opts)
-	Handle(err)
+	db, err := openDB(opts.DBPath())
+	if err != nil {
+		return nil, err
+	}
 
-	cbtx := CoinbaseTx(address, genesisData)
-	genesis := Genesis(cbtx)
+	cbtx := CoinbaseTx(address, genesisData, opts.params().Subsidy(0))
+	genesis := Genesis(cbtx, opts.params())
 	fmt.Println("Genesis created")
 
-	// set key: genesis.Hash, lh
-	err = db.Update(func(txn *badger.Txn) error {
-		err = txn.Set(genesis.Hash, genesis.Serialize())
-		Handle(err)
-		err = txn.Set([]byte("lh"), genesis.Hash)
-
-		return err
-	})
-	Handle(err)
-
-	lastHash := genesis.Hash
+	// 空的 chain 接受的第一個區塊就是創世區塊
+	blockchain := Blockchain{nil, db, opts.params(), NewMiner(), opts, nil}
+	if err := blockchain.AcceptBlock(genesis); err != nil {
+		db.Close()
+		return nil, err
+	}
 
-	blockchain := Blockchain{lastHash, db}
-	return &blockchain
+	return &blockchain, nil
 }
 
-// ContinueBlockchain find lasthash in DB, set lasthash and db into Blockchain, and return it
-func ContinueBlockchain(address string) *Blockchain {
-	if DBexists() == false {
-		fmt.Println("No existing blockchain found, create one!")
-		runtime.Goexit()
+// ContinueBlockchain find lasthash in opts.DBPath(), set lasthash and db into Blockchain, and return it.
+// A reorganization which was stopped in the middle is finished first.
+// It returns ErrChainNotFound when there is no chain yet, and ErrDatabaseEncoding when the database
+// is not stored with EncodingVersion.
+func ContinueBlockchain(address string, opts Options) (*Blockchain, error) {
+	if DBexists(opts.DBPath()) == false {
+		return nil, ErrChainNotFound
 	}
 
-	opts := badger.DefaultOptions(dbPath)
-	opts.Dir = dbPath
-	opts.ValueDir = dbPath
-
-	db, err := badger.Open(opts)
-	Handle(err)
+	db, err := openDB(opts.DBPath())
+	if err != nil {
+		return nil, err
+	}
 
 	var lastHash []byte
 	// get lh
-	err = db.Update(func(txn *badger.Txn) error {
+	err = db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("lh"))
-		Handle(err)
+		if err == badger.ErrKeyNotFound {
+			return ErrChainNotFound
+		}
+		if err != nil {
+			return err
+		}
+
+		lastHash, err = item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
 
-		err = item.Value(func(val []byte) error {
-			lastHash = val
+		// 用 gob 儲存的舊資料庫沒有 format，要先轉換
+		item, err = txn.Get(formatKey)
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: the database uses gob, migrate it with migratedb", ErrDatabaseEncoding)
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) == 1 && val[0] < EncodingVersion {
+				return fmt.Errorf("%w: the database uses version %d, migrate it with migratedb", ErrDatabaseEncoding, val[0])
+			}
+			if !bytes.Equal(val, []byte{EncodingVersion}) {
+				return fmt.Errorf("%w: version %x", ErrDatabaseEncoding, val)
+			}
 			return nil
 		})
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
 
-		return err
+	chain := Blockchain{lastHash, db, opts.params(), NewMiner(), opts, nil}
+	// 上次停在重組的中間就先把它做完
+	if err := chain.recoverReorg(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &chain, nil
+}
 
-	})
-	Handle(err)
+// OpenBlockchain open the chain in opts.DBPath() like ContinueBlockchain,
+// but create an empty database without any block when there is none.
+// The first block accepted by the empty chain is its genesis block, e.g. one received from a peer.
+func OpenBlockchain(opts Options) (*Blockchain, error) {
+	if DBexists(opts.DBPath()) {
+		chain, err := ContinueBlockchain("", opts)
+		if err != ErrChainNotFound {
+			return chain, err
+		}
+	}
+
+	db, err := openDB(opts.DBPath())
+	if err != nil {
+		return nil, err
+	}
 
-	chain := Blockchain{lastHash, db}
-	return &chain
+	chain := Blockchain{nil, db, opts.params(), NewMiner(), opts, nil}
+	return &chain, nil
 }
 
-// FindTransaction return the transaction of the given ID
+// openDB open the badger database at dbPath
+func openDB(dbPath string) (*badger.DB, error) {
+	if err := os.MkdirAll(dbPath, 0755); err != nil {
+		return nil, err
+	}
+
+	opts := badger.DefaultOptions(dbPath)
+	opts.Dir = dbPath
+	opts.ValueDir = dbPath
+
+	return badger.Open(opts)
+}
+
+// FindTransaction return the transaction of the chain with the given ID, or ErrTxNotFound.
+// It looks the block up in the transaction index, and walks the chain back from the tip without one.
 func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
+	tx, _, err := chain.findTransaction(ID)
+	return tx, err
+}
+
+// findTransaction is FindTransaction, it also return the height of the transaction's block
+func (chain *Blockchain) findTransaction(ID []byte) (Transaction, int, error) {
+	indexed, err := chain.HasTxIndex()
+	if err != nil {
+		return Transaction{}, 0, err
+	}
+	if indexed {
+		hash, position, found, err := chain.txLocation(ID)
+		if err != nil {
+			return Transaction{}, 0, err
+		}
+		if !found {
+			return Transaction{}, 0, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
+		}
+
+		block, err := chain.GetBlockByHash(hash)
+		if err != nil {
+			return Transaction{}, 0, err
+		}
+		if position >= len(block.Transactions) || !bytes.Equal(block.Transactions[position].ID, ID) {
+			return Transaction{}, 0, fmt.Errorf("transaction index points %x to position %d of block %x, rebuild it with reindexutxo", ID, position, hash)
+		}
+		return *block.Transactions[position], block.Height, nil
+	}
+
 	iter := chain.CreateIterator()
 
-	for {
-		block := iter.Next()
+	for len(iter.CurrentHash) != 0 {
+		block, err := iter.Next()
+		if err != nil {
+			return Transaction{}, 0, err
+		}
 
 		for _, tx := range block.Transactions {
 			if bytes.Compare(tx.ID, ID) == 0 {
-				return *tx, nil
+				return *tx, block.Height, nil
 			}
 		}
 
@@ -118,46 +209,75 @@ func (chain *Blockchain) FindTransaction(ID []byte) (Transaction, error) {
 
 	}
 
-	return Transaction{}, errors.New("Transaction does not exist")
+	return Transaction{}, 0, fmt.Errorf("%w: %x", ErrTxNotFound, ID)
 }
 
-// SignTransaction sign the transaction with privateKey
-func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) {
+// prevTransactions find the transactions spent by the inputs of tx
+func (chain *Blockchain) prevTransactions(tx *Transaction) (map[string]Transaction, error) {
 	prevTXs := make(map[string]Transaction)
 
 	for _, in := range tx.Inputs {
 		prevTX, err := chain.FindTransaction(in.ID)
-		Handle(err)
+		if err != nil {
+			return nil, err
+		}
 		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
 	}
 
-	tx.Sign(privKey, prevTXs)
+	return prevTXs, nil
+}
+
+// SignTransaction sign the transaction with privateKey
+func (chain *Blockchain) SignTransaction(tx *Transaction, privKey ecdsa.PrivateKey) error {
+	prevTXs, err := chain.prevTransactions(tx)
+	if err != nil {
+		return err
+	}
+
+	return tx.Sign(privKey, prevTXs)
+}
+
+// SignMultisigTransaction add the signatures of privateKey to the multisig inputs of the transaction,
+// and return how many inputs it signed
+func (chain *Blockchain) SignMultisigTransaction(tx *Transaction, privKey ecdsa.PrivateKey) (int, error) {
+	prevTXs, err := chain.prevTransactions(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	return tx.SignMultisig(privKey, prevTXs)
 }
 
 // VerifyTransaction verify the transaction
-func (chain *Blockchain) VerifyTransaction(tx *Transaction) bool {
-	prevTXs := make(map[string]Transaction)
+func (chain *Blockchain) VerifyTransaction(tx *Transaction) (bool, error) {
+	if tx.IsCoinbase() {
+		return true, nil
+	}
 
-	for _, in := range tx.Inputs {
-		prevTX, err := chain.FindTransaction(in.ID)
-		Handle(err)
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	prevTXs, err := chain.prevTransactions(tx)
+	if err != nil {
+		return false, err
 	}
 
-	return tx.Verify(prevTXs)
+	return tx.Verify(prevTXs), nil
 }
 
 // FindUTXO return mapping of address to TxOutputs
-func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
+func (chain *Blockchain) FindUTXO() (map[string]TxOutputs, error) {
 	UTXO := make(map[string]TxOutputs)
 	spentTXOs := make(map[string][]int)
 
 	iter := chain.CreateIterator()
 
 	for {
-		block := iter.Next()
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
 
-		for _, tx := range block.Transactions {
+		// 從後面的交易往前，同一個區塊裡被花掉的 output 才會先被記錄
+		for i := len(block.Transactions) - 1; i >= 0; i-- {
+			tx := block.Transactions[i]
 			txID := hex.EncodeToString(tx.ID)
 
 		Outputs:
@@ -171,7 +291,8 @@ func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
 				}
 
 				outs := UTXO[txID]
-				outs.Outputs = append(outs.Outputs, out)
+				outs.Height, outs.Coinbase = block.Height, tx.IsCoinbase()
+				outs.Add(outIdx, out)
 				UTXO[txID] = outs
 			}
 
@@ -190,47 +311,91 @@ func (chain *Blockchain) FindUTXO() map[string]TxOutputs {
 		}
 	}
 
-	return UTXO
+	return UTXO, nil
+}
 
+// AddBlock mine a new block with the transactions on top of the last block and store it
+func (chain *Blockchain) AddBlock(transactions []*Transaction) (*Block, error) {
+	return chain.MineBlock(context.Background(), transactions)
 }
 
-// AddBlock add new block in Blockchain's Block
-func (chain *Blockchain) AddBlock(transactions []*Transaction) *Block {
-	var lastHash []byte
+// MineBlock mine a new block on top of the last block with chain.Miner and store it.
+// Nothing is stored when ctx is cancelled before the block is mined.
+func (chain *Blockchain) MineBlock(ctx context.Context, transactions []*Transaction) (*Block, error) {
+	newBlock, err := chain.NewBlockTemplate(transactions)
+	if err != nil {
+		return nil, err
+	}
 
-	err := chain.Database.View(func(txn *badger.Txn) error {
-		// get lashHash
-		item, err := txn.Get([]byte("lh"))
-		Handle(err)
+	if err := chain.mineTemplate(ctx, newBlock); err != nil {
+		return nil, err
+	}
 
-		err = item.Value(func(val []byte) error {
-			lastHash = val
-			return nil
-		})
+	return newBlock, nil
+}
+
+// MineMempool mine a new block of the pool's transactions with a coinbase paying address and store it,
+// the mined transactions are removed from the pool
+func (chain *Blockchain) MineMempool(ctx context.Context, pool *Mempool, address string) (*Block, error) {
+	newBlock, err := pool.NewBlockTemplate(address)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := chain.mineTemplate(ctx, newBlock); err != nil {
+		return nil, err
+	}
+	pool.BlockConnected(newBlock)
+
+	return newBlock, nil
+}
+
+// mineTemplate search the nonce of the block template with chain.Miner and store the block
+func (chain *Blockchain) mineTemplate(ctx context.Context, block *Block) error {
+	if err := chain.Miner.MineBlock(ctx, block); err != nil {
 		return err
-	})
-	Handle(err)
+	}
 
-	// create new block
-	newBlock := CreateBlock(transactions, lastHash)
+	return chain.AcceptBlock(block)
+}
 
-	err = chain.Database.Update(func(txn *badger.Txn) error {
+// NewBlockTemplate create the unmined block on top of the last block,
+// with the target bits and a timestamp the consensus rules expect
+func (chain *Blockchain) NewBlockTemplate(transactions []*Transaction) (*Block, error) {
+	lastBlock, err := chain.GetBlockByHash(chain.LastHash)
+	if err != nil {
+		return nil, err
+	}
 
-		// set newBlock.Hash and lh
-		err = txn.Set(newBlock.Hash, newBlock.Serialize())
-		Handle(err)
+	bits, err := chain.NextBits(lastBlock)
+	if err != nil {
+		return nil, err
+	}
 
-		err = txn.Set([]byte("lh"), newBlock.Hash)
+	// create new block
+	newBlock := NewBlock(transactions, lastBlock.Hash, lastBlock.Height+1, bits)
 
-		// set new LastHash to chain
-		chain.LastHash = newBlock.Hash
+	// timestamp 必須大於前面區塊的 median time
+	mtp, err := chain.MedianTimePast(lastBlock)
+	if err != nil {
+		return nil, err
+	}
+	if newBlock.Timestamp <= mtp {
+		newBlock.Timestamp = mtp + 1
+	}
 
-		return err
-	})
-	Handle(err)
+	return newBlock, nil
+}
 
-	return newBlock
+// LastBlock return the block at the tip of the chain
+func (chain *Blockchain) LastBlock() (*Block, error) {
+	return chain.GetBlockByHash(chain.LastHash)
+}
 
+// GetBlockByHash return the stored block with the hash, or ErrBlockNotFound
+func (chain *Blockchain) GetBlockByHash(hash []byte) (*Block, error) {
+	iter := Iterator{hash, chain.Database}
+	return iter.Next()
 }
 
 // CreateIterator return type Iterator for iterating blockchain
@@ -239,32 +404,36 @@ func (chain *Blockchain) CreateIterator() *Iterator {
 	return &iter
 }
 
-// Next return current Block from Iterator and set new iter.CurrentHash
-func (iter *Iterator) Next() *Block {
+// Next return current Block from Iterator and set new iter.CurrentHash,
+// it returns ErrBlockNotFound when the current hash is not stored
+func (iter *Iterator) Next() (*Block, error) {
 	var block *Block
 	err := iter.Database.View(func(txn *badger.Txn) error {
 		item, err := txn.Get(iter.CurrentHash)
-		Handle(err)
+		if err == badger.ErrKeyNotFound {
+			return fmt.Errorf("%w: %x", ErrBlockNotFound, iter.CurrentHash)
+		}
+		if err != nil {
+			return err
+		}
 
-		err = item.Value(func(val []byte) error {
-			encodedBlock := val
-			block = Deserialize(encodedBlock)
-			return nil
+		return item.Value(func(val []byte) error {
+			block, err = Deserialize(val)
+			return err
 		})
-
-		return err
-
 	})
-	Handle(err)
+	if err != nil {
+		return nil, err
+	}
 
 	iter.CurrentHash = block.PrevHash
 
-	return block
+	return block, nil
 }
 
-// DBexists check blockchain exists
-func DBexists() bool {
-	if _, err := os.Stat(dbFile); os.IsNotExist(err) {
+// DBexists check blockchain exists in the badger directory dbPath
+func DBexists(dbPath string) bool {
+	if _, err := os.Stat(filepath.Join(dbPath, "MANIFEST")); os.IsNotExist(err) {
 		return false
 	}
 
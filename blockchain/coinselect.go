@@ -0,0 +1,159 @@
+package blockchain
+
+import (
+	"crypto/rand"
+	"math/big"
+	"sort"
+)
+
+// maxBnBTries is the most branches SelectBranchAndBound walks before it gives up on an exact match
+const maxBnBTries = 100000
+
+// DefaultDustLimit is the dust limit of the send commands, without one only change
+// worth less than its fees goes to the miner, so nothing does without a fee rate
+const DefaultDustLimit = 0
+
+// SelectionTarget is what the coins picked by a CoinSelector must pay.
+// Every coin costs InputFee to spend, so a coin is worth its value minus InputFee.
+type SelectionTarget struct {
+	Amount    int // the payment and the fee of the transaction without inputs and change
+	InputFee  int // the fee of one more input
+	ChangeFee int // the fee of the change output
+	DustLimit int // change up to DustLimit is dust whatever the fees are
+}
+
+// CostOfChange is what a change output costs: its own fee and the fee of spending it later, at least DustLimit.
+// Change which is not worth more than that is dust, it is left to the miner instead.
+func (t SelectionTarget) CostOfChange() int {
+	if cost := t.ChangeFee + t.InputFee; cost > t.DustLimit {
+		return cost
+	}
+	return t.DustLimit
+}
+
+// effectiveValue return the value of the coin minus the fee of spending it
+func (t SelectionTarget) effectiveValue(coin Coin) int {
+	return coin.Output.Value - t.InputFee
+}
+
+// CoinSelector pick coins whose effective values add up to at least target.Amount,
+// it returns nil when the coins cannot pay it. The coins must not be changed.
+type CoinSelector func(coins []Coin, target SelectionTarget) []Coin
+
+// DefaultCoinSelector is the name of the CoinSelector used when none is chosen
+const DefaultCoinSelector = "bnb"
+
+// CoinSelectors are the coin selection strategies by name
+var CoinSelectors = map[string]CoinSelector{
+	"largest": SelectLargestFirst,
+	"bnb":     SelectBranchAndBound,
+	"random":  SelectRandom,
+}
+
+// SelectLargestFirst take the largest coins until they pay the target, which spends as few coins as possible
+func SelectLargestFirst(coins []Coin, target SelectionTarget) []Coin {
+	sorted := sortedCoins(coins, target)
+	return accumulate(sorted, target)
+}
+
+// SelectBranchAndBound search the coins whose effective values pay the target exactly, or with less left over
+// than a change output costs, so the transaction needs no change. Without such coins it selects largest first.
+func SelectBranchAndBound(coins []Coin, target SelectionTarget) []Coin {
+	sorted := sortedCoins(coins, target)
+
+	// rest[i] 是從 i 開始所有 coin 的有效價值總和，加上去也不夠就不用再往下找
+	rest := make([]int, len(sorted)+1)
+	for i := len(sorted) - 1; i >= 0; i-- {
+		rest[i] = rest[i+1] + target.effectiveValue(sorted[i])
+	}
+
+	upper := target.Amount + target.CostOfChange()
+	selected := make([]bool, len(sorted))
+	tries := 0
+
+	var search func(i, sum int) bool
+	search = func(i, sum int) bool {
+		tries++
+		if sum > upper || tries > maxBnBTries {
+			return false
+		}
+		if sum >= target.Amount {
+			return true
+		}
+		if i == len(sorted) || sum+rest[i] < target.Amount {
+			return false
+		}
+
+		selected[i] = true
+		if search(i+1, sum+target.effectiveValue(sorted[i])) {
+			return true
+		}
+		selected[i] = false
+
+		// 跟前一個一樣大的 coin 在前一個沒選時也不用選，結果都一樣
+		j := i + 1
+		for j < len(sorted) && sorted[j].Output.Value == sorted[i].Output.Value {
+			j++
+		}
+		return search(j, sum)
+	}
+
+	if !search(0, 0) {
+		return accumulate(sorted, target)
+	}
+
+	var picked []Coin
+	for i, coin := range sorted {
+		if selected[i] {
+			picked = append(picked, coin)
+		}
+	}
+	return picked
+}
+
+// SelectRandom take coins in a random order until they pay the target,
+// so the coins spent together do not tell which ones the wallet holds
+func SelectRandom(coins []Coin, target SelectionTarget) []Coin {
+	shuffled := positiveCoins(coins, target)
+
+	for i := len(shuffled) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return nil
+		}
+		j := int(n.Int64())
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	}
+
+	return accumulate(shuffled, target)
+}
+
+// positiveCoins return the coins worth more than the fee of spending them
+func positiveCoins(coins []Coin, target SelectionTarget) []Coin {
+	var positive []Coin
+	for _, coin := range coins {
+		if target.effectiveValue(coin) > 0 {
+			positive = append(positive, coin)
+		}
+	}
+	return positive
+}
+
+// sortedCoins return the positiveCoins from the largest
+func sortedCoins(coins []Coin, target SelectionTarget) []Coin {
+	sorted := positiveCoins(coins, target)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Output.Value > sorted[j].Output.Value })
+	return sorted
+}
+
+// accumulate take the coins in order until they pay the target, nil when all of them do not
+func accumulate(coins []Coin, target SelectionTarget) []Coin {
+	sum := 0
+	for i, coin := range coins {
+		sum += target.effectiveValue(coin)
+		if sum >= target.Amount {
+			return coins[:i+1]
+		}
+	}
+	return nil
+}
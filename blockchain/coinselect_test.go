@@ -0,0 +1,153 @@
+package blockchain
+
+import (
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// testCoins return coins of the values, the TxID of a coin is its position
+func testCoins(values ...int) []Coin {
+	var coins []Coin
+	for i, value := range values {
+		coins = append(coins, Coin{[]byte{byte(i)}, 0, TxOutput{value, nil, nil}, 0, false})
+	}
+	return coins
+}
+
+func coinValues(coins []Coin) []int {
+	var values []int
+	for _, coin := range coins {
+		values = append(values, coin.Output.Value)
+	}
+	return values
+}
+
+func sameValues(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestSelectLargestFirst(t *testing.T) {
+	coins := testCoins(1, 5, 10, 3)
+
+	got := coinValues(SelectLargestFirst(coins, SelectionTarget{Amount: 12}))
+	if !sameValues(got, []int{10, 5}) {
+		t.Errorf("selected %v, want [10 5]", got)
+	}
+
+	// 每個 coin 扣掉 InputFee 後才是能付的價值
+	got = coinValues(SelectLargestFirst(coins, SelectionTarget{Amount: 11, InputFee: 2}))
+	if !sameValues(got, []int{10, 5}) {
+		t.Errorf("selected %v with input fee 2, want [10 5]", got)
+	}
+	got = coinValues(SelectLargestFirst(coins, SelectionTarget{Amount: 12, InputFee: 2}))
+	if !sameValues(got, []int{10, 5, 3}) {
+		t.Errorf("selected %v with input fee 2, want [10 5 3]", got)
+	}
+}
+
+func TestSelectBranchAndBound(t *testing.T) {
+	coins := testCoins(10, 7, 5, 3)
+
+	tests := []struct {
+		target SelectionTarget
+		want   []int
+	}{
+		{SelectionTarget{Amount: 8}, []int{5, 3}},
+		{SelectionTarget{Amount: 15}, []int{10, 5}},
+		{SelectionTarget{Amount: 6, InputFee: 1}, []int{7}},
+		// 剩下的 2 是 dust，不用找零也可以
+		{SelectionTarget{Amount: 8, DustLimit: 2}, []int{10}},
+		// 沒有剛好的組合就從大的開始選
+		{SelectionTarget{Amount: 11}, []int{10, 7}},
+	}
+	for _, test := range tests {
+		got := coinValues(SelectBranchAndBound(coins, test.target))
+		if !sameValues(got, test.want) {
+			t.Errorf("target %+v: selected %v, want %v", test.target, got, test.want)
+		}
+	}
+}
+
+func TestSelectRandom(t *testing.T) {
+	coins := testCoins(1, 2, 3, 4, 5, 6, 7, 8)
+	target := SelectionTarget{Amount: 20, InputFee: 1}
+
+	for i := 0; i < 20; i++ {
+		sum := 0
+		for _, coin := range SelectRandom(coins, target) {
+			if coin.Output.Value <= target.InputFee {
+				t.Fatalf("selected coin of %d, which is not worth its input fee", coin.Output.Value)
+			}
+			sum += target.effectiveValue(coin)
+		}
+		if sum < target.Amount {
+			t.Fatalf("selected coins worth %d, want at least %d", sum, target.Amount)
+		}
+	}
+}
+
+func TestSelectInsufficientFunds(t *testing.T) {
+	coins := testCoins(1, 2, 3)
+
+	for name, selector := range CoinSelectors {
+		if got := selector(coins, SelectionTarget{Amount: 7}); got != nil {
+			t.Errorf("%s selected %v for more than all coins", name, coinValues(got))
+		}
+		// 扣掉 InputFee 後只剩 2 + 1
+		if got := selector(coins, SelectionTarget{Amount: 4, InputFee: 1}); got != nil {
+			t.Errorf("%s selected %v for more than the coins are worth", name, coinValues(got))
+		}
+	}
+}
+
+func TestCostOfChange(t *testing.T) {
+	if cost := (SelectionTarget{InputFee: 3, ChangeFee: 1, DustLimit: 2}).CostOfChange(); cost != 4 {
+		t.Errorf("cost of change %d, want the fees 4", cost)
+	}
+	if cost := (SelectionTarget{DustLimit: 2}).CostOfChange(); cost != 2 {
+		t.Errorf("cost of change %d without fees, want the dust limit 2", cost)
+	}
+}
+
+func TestNewTransactionDustLimit(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	from, to := string(w.Address()), string(wallet.MakeWallet().Address())
+	balance := lastBlock(t, chain).Transactions[0].Outputs[0].Value
+
+	tests := []struct {
+		amount  int
+		opts    TxOptions
+		outputs int
+	}{
+		// 沒有 dust limit 也沒有 fee rate 時，找零 1 也不會給礦工
+		{balance, TxOptions{}, 1},
+		{balance - 1, TxOptions{}, 2},
+		{balance - 5, TxOptions{DustLimit: 5}, 1},
+		{balance - 6, TxOptions{DustLimit: 5}, 2},
+		{balance - 1, TxOptions{DustLimit: 1}, 1},
+		{balance - 2, TxOptions{DustLimit: 1}, 2},
+	}
+	for _, test := range tests {
+		raw, err := NewRawTransaction(from, to, test.amount, 0, test.opts, &UTXOSet{chain})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(raw.Transaction.Outputs); n != test.outputs {
+			t.Errorf("amount %d of %d with dust limit %d: %d outputs, want %d", test.amount, balance, test.opts.DustLimit, n, test.outputs)
+		}
+	}
+
+	if _, err := NewRawTransaction(from, to, 1, 0, TxOptions{DustLimit: -1}, &UTXOSet{chain}); err == nil {
+		t.Error("created a transaction with a negative dust limit")
+	}
+}
@@ -0,0 +1,147 @@
+package blockchain
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+)
+
+// CompactToBig turn the compact target bits into a big.Int.
+// Like bitcoin, the first byte is the size in bytes and the other 3 bytes are the mantissa.
+func CompactToBig(compact uint32) *big.Int {
+	mantissa := compact & 0x007fffff
+	exponent := uint(compact >> 24)
+
+	target := new(big.Int)
+	if exponent <= 3 {
+		mantissa >>= 8 * (3 - exponent)
+		target.SetInt64(int64(mantissa))
+	} else {
+		target.SetInt64(int64(mantissa))
+		target.Lsh(target, 8*(exponent-3))
+	}
+
+	return target
+}
+
+// BigToCompact turn the target into the compact target bits
+func BigToCompact(target *big.Int) uint32 {
+	if target.Sign() <= 0 {
+		return 0
+	}
+
+	var mantissa uint32
+	exponent := uint(len(target.Bytes()))
+
+	if exponent <= 3 {
+		mantissa = uint32(target.Uint64())
+		mantissa <<= 8 * (3 - exponent)
+	} else {
+		tmp := new(big.Int).Rsh(target, 8*(exponent-3))
+		mantissa = uint32(tmp.Uint64())
+	}
+
+	// 最高位元是正負號，若被占用就把 mantissa 右移一個 byte
+	if mantissa&0x00800000 != 0 {
+		mantissa >>= 8
+		exponent++
+	}
+
+	return uint32(exponent<<24) | mantissa
+}
+
+// CalcWork return the expected number of hashes to mine a block with the target bits,
+// 2^256 / (target + 1) like bitcoin
+func CalcWork(bits uint32) *big.Int {
+	target := CompactToBig(bits)
+	if target.Sign() <= 0 {
+		return new(big.Int)
+	}
+
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	return numerator.Div(numerator, target.Add(target, big.NewInt(1)))
+}
+
+// NextBits return the target bits required for the block after prev.
+// Every RetargetInterval blocks the target is scaled by the time the last interval actually took,
+// from the block before it to prev, limited to a factor of 4 in either direction.
+func (chain *Blockchain) NextBits(prev *Block) (uint32, error) {
+	params := chain.Params
+
+	if prev == nil {
+		return params.PowLimitBits, nil
+	}
+
+	height := prev.Height + 1
+	if height%params.RetargetInterval != 0 {
+		return prev.Bits, nil
+	}
+
+	// 往回找這個區間前一個區塊，RetargetInterval 個間隔才會被量到。
+	// 第一次調整時區間從 genesis 開始，前面沒有區塊，就少量一個間隔
+	iter := Iterator{prev.PrevHash, chain.Database}
+	first := prev
+	for i := 0; i < params.RetargetInterval && first.Height > 0; i++ {
+		block, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+		first = block
+	}
+
+	expected := int64(params.TargetBlockTime.Seconds()) * int64(prev.Height-first.Height)
+	actual := prev.Timestamp - first.Timestamp
+	if actual < expected/4 {
+		actual = expected / 4
+	}
+	if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := CompactToBig(prev.Bits)
+	target.Mul(target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+
+	limit := CompactToBig(params.PowLimitBits)
+	if target.Cmp(limit) > 0 {
+		target = limit
+	}
+
+	return BigToCompact(target), nil
+}
+
+// ValidateProof check the block claims the expected target bits and its hash meets the target,
+// it returns an ErrInvalidBlock error with the reason otherwise
+func (chain *Blockchain) ValidateProof(block *Block) error {
+	var prev *Block
+
+	if len(block.PrevHash) != 0 {
+		var err error
+		if prev, err = chain.GetBlockByHash(block.PrevHash); err != nil {
+			return err
+		}
+	}
+
+	return chain.validateProof(block, prev)
+}
+
+// validateProof check the target bits and proof of work of the block on top of prev
+func (chain *Blockchain) validateProof(block, prev *Block) error {
+	bits, err := chain.NextBits(prev)
+	if err != nil {
+		return err
+	}
+	if block.Bits != bits {
+		return fmt.Errorf("%w: target bits %08x, expected %08x", ErrInvalidBlock, block.Bits, bits)
+	}
+
+	pow := NewProof(block)
+	if !bytes.Equal(block.Hash, pow.Hash()) {
+		return fmt.Errorf("%w: hash %x does not match the header", ErrInvalidBlock, block.Hash)
+	}
+	if !pow.Validate() {
+		return fmt.Errorf("%w: hash %x does not meet the target", ErrInvalidBlock, block.Hash)
+	}
+
+	return nil
+}
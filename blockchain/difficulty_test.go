@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"context"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// acceptAt mine a block on top of prev with the timestamp and accept it
+func acceptAt(t *testing.T, chain *Blockchain, prev *Block, address string, timestamp int64) *Block {
+	t.Helper()
+
+	block := mineOn(t, chain, prev, address)
+	block.Timestamp = timestamp
+	if err := NewMiner().MineBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AcceptBlock(block); err != nil {
+		t.Fatalf("accept block at height %d: %v", block.Height, err)
+	}
+	return block
+}
+
+func TestNextBits(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := testParams()
+	params.RetargetInterval = 4
+	chain, err := OpenBlockchain(Options{DataDir: dir, Params: params})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	defer closeTestChain(chain)
+	address := string(wallet.MakeWallet().Address())
+
+	blockTime := int64(params.TargetBlockTime.Seconds())
+	start := time.Now().Unix() - 100*blockTime
+	genesis := NewBlock([]*Transaction{CoinbaseTx(address, "", params.Subsidy(0))}, []byte{}, 0, params.PowLimitBits)
+	genesis.Timestamp = start
+	if err := NewMiner().MineBlock(context.Background(), genesis); err != nil {
+		t.Fatal(err)
+	}
+	if err := chain.AcceptBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+
+	// 區塊剛好每 TargetBlockTime 一個，難度不變
+	prev := genesis
+	for height := 1; height < 8; height++ {
+		prev = acceptAt(t, chain, prev, address, start+int64(height)*blockTime)
+		if prev.Bits != params.PowLimitBits {
+			t.Fatalf("block %d at the target block time has bits %08x, want %08x", height, prev.Bits, params.PowLimitBits)
+		}
+	}
+
+	// 快了一倍，target 減半
+	for height := 8; height < 12; height++ {
+		prev = acceptAt(t, chain, prev, address, start+7*blockTime+int64(height-7)*blockTime/2)
+	}
+	bits, err := chain.NextBits(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := new(big.Int).Div(CompactToBig(params.PowLimitBits), big.NewInt(2))
+	if bits != BigToCompact(want) {
+		t.Errorf("bits %08x after blocks twice as fast, want %08x", bits, BigToCompact(want))
+	}
+}
@@ -0,0 +1,318 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// EncodingVersion is the version byte every encoded value starts with.
+//
+// Blocks, transactions and the records of the database are encoded field by field in the order below,
+// so the same value always has the same bytes, and transaction IDs are the sha256 of them:
+//
+//	int      8 bytes, big endian two's complement
+//	uint32   4 bytes, big endian
+//	bytes    uint32 length followed by the bytes, nil and empty are the same
+//	list     uint32 count followed by the items
+//	bool     1 byte, 0 or 1
+//	string   bytes of the string
+//
+//	Transaction  ID bytes, Inputs list of TxInput, Outputs list of TxOutput, LockTime int
+//	TxInput      ID bytes, Out int, Signature bytes, PubKey bytes, Script bytes, Sequence int
+//	TxOutput     Value int, PubKeyHash bytes, Script bytes
+//	Block        Version int, Height int, Timestamp int, PrevHash bytes, MerkleRoot bytes, Bits uint32,
+//	             Nonce int, Hash bytes, Transactions list of Transaction
+//	BlockHeader  the Block fields up to Nonce, hashed by the proof of work from block version 5
+//	TxOutputs    Height int, Coinbase bool, Outputs list of Index int and TxOutput
+//	BlockUndo    Spent list of TxID bytes, Out int, Height int, Coinbase bool and TxOutput
+//	AddressTx    TxID bytes, Height int, Received int, Sent int
+//
+// Other packages encode their values, like the network messages, with Encoder and Decoder.
+// Values nested in another value, like the transactions of a block, have no version byte of their own.
+// Older versions are still read: version 1 had no Script in TxInput and TxOutput, version 2 had no LockTime,
+// Sequence and heights, and version 3 had no Coinbase. Transactions are hashed with version 3, or version 2
+// without LockTime and Sequence, so their IDs did not change.
+const EncodingVersion byte = 4
+
+// encoder write the binary encoding of values
+type encoder struct {
+	bytes.Buffer
+	version byte
+}
+
+// newEncoder return an encoder which wrote the version byte
+func newEncoder() *encoder {
+	return newEncoderVersion(EncodingVersion)
+}
+
+// newEncoderVersion return an encoder of an older version, which leaves out the fields added after it
+func newEncoderVersion(version byte) *encoder {
+	e := &encoder{version: version}
+	e.WriteByte(version)
+	return e
+}
+
+func (e *encoder) writeInt(v int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(v))
+	e.Write(b[:])
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.Write(b[:])
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeUint32(uint32(len(b)))
+	e.Write(b)
+}
+
+func (e *encoder) writeBool(v bool) {
+	if v {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+}
+
+func (e *encoder) writeTransaction(tx *Transaction) {
+	e.writeBytes(tx.ID)
+
+	e.writeUint32(uint32(len(tx.Inputs)))
+	for _, in := range tx.Inputs {
+		e.writeBytes(in.ID)
+		e.writeInt(int64(in.Out))
+		e.writeBytes(in.Signature)
+		e.writeBytes(in.PubKey)
+		e.writeBytes(in.Script)
+		if e.version >= 3 {
+			e.writeInt(int64(in.Sequence))
+		}
+	}
+
+	e.writeUint32(uint32(len(tx.Outputs)))
+	for _, out := range tx.Outputs {
+		e.writeOutput(out)
+	}
+
+	if e.version >= 3 {
+		e.writeInt(tx.LockTime)
+	}
+}
+
+func (e *encoder) writeOutput(out TxOutput) {
+	e.writeInt(int64(out.Value))
+	e.writeBytes(out.PubKeyHash)
+	e.writeBytes(out.Script)
+}
+
+// decoder read the binary encoding of values. The first error is kept and every later read returns zero values,
+// so a value is read field by field and the error checked once at the end with finish.
+type decoder struct {
+	data    []byte
+	version byte
+	err     error
+}
+
+// newDecoder return a decoder of data which read the version byte
+func newDecoder(data []byte) *decoder {
+	d := &decoder{data: data}
+	if len(data) == 0 {
+		d.err = fmt.Errorf("%w: no data", ErrInvalidEncoding)
+	} else if data[0] < 1 || data[0] > EncodingVersion {
+		d.err = fmt.Errorf("%w: unknown version %d", ErrInvalidEncoding, data[0])
+	} else {
+		d.version = data[0]
+		d.data = data[1:]
+	}
+	return d
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.err = fmt.Errorf("%w: %d bytes missing", ErrInvalidEncoding, n-len(d.data))
+		return nil
+	}
+
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) readInt() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.BigEndian.Uint64(b))
+}
+
+func (d *decoder) readUint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) readBool() bool {
+	b := d.next(1)
+	if b == nil {
+		return false
+	}
+	if b[0] > 1 {
+		d.err = fmt.Errorf("%w: bool of value %d", ErrInvalidEncoding, b[0])
+		return false
+	}
+	return b[0] == 1
+}
+
+func (d *decoder) readBytes() []byte {
+	n := d.readUint32()
+	if n == 0 {
+		return nil
+	}
+
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// readCount read the count of a list, every item has at least one byte so a larger count
+// than the remaining bytes is invalid and nothing too big is allocated
+func (d *decoder) readCount() int {
+	n := int(d.readUint32())
+	if d.err == nil && n > len(d.data) {
+		d.err = fmt.Errorf("%w: list of %d items in %d bytes", ErrInvalidEncoding, n, len(d.data))
+		return 0
+	}
+	return n
+}
+
+func (d *decoder) readTransaction() *Transaction {
+	tx := &Transaction{}
+	tx.ID = d.readBytes()
+
+	n := d.readCount()
+	for i := 0; i < n && d.err == nil; i++ {
+		in := TxInput{}
+		in.ID = d.readBytes()
+		in.Out = int(d.readInt())
+		in.Signature = d.readBytes()
+		in.PubKey = d.readBytes()
+		if d.version >= 2 {
+			in.Script = d.readBytes()
+		}
+		if d.version >= 3 {
+			in.Sequence = int(d.readInt())
+		}
+		tx.Inputs = append(tx.Inputs, in)
+	}
+
+	n = d.readCount()
+	for i := 0; i < n && d.err == nil; i++ {
+		tx.Outputs = append(tx.Outputs, d.readOutput())
+	}
+
+	if d.version >= 3 {
+		tx.LockTime = d.readInt()
+	}
+
+	return tx
+}
+
+func (d *decoder) readOutput() TxOutput {
+	out := TxOutput{}
+	out.Value = int(d.readInt())
+	out.PubKeyHash = d.readBytes()
+	if d.version >= 2 {
+		out.Script = d.readBytes()
+	}
+	return out
+}
+
+// finish return the first error, and an error when bytes are left after the value
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%w: %d bytes after the value", ErrInvalidEncoding, len(d.data))
+	}
+	return d.err
+}
+
+// Encoder write values of other packages with the binary encoding, it starts with the version byte
+type Encoder struct {
+	e *encoder
+}
+
+// NewEncoder return an Encoder of EncodingVersion
+func NewEncoder() *Encoder {
+	return &Encoder{newEncoder()}
+}
+
+// WriteInt write an int
+func (e *Encoder) WriteInt(v int) {
+	e.e.writeInt(int64(v))
+}
+
+// WriteBytes write bytes
+func (e *Encoder) WriteBytes(b []byte) {
+	e.e.writeBytes(b)
+}
+
+// WriteString write a string
+func (e *Encoder) WriteString(s string) {
+	e.e.writeBytes([]byte(s))
+}
+
+// WriteCount write the count of a list, the items are written after it
+func (e *Encoder) WriteCount(n int) {
+	e.e.writeUint32(uint32(n))
+}
+
+// Bytes return the encoded values
+func (e *Encoder) Bytes() []byte {
+	return e.e.Bytes()
+}
+
+// Decoder read values written by Encoder, like decoder the first error is kept and returned by Finish
+type Decoder struct {
+	d *decoder
+}
+
+// NewDecoder return a Decoder of data
+func NewDecoder(data []byte) *Decoder {
+	return &Decoder{newDecoder(data)}
+}
+
+// ReadInt read an int
+func (d *Decoder) ReadInt() int {
+	return int(d.d.readInt())
+}
+
+// ReadBytes read bytes
+func (d *Decoder) ReadBytes() []byte {
+	return d.d.readBytes()
+}
+
+// ReadString read a string
+func (d *Decoder) ReadString() string {
+	return string(d.d.readBytes())
+}
+
+// ReadCount read the count of a list
+func (d *Decoder) ReadCount() int {
+	return d.d.readCount()
+}
+
+// Finish return the first error, and an error when bytes are left after the values
+func (d *Decoder) Finish() error {
+	return d.d.finish()
+}
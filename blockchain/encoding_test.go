@@ -0,0 +1,179 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// testTransaction return a transaction which uses every field, the empty fields are nil like the decoder reads them
+func testTransaction() *Transaction {
+	tx := &Transaction{
+		nil,
+		[]TxInput{
+			{bytes.Repeat([]byte{1}, 32), 0, []byte{2, 3}, []byte{4, 5}, nil, 0},
+			{bytes.Repeat([]byte{6}, 32), 3, nil, nil, []byte{OpTrue}, 10},
+		},
+		[]TxOutput{
+			{50, bytes.Repeat([]byte{7}, 20), nil},
+			{-1, nil, []byte{OpTrue}},
+		},
+		1 << 40,
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func TestTransactionEncoding(t *testing.T) {
+	tx := testTransaction()
+
+	got, err := DeserializeTransaction(tx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(&got, tx) {
+		t.Fatalf("decoded %+v, want %+v", got, tx)
+	}
+	if !bytes.Equal(got.Hash(), tx.ID) {
+		t.Fatal("the decoded transaction has another ID")
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+	block := &Block{
+		BlockHeader{BlockVersion, 7, 1600000000, bytes.Repeat([]byte{1}, 32), nil, 0x207fffff, 42},
+		bytes.Repeat([]byte{2}, 32),
+		[]*Transaction{testTransaction(), testTransaction()},
+	}
+	block.MerkleRoot = block.HashTransactions()
+
+	got, err := Deserialize(block.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, block) {
+		t.Fatalf("decoded %+v, want %+v", got, block)
+	}
+}
+
+func TestRecordEncoding(t *testing.T) {
+	outs := TxOutputs{5, true, []UnspentOutput{{0, TxOutput{1, []byte{1}, nil}}, {3, TxOutput{2, nil, []byte{OpTrue}}}}}
+	gotOuts, err := DeserializeOutputs(outs.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotOuts, outs) {
+		t.Errorf("decoded outputs %+v, want %+v", gotOuts, outs)
+	}
+
+	undo := BlockUndo{[]SpentOutput{{[]byte{1}, 2, 3, true, TxOutput{4, []byte{5}, nil}}, {[]byte{6}, 0, 0, false, TxOutput{7, nil, []byte{OpTrue}}}}}
+	gotUndo, err := DeserializeUndo(undo.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotUndo, undo) {
+		t.Errorf("decoded undo %+v, want %+v", gotUndo, undo)
+	}
+
+	addrTx := AddressTx{[]byte{1, 2}, 3, 4, 5}
+	gotAddrTx, err := DeserializeAddressTx(addrTx.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotAddrTx, addrTx) {
+		t.Errorf("decoded address tx %+v, want %+v", gotAddrTx, addrTx)
+	}
+
+	raw := &RawTransaction{testTransaction(), []TxOutput{{1, []byte{1}, nil}, {2, nil, []byte{OpTrue}}}}
+	gotRaw, err := DeserializeRawTransaction(raw.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotRaw, raw) {
+		t.Errorf("decoded raw transaction %+v, want %+v", gotRaw, raw)
+	}
+}
+
+func TestOlderEncodingVersion(t *testing.T) {
+	tx := testTransaction()
+
+	// version 2 沒有 LockTime 和 Sequence
+	e := newEncoderVersion(2)
+	e.writeTransaction(tx)
+	got, err := DeserializeTransaction(e.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.LockTime != 0 || got.Inputs[1].Sequence != 0 {
+		t.Errorf("version 2 transaction has lock time %d and sequence %d, want 0", got.LockTime, got.Inputs[1].Sequence)
+	}
+	if !bytes.Equal(got.Inputs[1].Script, tx.Inputs[1].Script) || !bytes.Equal(got.Outputs[1].Script, tx.Outputs[1].Script) {
+		t.Error("version 2 transaction lost its scripts")
+	}
+}
+
+func TestInvalidEncoding(t *testing.T) {
+	data := testTransaction().Serialize()
+
+	tests := map[string][]byte{
+		"empty":           nil,
+		"unknown version": append([]byte{EncodingVersion + 1}, data[1:]...),
+		"truncated":       data[:len(data)-1],
+		"trailing bytes":  append(append([]byte{}, data...), 0),
+		"huge list":       {EncodingVersion, 0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff},
+	}
+	for name, data := range tests {
+		if _, err := DeserializeTransaction(data); !errors.Is(err, ErrInvalidEncoding) {
+			t.Errorf("%s: %v, want ErrInvalidEncoding", name, err)
+		}
+	}
+
+	undo := (&BlockUndo{[]SpentOutput{{[]byte{1}, 0, 0, true, TxOutput{}}}}).Serialize()
+	// Coinbase 在最後 16 bytes 的 output 前面
+	undo[len(undo)-17] = 2
+	if _, err := DeserializeUndo(undo); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("bool of value 2: %v, want ErrInvalidEncoding", err)
+	}
+}
+
+func TestEncoderDecoder(t *testing.T) {
+	e := NewEncoder()
+	e.WriteInt(-3)
+	e.WriteString("node")
+	e.WriteCount(2)
+	e.WriteBytes([]byte{1})
+	e.WriteBytes(nil)
+
+	d := NewDecoder(e.Bytes())
+	i, s, n := d.ReadInt(), d.ReadString(), d.ReadCount()
+	a, b := d.ReadBytes(), d.ReadBytes()
+	if err := d.Finish(); err != nil {
+		t.Fatal(err)
+	}
+	if i != -3 || s != "node" || n != 2 || !bytes.Equal(a, []byte{1}) || b != nil {
+		t.Errorf("read %d %q %d %v %v", i, s, n, a, b)
+	}
+
+	d = NewDecoder(e.Bytes())
+	d.ReadInt()
+	if err := d.Finish(); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("finish before the last value: %v, want ErrInvalidEncoding", err)
+	}
+}
+
+func TestHeaderBytes(t *testing.T) {
+	a := BlockHeader{BlockVersion, 1, 1600000000, []byte{1, 2}, []byte{3}, 0x207fffff, 0}
+	b := a
+	b.PrevHash, b.MerkleRoot = []byte{1}, []byte{2, 3}
+
+	if bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("headers of different previous hashes and Merkle roots have the same bytes")
+	}
+
+	// version 4 的 header 直接接起來，hash 要跟以前一樣
+	a.Version, b.Version = 4, 4
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Error("version 4 headers are not joined like before")
+	}
+}
@@ -0,0 +1,63 @@
+package blockchain
+
+import "errors"
+
+// Errors returned by the blockchain package, check them with errors.Is
+var (
+	// ErrChainExists is returned by InitBlockchain when the database already holds a chain
+	ErrChainExists = errors.New("blockchain already exists")
+	// ErrChainNotFound is returned by ContinueBlockchain when there is no chain to open
+	ErrChainNotFound = errors.New("no existing blockchain found")
+	// ErrBlockNotFound is returned when a block hash is not in the database
+	ErrBlockNotFound = errors.New("block does not exist")
+	// ErrBlockExists is returned by AcceptBlock when the block is already stored
+	ErrBlockExists = errors.New("block already exists")
+	// ErrOrphanBlock is returned by AcceptBlock when the previous block is not stored yet
+	ErrOrphanBlock = errors.New("previous block does not exist")
+	// ErrTxNotFound is returned when a transaction ID is not in the chain
+	ErrTxNotFound = errors.New("transaction does not exist")
+	// ErrInsufficientFunds is returned when an address cannot pay the amount
+	ErrInsufficientFunds = errors.New("not enough funds")
+	// ErrInvalidAddress is returned when an address is not valid, see wallet.ValidateAddress
+	ErrInvalidAddress = errors.New("invalid address")
+	// ErrWalletNotFound is returned when the wallet file has no key for an address
+	ErrWalletNotFound = errors.New("address is not in the wallet")
+	// ErrInvalidBlock is returned when a block breaks a consensus rule
+	ErrInvalidBlock = errors.New("invalid block")
+	// ErrInvalidTransaction is returned when a transaction breaks a consensus rule
+	ErrInvalidTransaction = errors.New("invalid transaction")
+	// ErrTxInMempool is returned when a transaction is added to a Mempool twice
+	ErrTxInMempool = errors.New("transaction is already in the mempool")
+	// ErrTxConflict is returned when a transaction spends an output already spent by a transaction of the Mempool
+	ErrTxConflict = errors.New("transaction conflicts with the mempool")
+	// ErrMempoolFull is returned when a Mempool has no room for a transaction
+	ErrMempoolFull = errors.New("mempool is full")
+	// ErrInvalidScript is returned when the scripts of an input fail or cannot be run
+	ErrInvalidScript = errors.New("invalid script")
+	// ErrMissingSignatures is returned when a multisig transaction needs signatures of keys which are not in the wallet
+	ErrMissingSignatures = errors.New("transaction is not fully signed")
+	// ErrInvalidEncoding is returned when bytes are not a value of the binary encoding
+	ErrInvalidEncoding = errors.New("invalid encoding")
+	// ErrDatabaseEncoding is returned when the database is not stored with the binary encoding of EncodingVersion
+	ErrDatabaseEncoding = errors.New("unsupported database encoding")
+	// ErrNoAddressIndex is returned when the address index is needed but the chain does not keep it
+	ErrNoAddressIndex = errors.New("address index is not enabled")
+)
+
+// blockTxError is an invalid transaction found while validating a block,
+// it matches both ErrInvalidBlock and ErrInvalidTransaction
+type blockTxError struct {
+	err error
+}
+
+func (e blockTxError) Error() string {
+	return ErrInvalidBlock.Error() + ": " + e.err.Error()
+}
+
+func (e blockTxError) Is(target error) bool {
+	return target == ErrInvalidBlock
+}
+
+func (e blockTxError) Unwrap() error {
+	return e.err
+}
@@ -0,0 +1,59 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestChainErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{DataDir: dir, Params: testParams()}
+	address := string(wallet.MakeWallet().Address())
+
+	if _, err := ContinueBlockchain(address, opts); !errors.Is(err, ErrChainNotFound) {
+		t.Errorf("ContinueBlockchain without a chain returned %v, want %v", err, ErrChainNotFound)
+	}
+	if _, err := InitBlockchain("invalid", opts); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("InitBlockchain to an invalid address returned %v, want %v", err, ErrInvalidAddress)
+	}
+
+	chain, err := InitBlockchain(address, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer chain.Database.Close()
+	if _, err := InitBlockchain(address, opts); !errors.Is(err, ErrChainExists) {
+		t.Errorf("InitBlockchain over a chain returned %v, want %v", err, ErrChainExists)
+	}
+}
+
+func TestLookupErrors(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	missing := bytes.Repeat([]byte{1}, 32)
+
+	if _, err := chain.FindTransaction(missing); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("FindTransaction of a missing transaction returned %v, want %v", err, ErrTxNotFound)
+	}
+	if _, err := chain.GetBlockByHash(missing); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("GetBlockByHash of a missing block returned %v, want %v", err, ErrBlockNotFound)
+	}
+
+	from, to := string(w.Address()), string(wallet.MakeWallet().Address())
+	balance := lastBlock(t, chain).Transactions[0].Outputs[0].Value
+	if _, err := NewRawTransaction(from, to, balance+1, 0, TxOptions{}, &UTXOSet{chain}); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("spending more than the balance returned %v, want %v", err, ErrInsufficientFunds)
+	}
+	if _, err := NewRawTransaction(from, "invalid", 1, 0, TxOptions{}, &UTXOSet{chain}); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("paying an invalid address returned %v, want %v", err, ErrInvalidAddress)
+	}
+}
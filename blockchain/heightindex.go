@@ -0,0 +1,156 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The height index maps the height of every block of the chain to its hash:
+//
+//	height-<height> → block hash
+//
+// Like the transaction index it changes when blocks are connected and disconnected, and
+// heightIndexKey is set once every block of the chain is indexed.
+var (
+	heightPrefix   = []byte("height-")
+	heightIndexKey = []byte("heightindex")
+)
+
+// ForwardIterator iterate the blocks of the chain from genesis up to the block at LastHeight
+type ForwardIterator struct {
+	CurrentHeight int
+	LastHeight    int
+	Blockchain    *Blockchain
+}
+
+func heightKey(height int) []byte {
+	return append(append([]byte{}, heightPrefix...), ToHex(int64(height))...)
+}
+
+// HasHeightIndex report whether every block of the chain is in the height index
+func (chain *Blockchain) HasHeightIndex() (bool, error) {
+	var indexed bool
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(heightIndexKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		indexed = err == nil
+		return err
+	})
+	return indexed, err
+}
+
+// ReindexHeights rebuild the height index from the blocks of the chain
+func (chain *Blockchain) ReindexHeights() error {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(heightIndexKey)
+	})
+	if err != nil {
+		return err
+	}
+	if err := (&UTXOSet{chain}).DeleteByPrefix(heightPrefix); err != nil {
+		return err
+	}
+
+	iter := chain.CreateIterator()
+	for len(iter.CurrentHash) != 0 {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+
+		err = chain.Database.Update(func(txn *badger.Txn) error {
+			return txn.Set(heightKey(block.Height), block.Hash)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(heightIndexKey, []byte{})
+	})
+}
+
+// GetBlockByHeight return the block of the chain at the height, or ErrBlockNotFound.
+// It looks the hash up in the height index, and walks the chain back from the tip without one.
+func (chain *Blockchain) GetBlockByHeight(height int) (*Block, error) {
+	indexed, err := chain.HasHeightIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	if indexed {
+		var hash []byte
+		err := chain.Database.View(func(txn *badger.Txn) error {
+			item, err := txn.Get(heightKey(height))
+			if err == badger.ErrKeyNotFound {
+				return fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+			}
+			if err != nil {
+				return err
+			}
+
+			hash, err = item.ValueCopy(nil)
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		return chain.GetBlockByHash(hash)
+	}
+
+	iter := chain.CreateIterator()
+	for len(iter.CurrentHash) != 0 {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		if block.Height == height {
+			return block, nil
+		}
+		if block.Height < height {
+			break
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no block at height %d", ErrBlockNotFound, height)
+}
+
+// CreateForwardIterator return a ForwardIterator from the genesis block up to the last block
+func (chain *Blockchain) CreateForwardIterator() (*ForwardIterator, error) {
+	// 空的 chain 沒有任何區塊可以走
+	if len(chain.LastHash) == 0 {
+		return &ForwardIterator{0, -1, chain}, nil
+	}
+
+	last, err := chain.LastBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	return &ForwardIterator{0, last.Height, chain}, nil
+}
+
+// HasNext report whether the iterator has not passed LastHeight yet
+func (iter *ForwardIterator) HasNext() bool {
+	return iter.CurrentHeight <= iter.LastHeight
+}
+
+// Next return the block at CurrentHeight and move to the next height
+func (iter *ForwardIterator) Next() (*Block, error) {
+	if !iter.HasNext() {
+		return nil, fmt.Errorf("%w: no block after height %d", ErrBlockNotFound, iter.LastHeight)
+	}
+
+	block, err := iter.Blockchain.GetBlockByHeight(iter.CurrentHeight)
+	if err != nil {
+		return nil, err
+	}
+
+	iter.CurrentHeight++
+	return block, nil
+}
@@ -0,0 +1,81 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestGetBlockByHeight(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+
+	genesis := lastBlock(t, chain)
+	acceptOn(t, chain, acceptOn(t, chain, genesis, address), address)
+
+	// 另一個分支的 work 比較多，高度要指到新的分支
+	blocks := []*Block{genesis}
+	for i := 0; i < 3; i++ {
+		blocks = append(blocks, acceptOn(t, chain, blocks[i], address))
+	}
+	if !bytes.Equal(chain.LastHash, blocks[3].Hash) {
+		t.Fatal("the chain did not switch to the branch with more work")
+	}
+
+	for _, index := range []bool{true, false} {
+		if !index {
+			err := chain.Database.Update(func(txn *badger.Txn) error {
+				return txn.Delete(heightIndexKey)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for height, want := range blocks {
+			block, err := chain.GetBlockByHeight(height)
+			if err != nil {
+				t.Fatalf("index %v: height %d: %v", index, height, err)
+			}
+			if !bytes.Equal(block.Hash, want.Hash) {
+				t.Errorf("index %v: block %x at height %d, want %x", index, block.Hash, height, want.Hash)
+			}
+		}
+		if _, err := chain.GetBlockByHeight(len(blocks)); !errors.Is(err, ErrBlockNotFound) {
+			t.Errorf("index %v: height above the tip returned %v, want %v", index, err, ErrBlockNotFound)
+		}
+	}
+
+	if err := chain.ReindexHeights(); err != nil {
+		t.Fatal(err)
+	}
+	if indexed, err := chain.HasHeightIndex(); err != nil || !indexed {
+		t.Fatalf("no height index after reindexing: %v", err)
+	}
+
+	iter, err := chain.CreateForwardIterator()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range blocks {
+		if !iter.HasNext() {
+			t.Fatalf("the iterator stopped before height %d", want.Height)
+		}
+		block, err := iter.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(block.Hash, want.Hash) {
+			t.Errorf("iterator returned %x at height %d, want %x", block.Hash, want.Height, want.Hash)
+		}
+	}
+	if iter.HasNext() {
+		t.Error("the iterator goes past the last block")
+	}
+	if _, err := iter.Next(); !errors.Is(err, ErrBlockNotFound) {
+		t.Errorf("Next after the last block returned %v, want %v", err, ErrBlockNotFound)
+	}
+}
@@ -0,0 +1,91 @@
+package blockchain
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// testParams are DefaultParams with the easiest target, so a block is mined with a few hashes
+func testParams() *ChainParams {
+	params := DefaultParams
+	params.PowLimitBits = 0x207fffff
+	return &params
+}
+
+// newTestChain create a chain in a temporary directory whose genesis coinbase pays the returned wallet,
+// close it with closeTestChain
+func newTestChain(t *testing.T) (*Blockchain, *wallet.Wallet) {
+	t.Helper()
+
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := wallet.MakeWallet()
+	chain, err := InitBlockchain(string(w.Address()), Options{DataDir: dir, Params: testParams()})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+
+	return chain, w
+}
+
+// closeTestChain close the chain and delete its directory
+func closeTestChain(chain *Blockchain) {
+	chain.Database.Close()
+	os.RemoveAll(chain.Options.DataDir)
+}
+
+// mineOn mine a block on top of prev with a coinbase paying the subsidy to address and txs after it,
+// the block is not accepted by the chain
+func mineOn(t *testing.T, chain *Blockchain, prev *Block, address string, txs ...*Transaction) *Block {
+	t.Helper()
+
+	bits, err := chain.NextBits(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtp, err := chain.MedianTimePast(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	coinbase := CoinbaseTx(address, "", chain.Params.Subsidy(prev.Height+1))
+	block := NewBlock(append([]*Transaction{coinbase}, txs...), prev.Hash, prev.Height+1, bits)
+	if block.Timestamp <= mtp {
+		block.Timestamp = mtp + 1
+	}
+
+	if err := NewMiner().MineBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+// acceptOn mine a block on top of prev like mineOn and accept it
+func acceptOn(t *testing.T, chain *Blockchain, prev *Block, address string, txs ...*Transaction) *Block {
+	t.Helper()
+
+	block := mineOn(t, chain, prev, address, txs...)
+	if err := chain.AcceptBlock(block); err != nil {
+		t.Fatalf("accept block at height %d: %v", block.Height, err)
+	}
+	return block
+}
+
+// lastBlock return the last block of the chain
+func lastBlock(t *testing.T, chain *Blockchain) *Block {
+	t.Helper()
+
+	block, err := chain.LastBlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
@@ -0,0 +1,115 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestIsFinal(t *testing.T) {
+	tests := []struct {
+		lockTime   int64
+		height     int
+		medianTime int64
+		final      bool
+	}{
+		{0, 0, 0, true},
+		{10, 9, LockTimeThreshold + 100, false},
+		{10, 10, 0, true},
+		// 大於 LockTimeThreshold 的是時間，和高度無關
+		{LockTimeThreshold + 100, 1 << 30, LockTimeThreshold + 99, false},
+		{LockTimeThreshold + 100, 0, LockTimeThreshold + 100, true},
+	}
+	for _, test := range tests {
+		tx := &Transaction{LockTime: test.lockTime}
+		if got := tx.IsFinal(test.height, test.medianTime); got != test.final {
+			t.Errorf("lock time %d at height %d and median time %d: final %v, want %v", test.lockTime, test.height, test.medianTime, got, test.final)
+		}
+	}
+}
+
+func TestLockTime(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+	mp := NewMempool(chain)
+
+	genesis := lastBlock(t, chain)
+	prevTX := genesis.Transactions[0]
+	tx := &Transaction{nil, []TxInput{{prevTX.ID, 0, nil, w.PublicKey, nil, 0}}, []TxOutput{*NewTXOutput(prevTX.Outputs[0].Value-1, address)}, 2}
+	if err := tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+
+	if err := mp.Add(tx); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("adding a transaction locked until height 2 at height 1: %v, want %v", err, ErrInvalidTransaction)
+	}
+	if err := chain.AcceptBlock(mineOn(t, chain, genesis, address, tx)); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("block at height 1 with a transaction locked until height 2: %v, want %v", err, ErrInvalidTransaction)
+	}
+
+	first := acceptOn(t, chain, genesis, address)
+	if err := mp.Add(tx); err != nil {
+		t.Errorf("adding a transaction locked until height 2 at height 2: %v", err)
+	}
+	acceptOn(t, chain, first, address, tx)
+}
+
+func TestRelativeLockTime(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+	locked := wallet.MakeWallet()
+	u := &UTXOSet{chain}
+
+	genesis := lastBlock(t, chain)
+	raw, err := NewRawTransaction(address, string(locked.Address()), 30, 1, TxOptions{LockBlocks: 2}, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := raw.Sign(&wallet.Wallets{Wallets: map[string]*wallet.Wallet{address: w}}); err != nil {
+		t.Fatal(err)
+	}
+	first := acceptOn(t, chain, genesis, address, raw.Transaction)
+
+	// 第 1 個區塊的 output 到第 3 個區塊才能花
+	if _, err := NewRawTransaction(string(locked.Address()), address, 29, 1, TxOptions{}, u); !errors.Is(err, ErrInsufficientFunds) {
+		t.Errorf("spending the locked output at height 2: %v, want %v", err, ErrInsufficientFunds)
+	}
+
+	prevTX := raw.Transaction
+	out := 0
+	for i, output := range prevTX.Outputs {
+		if output.RelativeLock() == 2 {
+			out = i
+		}
+	}
+	spendLocked := func(sequence int) *Transaction {
+		tx := &Transaction{nil, []TxInput{{prevTX.ID, out, nil, locked.PublicKey, nil, sequence}}, []TxOutput{*NewTXOutput(29, address)}, 0}
+		if err := tx.Sign(locked.PrivateKey, map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}); err != nil {
+			t.Fatal(err)
+		}
+		tx.ID = tx.Hash()
+		return tx
+	}
+
+	if err := chain.AcceptBlock(mineOn(t, chain, first, address, spendLocked(2))); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("spending the locked output at height 2: %v, want %v", err, ErrInvalidTransaction)
+	}
+	second := acceptOn(t, chain, first, address)
+	if err := chain.AcceptBlock(mineOn(t, chain, second, address, spendLocked(1))); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("spending the locked output with sequence 1: %v, want %v", err, ErrInvalidTransaction)
+	}
+
+	coins, err := u.SpendableCoins(string(locked.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := coinValues(coins); !sameValues(got, []int{30}) {
+		t.Errorf("spendable coins %v at height 3, want [30]", got)
+	}
+	acceptOn(t, chain, second, address, spendLocked(2))
+}
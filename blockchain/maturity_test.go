@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestMature(t *testing.T) {
+	params := ChainParams{CoinbaseMaturity: 10}
+
+	tests := []struct {
+		coinbase     bool
+		height, next int
+		mature       bool
+	}{
+		{false, 5, 6, true},
+		// genesis 的 coinbase 不用等
+		{true, 0, 1, true},
+		{true, 5, 14, false},
+		{true, 5, 15, true},
+	}
+	for _, test := range tests {
+		if got := params.Mature(test.coinbase, test.height, test.next); got != test.mature {
+			t.Errorf("coinbase %v of height %d in block %d: mature %v, want %v", test.coinbase, test.height, test.next, got, test.mature)
+		}
+	}
+}
+
+func TestCoinbaseMaturity(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	miner := wallet.MakeWallet()
+	address := string(w.Address())
+	u := &UTXOSet{chain}
+	mp := NewMempool(chain)
+
+	block := acceptOn(t, chain, lastBlock(t, chain), string(miner.Address()))
+	coinbase := block.Transactions[0]
+	for tip := block; tip.Height < chain.Params.CoinbaseMaturity-1; {
+		tip = acceptOn(t, chain, tip, address)
+	}
+
+	// 下一個區塊的高度是 10，第 1 個區塊的 coinbase 還不能花
+	tx := spend(t, miner, coinbase, 0, 1)
+	if err := mp.Add(tx); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("adding a transaction spending an immature coinbase: %v, want %v", err, ErrInvalidTransaction)
+	}
+	if err := chain.AcceptBlock(mineOn(t, chain, lastBlock(t, chain), address, tx)); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("block spending an immature coinbase: %v, want %v", err, ErrInvalidTransaction)
+	}
+	coins, err := u.FindCoins(string(miner.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spendable, err := u.SpendableCoins(string(miner.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(coins) != 1 || len(spendable) != 0 {
+		t.Errorf("%d coins, %d spendable, want 1 immature coin", len(coins), len(spendable))
+	}
+
+	tip := acceptOn(t, chain, lastBlock(t, chain), address)
+	if spendable, err = u.SpendableCoins(string(miner.Address())); err != nil {
+		t.Fatal(err)
+	}
+	if got := coinValues(spendable); !sameValues(got, []int{coinbase.Outputs[0].Value}) {
+		t.Errorf("spendable coins %v in block %d, want the coinbase", got, tip.Height+1)
+	}
+	if err := mp.Add(tx); err != nil {
+		t.Errorf("adding a transaction spending a mature coinbase: %v", err)
+	}
+	acceptOn(t, chain, tip, address, tx)
+}
@@ -0,0 +1,486 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultMempoolSize is the default limit of the serialized size of the pool's transactions
+	DefaultMempoolSize = 4 << 20
+	// DefaultMaxTxSize is the default limit of the serialized size of one transaction
+	DefaultMaxTxSize = 100 << 10
+	// DefaultMempoolExpiry is how long a transaction stays in the pool by default when it is not mined
+	DefaultMempoolExpiry = 24 * time.Hour
+	// DefaultMaxBlockSize is the default limit of the serialized size of a block template's transactions
+	DefaultMaxBlockSize = 1 << 20
+)
+
+// Mempool holds the validated transactions which are not mined yet.
+// Every transaction spends outputs of the UTXO set or of other transactions of the pool,
+// and no two transactions spend the same output. A transaction leaves the pool with its dependants,
+// the transactions spending its outputs, unless it is mined.
+// Transactions are ranked by fee rate, the fee per serialized byte: block templates take
+// the highest fee rates first, after the transactions they spend, and a full pool evicts the lowest ones.
+// It is safe for concurrent use, but the chain must not change while a method runs.
+type Mempool struct {
+	Chain        *Blockchain
+	MaxSize      int           // the limit of the serialized size of every transaction in the pool
+	MaxTxSize    int           // the limit of the serialized size of one transaction
+	MaxBlockSize int           // the limit of the serialized size of a block template's transactions
+	Expiry       time.Duration // transactions older than Expiry are evicted
+
+	mu      sync.Mutex
+	entries map[string]*mempoolEntry
+	spends  map[string]string // outpointKey → ID of the transaction spending it
+	size    int
+	seq     int
+}
+
+type mempoolEntry struct {
+	tx    *Transaction
+	size  int
+	fee   int
+	added time.Time
+	seq   int // the order the transactions were added
+}
+
+// better report whether e has a higher fee rate than other, or the same and was added first
+func (e *mempoolEntry) better(other *mempoolEntry) bool {
+	// fee/size > other.fee/other.size，交叉相乘避免小數
+	a, b := e.fee*other.size, other.fee*e.size
+	if a != b {
+		return a > b
+	}
+	return e.seq < other.seq
+}
+
+// NewMempool create an empty pool for the chain with the default limits
+func NewMempool(chain *Blockchain) *Mempool {
+	return &Mempool{
+		Chain:        chain,
+		MaxSize:      DefaultMempoolSize,
+		MaxTxSize:    DefaultMaxTxSize,
+		MaxBlockSize: DefaultMaxBlockSize,
+		Expiry:       DefaultMempoolExpiry,
+		entries:      make(map[string]*mempoolEntry),
+		spends:       make(map[string]string),
+	}
+}
+
+// Add validate tx against the UTXO set and the pool's transactions and add it to the pool, evicting transactions with a lower
+// fee rate when the pool is full. It returns ErrTxInMempool when tx is already in the pool, ErrTxConflict
+// when another transaction of the pool spends one of its outputs, and ErrMempoolFull when there is no room.
+func (mp *Mempool) Add(tx *Transaction) error {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.expire(time.Now())
+
+	id := hex.EncodeToString(tx.ID)
+	if _, ok := mp.entries[id]; ok {
+		return fmt.Errorf("%w: %s", ErrTxInMempool, id)
+	}
+
+	for _, in := range tx.Inputs {
+		if other, ok := mp.spends[outpointKey(in)]; ok {
+			return fmt.Errorf("%w: %s spends %s like %s", ErrTxConflict, id, outpointKey(in), other)
+		}
+	}
+
+	size := len(tx.Serialize())
+	if size > mp.MaxTxSize {
+		return fmt.Errorf("%w: transaction %s has %d bytes, the limit is %d", ErrInvalidTransaction, id, size, mp.MaxTxSize)
+	}
+
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase %s outside a block", ErrInvalidTransaction, id)
+	}
+	ctx, err := mp.Chain.nextBlockContext()
+	if err != nil {
+		return err
+	}
+	fee, err := validateTransaction(tx, poolView{mp, ctx.height}, ctx)
+	if err != nil {
+		return err
+	}
+
+	entry := &mempoolEntry{tx, size, fee, time.Now(), mp.seq + 1}
+	if err := mp.makeRoom(entry); err != nil {
+		return err
+	}
+
+	mp.seq++
+	mp.entries[id] = entry
+	for _, in := range tx.Inputs {
+		mp.spends[outpointKey(in)] = id
+	}
+	mp.size += size
+
+	return nil
+}
+
+// Has report whether the transaction is in the pool
+func (mp *Mempool) Has(ID []byte) bool {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	_, ok := mp.entries[hex.EncodeToString(ID)]
+	return ok
+}
+
+// Get return the transaction of the pool with the given ID
+func (mp *Mempool) Get(ID []byte) (*Transaction, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entry, ok := mp.entries[hex.EncodeToString(ID)]
+	if !ok {
+		return nil, false
+	}
+	return entry.tx, true
+}
+
+// Remove take the transaction and its dependants out of the pool
+func (mp *Mempool) Remove(ID []byte) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.removeWithDependants(hex.EncodeToString(ID))
+}
+
+// Count return the number of transactions in the pool
+func (mp *Mempool) Count() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return len(mp.entries)
+}
+
+// Size return the serialized size of the transactions in the pool
+func (mp *Mempool) Size() int {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	return mp.size
+}
+
+// Transactions return the transactions of the pool from the highest fee rate
+func (mp *Mempool) Transactions() []*Transaction {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	var txs []*Transaction
+	for _, entry := range mp.sorted() {
+		txs = append(txs, entry.tx)
+	}
+
+	return txs
+}
+
+// BlockConnected remove the transactions mined by the block, whose dependants now spend outputs of the UTXO set,
+// and the transactions spending the same outputs as the block's transactions with their dependants
+func (mp *Mempool) BlockConnected(block *Block) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	for _, tx := range block.Transactions {
+		mp.remove(hex.EncodeToString(tx.ID))
+
+		if tx.IsCoinbase() {
+			continue
+		}
+		for _, in := range tx.Inputs {
+			if other, ok := mp.spends[outpointKey(in)]; ok {
+				mp.removeWithDependants(other)
+			}
+		}
+	}
+}
+
+// Fee return the fee of the transaction of the pool with the given ID
+func (mp *Mempool) Fee(ID []byte) (int, bool) {
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	entry, ok := mp.entries[hex.EncodeToString(ID)]
+	if !ok {
+		return 0, false
+	}
+	return entry.fee, true
+}
+
+// TipChanged update the pool after the tip of the chain moved: the transactions of the connected blocks
+// are removed, and the transactions of the disconnected blocks go back to the pool when they are still valid.
+// The transactions which spend outputs the new chain does not have anymore are evicted with their dependants.
+func (mp *Mempool) TipChanged(change TipChange) {
+	for _, block := range change.Connected {
+		mp.BlockConnected(block)
+	}
+
+	// 從分叉點往上加回去，交易才會在它花費的交易之後
+	for i := len(change.Disconnected) - 1; i >= 0; i-- {
+		for _, tx := range change.Disconnected[i].Transactions[1:] {
+			mp.Add(tx)
+		}
+	}
+
+	// 只接上區塊時，和區塊衝突的交易已經連同 dependants 移除了
+	if len(change.Disconnected) == 0 {
+		return
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	ctx, err := mp.Chain.nextBlockContext()
+	if err != nil {
+		return
+	}
+	view := newBlockView(chainView{mp.Chain})
+	for _, entry := range mp.ordered() {
+		id := hex.EncodeToString(entry.tx.ID)
+		if _, ok := mp.entries[id]; !ok {
+			continue
+		}
+		if _, err := validateTransaction(entry.tx, view, ctx); err != nil {
+			mp.removeWithDependants(id)
+			continue
+		}
+		view.connect(entry.tx, ctx.height)
+	}
+}
+
+// NewBlockTemplate create the unmined block on top of the last block with the pool's transactions
+// of the highest fee rates which fit in mp.MaxBlockSize, and a coinbase paying the subsidy and their fees to address.
+// A transaction comes after the pool's transactions it spends, and is left out with them.
+// Transactions which are not valid anymore are evicted from the pool with their dependants.
+func (mp *Mempool) NewBlockTemplate(address string) (*Block, error) {
+	if err := checkAddress(address); err != nil {
+		return nil, err
+	}
+
+	mp.mu.Lock()
+	defer mp.mu.Unlock()
+
+	mp.expire(time.Now())
+
+	var txs []*Transaction
+	fees, size := 0, 0
+	view := newBlockView(chainView{mp.Chain})
+	ctx, err := mp.Chain.nextBlockContext()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range mp.ordered() {
+		id := hex.EncodeToString(entry.tx.ID)
+		if _, ok := mp.entries[id]; !ok || size+entry.size > mp.MaxBlockSize || mp.waiting(entry.tx, view) {
+			continue
+		}
+
+		fee, err := validateTransaction(entry.tx, view, ctx)
+		if err != nil {
+			mp.removeWithDependants(id)
+			continue
+		}
+
+		view.connect(entry.tx, ctx.height)
+		txs = append(txs, entry.tx)
+		fees += fee
+		size += entry.size
+	}
+
+	lastBlock, err := mp.Chain.LastBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	cbTx := CoinbaseTx(address, "", mp.Chain.Params.Subsidy(lastBlock.Height+1)+fees)
+	return mp.Chain.NewBlockTemplate(append([]*Transaction{cbTx}, txs...))
+}
+
+// sorted return the entries from the highest fee rate. mp.mu must be held.
+func (mp *Mempool) sorted() []*mempoolEntry {
+	entries := make([]*mempoolEntry, 0, len(mp.entries))
+	for _, entry := range mp.entries {
+		entries = append(entries, entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].better(entries[j]) })
+	return entries
+}
+
+// ordered return the entries from the highest fee rate, but every transaction after the pool's transactions it spends.
+// mp.mu must be held.
+func (mp *Mempool) ordered() []*mempoolEntry {
+	var ordered []*mempoolEntry
+	done := make(map[string]bool)
+
+	var visit func(entry *mempoolEntry)
+	visit = func(entry *mempoolEntry) {
+		id := hex.EncodeToString(entry.tx.ID)
+		if done[id] {
+			return
+		}
+		done[id] = true
+
+		for _, in := range entry.tx.Inputs {
+			if parent, ok := mp.entries[hex.EncodeToString(in.ID)]; ok {
+				visit(parent)
+			}
+		}
+		ordered = append(ordered, entry)
+	}
+
+	for _, entry := range mp.sorted() {
+		visit(entry)
+	}
+	return ordered
+}
+
+// waiting report whether tx spends a transaction of the pool which is not in view yet. mp.mu must be held.
+func (mp *Mempool) waiting(tx *Transaction, view *blockView) bool {
+	for _, in := range tx.Inputs {
+		id := hex.EncodeToString(in.ID)
+		if _, ok := mp.entries[id]; !ok {
+			continue
+		}
+		if _, ok := view.created[id]; !ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ancestors return the IDs of the pool's transactions tx spends, directly or through others. mp.mu must be held.
+func (mp *Mempool) ancestors(tx *Transaction) map[string]bool {
+	ancestors := make(map[string]bool)
+	txs := []*Transaction{tx}
+	for i := 0; i < len(txs); i++ {
+		for _, in := range txs[i].Inputs {
+			id := hex.EncodeToString(in.ID)
+			if parent, ok := mp.entries[id]; ok && !ancestors[id] {
+				ancestors[id] = true
+				txs = append(txs, parent.tx)
+			}
+		}
+	}
+	return ancestors
+}
+
+// dependants return id and the IDs of the pool's transactions spending its outputs, directly or through others.
+// mp.mu must be held.
+func (mp *Mempool) dependants(id string) []string {
+	ids := []string{id}
+	seen := map[string]bool{id: true}
+	for i := 0; i < len(ids); i++ {
+		entry, ok := mp.entries[ids[i]]
+		if !ok {
+			continue
+		}
+		for out := range entry.tx.Outputs {
+			child, ok := mp.spends[outpointKey(TxInput{entry.tx.ID, out, nil, nil, nil, 0})]
+			if ok && !seen[child] {
+				seen[child] = true
+				ids = append(ids, child)
+			}
+		}
+	}
+	return ids
+}
+
+// makeRoom evict the transactions with a lower fee rate than entry, with their dependants, until it fits in mp.MaxSize.
+// The transactions entry spends are kept, and nothing is evicted when it cannot fit. mp.mu must be held.
+func (mp *Mempool) makeRoom(entry *mempoolEntry) error {
+	free := mp.MaxSize - mp.size
+	if entry.size <= free {
+		return nil
+	}
+
+	var evict []string
+	evicted := make(map[string]bool)
+	ancestors := mp.ancestors(entry.tx)
+	entries := mp.sorted()
+	for i := len(entries) - 1; i >= 0 && free < entry.size; i-- {
+		if !entry.better(entries[i]) {
+			break
+		}
+		id := hex.EncodeToString(entries[i].tx.ID)
+		if evicted[id] || ancestors[id] {
+			continue
+		}
+
+		for _, dependant := range mp.dependants(id) {
+			if !evicted[dependant] {
+				evicted[dependant] = true
+				evict = append(evict, dependant)
+				free += mp.entries[dependant].size
+			}
+		}
+	}
+
+	if free < entry.size {
+		return fmt.Errorf("%w: %d of %d bytes are used", ErrMempoolFull, mp.size, mp.MaxSize)
+	}
+
+	for _, id := range evict {
+		mp.remove(id)
+	}
+	return nil
+}
+
+// expire evict the transactions older than mp.Expiry with their dependants. mp.mu must be held.
+func (mp *Mempool) expire(now time.Time) {
+	for id, entry := range mp.entries {
+		if now.Sub(entry.added) > mp.Expiry {
+			mp.removeWithDependants(id)
+		}
+	}
+}
+
+// removeWithDependants take the transaction and its dependants out of the pool. mp.mu must be held.
+func (mp *Mempool) removeWithDependants(id string) {
+	for _, dependant := range mp.dependants(id) {
+		mp.remove(dependant)
+	}
+}
+
+// remove take the transaction out of the pool, its dependants are left. mp.mu must be held.
+func (mp *Mempool) remove(id string) {
+	entry, ok := mp.entries[id]
+	if !ok {
+		return
+	}
+
+	for _, in := range entry.tx.Inputs {
+		delete(mp.spends, outpointKey(in))
+	}
+	mp.size -= entry.size
+	delete(mp.entries, id)
+}
+
+// poolView is the utxoView of the UTXO set with the outputs of the pool's transactions,
+// which are mined at the earliest in the next block at height. mp.mu must be held while it is used.
+// The pool's spends tell which of those outputs are spent.
+type poolView struct {
+	mp     *Mempool
+	height int
+}
+
+func (v poolView) prevTx(in TxInput) (Transaction, int, bool, error) {
+	if entry, ok := v.mp.entries[hex.EncodeToString(in.ID)]; ok {
+		return *entry.tx, v.height, in.Out >= 0 && in.Out < len(entry.tx.Outputs), nil
+	}
+	return chainView{v.mp.Chain}.prevTx(in)
+}
+
+func (v poolView) hasTx(ID []byte) (bool, error) {
+	if _, ok := v.mp.entries[hex.EncodeToString(ID)]; ok {
+		return true, nil
+	}
+	return chainView{v.mp.Chain}.hasTx(ID)
+}
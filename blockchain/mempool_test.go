@@ -0,0 +1,189 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// spend return a transaction of w spending output out of prevTX, which pays to w, back to w with fee
+func spend(t *testing.T, w *wallet.Wallet, prevTX *Transaction, out, fee int) *Transaction {
+	t.Helper()
+
+	value := prevTX.Outputs[out].Value - fee
+	tx := &Transaction{nil, []TxInput{{prevTX.ID, out, nil, w.PublicKey, nil, 0}}, []TxOutput{*NewTXOutput(value, string(w.Address()))}, 0}
+	if err := tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func TestMempoolChainedTransactions(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	mp := NewMempool(chain)
+
+	// 子交易的手續費比較高，但 block template 裡要排在父交易後面
+	parent := spend(t, w, lastBlock(t, chain).Transactions[0], 0, 1)
+	child := spend(t, w, parent, 0, 10)
+	grandchild := spend(t, w, child, 0, 1)
+	for _, tx := range []*Transaction{parent, child, grandchild} {
+		if err := mp.Add(tx); err != nil {
+			t.Fatalf("add %x: %v", tx.ID, err)
+		}
+	}
+
+	block, err := mp.NewBlockTemplate(string(w.Address()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 4 {
+		t.Fatalf("template has %d transactions, want the coinbase and 3", len(block.Transactions))
+	}
+	for i, tx := range []*Transaction{parent, child, grandchild} {
+		if got := block.Transactions[i+1]; hex.EncodeToString(got.ID) != hex.EncodeToString(tx.ID) {
+			t.Errorf("transaction %d of the template is %x, want %x", i+1, got.ID, tx.ID)
+		}
+	}
+
+	// 父交易被挖到後，子交易花費的是 UTXO set 的 output
+	acceptOn(t, chain, lastBlock(t, chain), string(w.Address()), parent)
+	mp.TipChanged(TipChange{lastBlock(t, chain), nil, []*Block{lastBlock(t, chain)}})
+	if mp.Has(parent.ID) || !mp.Has(child.ID) || !mp.Has(grandchild.ID) {
+		t.Errorf("after mining the parent: parent %v, child %v, grandchild %v, want only the dependants", mp.Has(parent.ID), mp.Has(child.ID), mp.Has(grandchild.ID))
+	}
+}
+
+func TestMempoolEvictsDependants(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	mp := NewMempool(chain)
+
+	genesis := lastBlock(t, chain)
+	parent := spend(t, w, genesis.Transactions[0], 0, 1)
+	child := spend(t, w, parent, 0, 1)
+	for _, tx := range []*Transaction{parent, child} {
+		if err := mp.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 區塊花掉同一個 output，父交易和子交易都無效了
+	conflict := spend(t, w, genesis.Transactions[0], 0, 2)
+	block := acceptOn(t, chain, genesis, string(w.Address()), conflict)
+	mp.TipChanged(TipChange{block, nil, []*Block{block}})
+	if mp.Count() != 0 {
+		t.Errorf("%d transactions left after a conflicting block, want the parent and its child evicted", mp.Count())
+	}
+
+	other := spend(t, w, block.Transactions[1], 0, 1)
+	if err := mp.Add(other); err != nil {
+		t.Fatal(err)
+	}
+	mp.Remove(conflict.ID)
+	if mp.Count() != 1 {
+		t.Errorf("%d transactions after removing a mined transaction", mp.Count())
+	}
+	mp.Remove(other.ID)
+	if mp.Count() != 0 || mp.Size() != 0 {
+		t.Errorf("%d transactions of %d bytes after removing the last one", mp.Count(), mp.Size())
+	}
+}
+
+func TestMempoolReorganizeKeepsChains(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+	mp := NewMempool(chain)
+	chain.Subscribe(mp.TipChanged)
+
+	genesis := lastBlock(t, chain)
+	parent := spend(t, w, genesis.Transactions[0], 0, 1)
+	acceptOn(t, chain, genesis, address, parent)
+	child := spend(t, w, parent, 0, 1)
+	if err := mp.Add(child); err != nil {
+		t.Fatal(err)
+	}
+
+	// 切到沒有父交易的分支，父交易回到 mempool，子交易留著
+	b1 := acceptOn(t, chain, genesis, address)
+	acceptOn(t, chain, b1, address)
+	if !mp.Has(parent.ID) || !mp.Has(child.ID) {
+		t.Errorf("after the reorganization: parent %v, child %v, want both in the pool", mp.Has(parent.ID), mp.Has(child.ID))
+	}
+}
+
+// split return a transaction of w spending output out of prevTX into n outputs of the same value paying to w,
+// the remainder of the division is the fee
+func split(t *testing.T, w *wallet.Wallet, prevTX *Transaction, out, n int) *Transaction {
+	t.Helper()
+
+	tx := &Transaction{nil, []TxInput{{prevTX.ID, out, nil, w.PublicKey, nil, 0}}, nil, 0}
+	for i := 0; i < n; i++ {
+		tx.Outputs = append(tx.Outputs, *NewTXOutput(prevTX.Outputs[out].Value/n, string(w.Address())))
+	}
+	if err := tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func TestBlockTemplateByFeeRate(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+	mp := NewMempool(chain)
+
+	coins := split(t, w, lastBlock(t, chain).Transactions[0], 0, 3)
+	acceptOn(t, chain, lastBlock(t, chain), address, coins)
+
+	// 大小一樣，fee rate 的順序就是 fee 的順序
+	low, high, middle := spend(t, w, coins, 0, 1), spend(t, w, coins, 1, 5), spend(t, w, coins, 2, 3)
+	for _, tx := range []*Transaction{low, high, middle} {
+		if err := mp.Add(tx); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fee, ok := mp.Fee(high.ID); !ok || fee != 5 {
+		t.Errorf("fee of the pool transaction %d, %v, want 5", fee, ok)
+	}
+
+	block, err := mp.NewBlockTemplate(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, tx := range []*Transaction{high, middle, low} {
+		if got := block.Transactions[i+1]; hex.EncodeToString(got.ID) != hex.EncodeToString(tx.ID) {
+			t.Errorf("transaction %d of the template is %x, want %x", i+1, got.ID, tx.ID)
+		}
+	}
+	if reward, want := block.Transactions[0].OutputValue(), chain.Params.Subsidy(block.Height)+9; reward != want {
+		t.Errorf("the coinbase pays %d, want the subsidy and the fees %d", reward, want)
+	}
+
+	// 只留下 fee 最高的交易放得進區塊
+	mp.MaxBlockSize = len(high.Serialize())
+	if block, err = mp.NewBlockTemplate(address); err != nil {
+		t.Fatal(err)
+	}
+	if len(block.Transactions) != 2 || hex.EncodeToString(block.Transactions[1].ID) != hex.EncodeToString(high.ID) {
+		t.Errorf("template of %d transactions, want the coinbase and the highest fee rate", len(block.Transactions))
+	}
+}
+
+func TestMempoolRejectsNegativeFee(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	mp := NewMempool(chain)
+
+	if err := mp.Add(spend(t, w, lastBlock(t, chain).Transactions[0], 0, -1)); !errors.Is(err, ErrInvalidTransaction) {
+		t.Errorf("adding a transaction paying more than its inputs returned %v, want %v", err, ErrInvalidTransaction)
+	}
+	if mp.Count() != 0 {
+		t.Errorf("%d transactions in the pool", mp.Count())
+	}
+}
@@ -0,0 +1,144 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+)
+
+// MerkleTree is a binary hash tree built from the transactions of a block
+type MerkleTree struct {
+	RootNode *MerkleNode
+	Leaves   []*MerkleNode
+}
+
+// MerkleNode is a node of the MerkleTree, leaves have no Left and Right
+type MerkleNode struct {
+	Left   *MerkleNode
+	Right  *MerkleNode
+	Parent *MerkleNode
+	Data   []byte
+}
+
+// MerkleProof is the path from a leaf to the root of a MerkleTree.
+// Hashes[i] is the sibling at level i, Left[i] tells whether it sits on the left side.
+type MerkleProof struct {
+	Index  int
+	Hashes [][]byte
+	Left   []bool
+}
+
+// NewMerkleNode create a leaf node when left and right are nil,
+// otherwise hash the children's data together
+func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
+	node := MerkleNode{}
+
+	if left == nil && right == nil {
+		hash := sha256.Sum256(data)
+		node.Data = hash[:]
+	} else {
+		prevHashes := append(append([]byte{}, left.Data...), right.Data...)
+		hash := sha256.Sum256(prevHashes)
+		node.Data = hash[:]
+	}
+
+	node.Left = left
+	node.Right = right
+
+	return &node
+}
+
+// NewMerkleTree build a MerkleTree with the given data as leaves.
+// Like bitcoin, the last node of a level is paired with itself when the level is odd.
+func NewMerkleTree(data [][]byte) *MerkleTree {
+	var nodes []*MerkleNode
+
+	for _, d := range data {
+		nodes = append(nodes, NewMerkleNode(nil, nil, d))
+	}
+
+	if len(nodes) == 0 {
+		nodes = append(nodes, NewMerkleNode(nil, nil, []byte{}))
+	}
+
+	leaves := nodes
+
+	for len(nodes) > 1 {
+		var level []*MerkleNode
+
+		for i := 0; i < len(nodes); i += 2 {
+			left, right := nodes[i], nodes[i]
+			if i+1 < len(nodes) {
+				right = nodes[i+1]
+			}
+
+			node := NewMerkleNode(left, right, nil)
+			left.Parent = node
+			right.Parent = node
+			level = append(level, node)
+		}
+
+		nodes = level
+	}
+
+	tree := MerkleTree{nodes[0], leaves}
+	return &tree
+}
+
+// Root return the hash of the root node
+func (t *MerkleTree) Root() []byte {
+	return t.RootNode.Data
+}
+
+// Proof return the inclusion proof of the leaf at index
+func (t *MerkleTree) Proof(index int) (*MerkleProof, error) {
+	if index < 0 || index >= len(t.Leaves) {
+		return nil, errors.New("Merkle leaf index out of range")
+	}
+
+	proof := MerkleProof{Index: index}
+
+	for node := t.Leaves[index]; node.Parent != nil; node = node.Parent {
+		parent := node.Parent
+
+		// 自己在左邊時，兄弟節點在右邊 (奇數層時兄弟節點是自己)
+		if parent.Left == node {
+			proof.Hashes = append(proof.Hashes, parent.Right.Data)
+			proof.Left = append(proof.Left, false)
+		} else {
+			proof.Hashes = append(proof.Hashes, parent.Left.Data)
+			proof.Left = append(proof.Left, true)
+		}
+	}
+
+	return &proof, nil
+}
+
+// VerifyMerkleProof check the data, a 32 bytes tx.ID, is included in the tree with the given root at proof.Index.
+// Inner nodes hash 64 bytes, so data of any other length could pass an inner node off as a leaf.
+func VerifyMerkleProof(root, data []byte, proof *MerkleProof) bool {
+	if proof == nil || len(data) != sha256.Size || len(proof.Hashes) != len(proof.Left) {
+		return false
+	}
+	if proof.Index < 0 || proof.Index>>uint(len(proof.Hashes)) != 0 {
+		return false
+	}
+
+	node := NewMerkleNode(nil, nil, data)
+
+	for i, hash := range proof.Hashes {
+		// 兄弟節點在左邊時，自己在這一層的位置是奇數
+		if proof.Left[i] != (proof.Index>>uint(i)&1 == 1) {
+			return false
+		}
+
+		sibling := &MerkleNode{Data: hash}
+		if proof.Left[i] {
+			node = NewMerkleNode(sibling, node, nil)
+		} else {
+			node = NewMerkleNode(node, sibling, nil)
+		}
+	}
+
+	return bytes.Equal(node.Data, root)
+}
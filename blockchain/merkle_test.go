@@ -0,0 +1,76 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// testLeaves return n different 32 bytes leaves like tx IDs
+func testLeaves(n int) [][]byte {
+	var leaves [][]byte
+	for i := 0; i < n; i++ {
+		hash := sha256.Sum256([]byte{byte(i)})
+		leaves = append(leaves, hash[:])
+	}
+	return leaves
+}
+
+func TestMerkleProof(t *testing.T) {
+	for n := 1; n <= 9; n++ {
+		leaves := testLeaves(n)
+		tree := NewMerkleTree(leaves)
+
+		for i, leaf := range leaves {
+			proof, err := tree.Proof(i)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyMerkleProof(tree.Root(), leaf, proof) {
+				t.Errorf("%d leaves: proof of leaf %d is invalid", n, i)
+			}
+			if other := leaves[(i+1)%n]; n > 1 && VerifyMerkleProof(tree.Root(), other, proof) {
+				t.Errorf("%d leaves: proof of leaf %d proves leaf %d", n, i, (i+1)%n)
+			}
+		}
+
+		if _, err := tree.Proof(n); err == nil {
+			t.Errorf("%d leaves: proof of leaf %d out of range", n, n)
+		}
+	}
+}
+
+func TestMerkleProofRejectsInnerNode(t *testing.T) {
+	leaves := testLeaves(4)
+	tree := NewMerkleTree(leaves)
+
+	// 左邊的內部節點是兩個 leaf hash 接起來的 64 bytes 的 hash
+	left := tree.RootNode.Left
+	inner := append(append([]byte{}, left.Left.Data...), left.Right.Data...)
+	proof := &MerkleProof{0, [][]byte{tree.RootNode.Right.Data}, []bool{false}}
+
+	// 不檢查長度的話，它的 hash 就是內部節點，proof 會通過
+	if !bytes.Equal(NewMerkleNode(nil, nil, inner).Data, left.Data) {
+		t.Fatal("the data does not hash to the inner node")
+	}
+	if VerifyMerkleProof(tree.Root(), inner, proof) {
+		t.Error("the 64 bytes of an inner node passed as a leaf")
+	}
+}
+
+func TestMerkleProofRejectsWrongIndex(t *testing.T) {
+	leaves := testLeaves(5)
+	tree := NewMerkleTree(leaves)
+	proof, err := tree.Proof(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, index := range []int{-1, 0, 1, 3, 2 + 1<<uint(len(proof.Hashes))} {
+		wrong := *proof
+		wrong.Index = index
+		if VerifyMerkleProof(tree.Root(), leaves[2], &wrong) {
+			t.Errorf("proof of leaf 2 verified at index %d", index)
+		}
+	}
+}
@@ -0,0 +1,297 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// formatKey holds the EncodingVersion of a database, databases without it were stored with gob
+var formatKey = []byte("format")
+
+// legacyPrefix marks the blocks migrated from gob or an older EncodingVersion. The IDs of their transactions
+// are hashes of the old encoding and their signatures sign those IDs, so they are kept as they were and not checked again.
+var legacyPrefix = []byte("legacy-")
+
+// migrateBatch is the number of values written in one badger transaction by MigrateDatabase
+const migrateBatch = 1000
+
+// MigrateDatabase convert the database in opts.DBPath() from gob or an older EncodingVersion to the current
+// binary encoding and return the number of blocks migrated, it does nothing for an up to date database.
+// Blocks and undo data are converted and the UTXO set and the address index are rebuilt.
+// The migrated blocks keep their hashes and transaction IDs, and they are trusted by this node
+// instead of validated again. A node syncing from scratch cannot validate them,
+// so every node of the network migrates its own database.
+// Blocks of version 2 and later are read as they are and keep being validated, since their transactions
+// hash the same, only the heights and coinbase flags missing in their undo data are added.
+func MigrateDatabase(opts Options) (int, error) {
+	if !DBexists(opts.DBPath()) {
+		return 0, ErrChainNotFound
+	}
+
+	db, err := openDB(opts.DBPath())
+	if err != nil {
+		return 0, err
+	}
+
+	// 沒有 format 的資料庫用 gob 儲存
+	var version byte
+	err = db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(formatKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 1 || val[0] > EncodingVersion {
+				return fmt.Errorf("%w: version %x", ErrDatabaseEncoding, val)
+			}
+			version = val[0]
+			return nil
+		})
+	})
+	if err != nil || version == EncodingVersion {
+		db.Close()
+		return 0, err
+	}
+
+	decodeBlock, decodeUndo := Deserialize, DeserializeUndo
+	if version == 0 {
+		decodeBlock, decodeUndo = gobBlock, gobUndo
+	}
+
+	blocks := 0
+	if version < 2 {
+		blocks, err = migrateValues(db, decodeBlock, decodeUndo)
+	}
+	if err == nil {
+		var chainBlocks int
+		chainBlocks, err = migrateUndo(db)
+		if version >= 2 {
+			blocks = chainBlocks
+		}
+	}
+	if err == nil {
+		err = db.Update(func(txn *badger.Txn) error {
+			return txn.Set(formatKey, []byte{EncodingVersion})
+		})
+	}
+	db.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	chain, err := ContinueBlockchain("", opts)
+	if err != nil {
+		return 0, err
+	}
+	defer chain.Database.Close()
+
+	return blocks, UTXOSet{chain}.Reindex()
+}
+
+// gobBlock decode a block stored with gob
+func gobBlock(data []byte) (*Block, error) {
+	var block Block
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&block)
+	return &block, err
+}
+
+// gobUndo decode undo data stored with gob
+func gobUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&undo)
+	return undo, err
+}
+
+// migrateValues rewrite the blocks and undo data of db, read with decodeBlock and decodeUndo, with the current
+// binary encoding and delete the UTXO set, which cannot be read anymore until it is rebuilt
+func migrateValues(db *badger.DB, decodeBlock func([]byte) (*Block, error), decodeUndo func([]byte) (BlockUndo, error)) (int, error) {
+	var values []migrateValue
+	blocks := 0
+
+	write := func() error {
+		err := writeValues(db, values)
+		values = values[:0]
+		return err
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+
+			switch {
+			case bytes.HasPrefix(key, utxoPrefix):
+				values = append(values, migrateValue{key, nil})
+
+			case bytes.HasPrefix(key, undoPrefix):
+				undo, err := decodeUndo(val)
+				if err != nil {
+					return fmt.Errorf("undo data %x cannot be read: %w", key, err)
+				}
+				values = append(values, migrateValue{key, undo.Serialize()})
+
+			// 區塊的 key 就是 32 bytes 的 hash，其他資料都有 prefix
+			case len(key) == 32:
+				block, err := decodeBlock(val)
+				if err != nil {
+					return fmt.Errorf("block %x cannot be read: %w", key, err)
+				}
+				values = append(values, migrateValue{key, block.Serialize()})
+				values = append(values, migrateValue{append(legacyPrefix, key...), []byte{}})
+				blocks++
+			}
+
+			if len(values) >= migrateBatch {
+				if err := write(); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	return blocks, write()
+}
+
+// migrateValue is a value rewritten by the migration, a nil val deletes the key
+type migrateValue struct {
+	key, val []byte
+}
+
+// writeValues write the values in one badger transaction
+func writeValues(db *badger.DB, values []migrateValue) error {
+	return db.Update(func(txn *badger.Txn) error {
+		for _, v := range values {
+			var err error
+			if v.val == nil {
+				err = txn.Delete(v.key)
+			} else {
+				err = txn.Set(v.key, v.val)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// migrateUndo add the heights of the blocks of the spent outputs and whether they are from a coinbase
+// to the undo data of db, undo data older than version 3 has no heights and older than version 4 no coinbase.
+// It walks the chain from the last block to find every transaction and returns the number of blocks of the chain.
+func migrateUndo(db *badger.DB) (int, error) {
+	heights := make(map[string]int)
+	coinbases := make(map[string]bool)
+	blocks := 0
+
+	err := db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte("lh"))
+		if err != nil {
+			return err
+		}
+		hash, err := item.ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+
+		for len(hash) != 0 {
+			item, err := txn.Get(hash)
+			if err != nil {
+				return err
+			}
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			block, err := Deserialize(val)
+			if err != nil {
+				return fmt.Errorf("block %x cannot be read: %w", hash, err)
+			}
+
+			for _, tx := range block.Transactions {
+				heights[hex.EncodeToString(tx.ID)] = block.Height
+				coinbases[hex.EncodeToString(tx.ID)] = tx.IsCoinbase()
+			}
+			hash = block.PrevHash
+			blocks++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var values []migrateValue
+	err = db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(undoPrefix); it.ValidForPrefix(undoPrefix); it.Next() {
+			item := it.Item()
+			val, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			undo, err := DeserializeUndo(val)
+			if err != nil {
+				return fmt.Errorf("undo data %x cannot be read: %w", item.Key(), err)
+			}
+
+			for i, spent := range undo.Spent {
+				id := hex.EncodeToString(spent.TxID)
+				undo.Spent[i].Height, undo.Spent[i].Coinbase = heights[id], coinbases[id]
+			}
+			values = append(values, migrateValue{item.KeyCopy(nil), undo.Serialize()})
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	// 分批寫入，避免單一 badger transaction 太大
+	for len(values) > 0 {
+		n := migrateBatch
+		if n > len(values) {
+			n = len(values)
+		}
+		if err := writeValues(db, values[:n]); err != nil {
+			return 0, err
+		}
+		values = values[n:]
+	}
+
+	return blocks, nil
+}
+
+// isLegacyBlock report whether the block was migrated from gob or an older EncodingVersion
+func (chain *Blockchain) isLegacyBlock(hash []byte) (bool, error) {
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(append(legacyPrefix, hash...))
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return false, nil
+	}
+
+	return err == nil, err
+}
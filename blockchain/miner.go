@@ -0,0 +1,198 @@
+package blockchain
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math"
+	"math/big"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Miner search the nonce of a block with several goroutines
+type Miner struct {
+	// Workers is the number of goroutines, worker i tries the nonces i, i+Workers, i+2*Workers ...
+	Workers int
+	// MaxNonce is the last nonce tried, the block's extra nonce is changed once it is reached
+	MaxNonce int
+	// HashRate is called every ReportInterval with the hashes per second, it can be nil
+	HashRate       func(hashesPerSecond float64)
+	ReportInterval time.Duration
+}
+
+// NewMiner create a Miner using every CPU
+func NewMiner() *Miner {
+	return &Miner{
+		Workers:        runtime.NumCPU(),
+		MaxNonce:       math.MaxInt64,
+		ReportInterval: time.Second,
+	}
+}
+
+// errNonceExhausted is returned when every nonce up to MaxNonce was tried without meeting the target
+var errNonceExhausted = errors.New("nonce space exhausted")
+
+// MineBlock search the nonce of the block and set its Nonce and Hash.
+// It returns ctx.Err() when ctx is cancelled before the block is mined.
+// When the whole nonce range is used up, the extra nonce of the coinbase is changed,
+// which changes the Merkle root, and the search starts again.
+func (m *Miner) MineBlock(ctx context.Context, block *Block) error {
+	pow := NewProof(block)
+	txs := block.Transactions
+
+	for extraNonce := uint64(1); ; extraNonce++ {
+		nonce, hash, err := m.Mine(ctx, pow)
+		if err == nil {
+			block.Hash = hash[:]
+			block.Nonce = nonce
+
+			return nil
+		}
+		if err != errNonceExhausted {
+			return err
+		}
+
+		// nonce 用完了，改變 header 的其他部分後重新搜尋
+		if len(txs) > 0 && txs[0].IsCoinbase() {
+			txs[0].SetExtraNonce(extraNonce)
+			block.MerkleRoot = block.HashTransactions()
+		} else {
+			// 沒有 coinbase 可以改，只能改 timestamp
+			block.Timestamp++
+		}
+	}
+}
+
+type minerResult struct {
+	nonce int
+	hash  []byte
+}
+
+// Mine select the nonce and the hash of the proof of work.
+// It stops and returns ctx.Err() when ctx is cancelled, e.g. when a competing block arrives.
+// Every worker has stopped when it returns, so pow.Block can be changed afterwards,
+// and HashRate is not called any more.
+func (m *Miner) Mine(ctx context.Context, pow *ProofOfWork) (int, []byte, error) {
+	workers := m.Workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var hashes uint64
+	// wg waits for every goroutine, searching only for the workers
+	var wg, searching sync.WaitGroup
+	found := make(chan minerResult, workers)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		searching.Add(1)
+		go func(start int) {
+			defer wg.Done()
+			defer searching.Done()
+			m.work(ctx, pow, start, workers, &hashes, found)
+		}(w)
+	}
+
+	if m.HashRate != nil && m.ReportInterval > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.report(ctx, &hashes)
+		}()
+	}
+
+	// 所有 worker 結束後關閉 channel，沒找到就會收到零值
+	go func() {
+		searching.Wait()
+		close(found)
+	}()
+
+	var res minerResult
+	var ok bool
+	select {
+	case res, ok = <-found:
+	case <-ctx.Done():
+	}
+
+	// 其他 worker 還在讀 block header，等它們停下來呼叫者才能修改 block
+	// report 也要停下來，Mine 回傳後就不會再呼叫 HashRate
+	cancel()
+	wg.Wait()
+
+	if ok {
+		return res.nonce, res.hash, nil
+	}
+	if parent.Err() != nil {
+		return 0, nil, parent.Err()
+	}
+	return 0, nil, errNonceExhausted
+}
+
+// work try every step-th nonce from start until a hash meets the target or ctx is done
+func (m *Miner) work(ctx context.Context, pow *ProofOfWork, start, step int, hashes *uint64, found chan<- minerResult) {
+	const batch = 1 << 12
+
+	var intHash big.Int
+	count := uint64(0)
+
+	maxNonce := m.MaxNonce
+	if maxNonce <= 0 {
+		maxNonce = math.MaxInt64
+	}
+
+	for nonce := start; nonce <= maxNonce; nonce += step {
+		hash := sha256.Sum256(pow.InitData(nonce))
+		intHash.SetBytes(hash[:])
+
+		if intHash.Cmp(pow.Target) == -1 {
+			atomic.AddUint64(hashes, count+1)
+			found <- minerResult{nonce, hash[:]}
+			return
+		}
+
+		count++
+		if count == batch {
+			atomic.AddUint64(hashes, count)
+			count = 0
+
+			select {
+			case <-ctx.Done():
+				return
+			default:
+			}
+		}
+
+		if nonce > maxNonce-step {
+			break
+		}
+	}
+
+	atomic.AddUint64(hashes, count)
+}
+
+// report call m.HashRate with the hashes per second until ctx is done
+func (m *Miner) report(ctx context.Context, hashes *uint64) {
+	ticker := time.NewTicker(m.ReportInterval)
+	defer ticker.Stop()
+
+	last := uint64(0)
+	lastTime := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			total := atomic.LoadUint64(hashes)
+			m.HashRate(float64(total-last) / now.Sub(lastTime).Seconds())
+			last, lastTime = total, now
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package blockchain
+
+import (
+	"bytes"
+	"context"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestMineBlockChangesExtraNonce(t *testing.T) {
+	coinbase := CoinbaseTx(string(wallet.MakeWallet().Address()), "", 20)
+	coinbaseID := coinbase.ID
+	// 每個 hash 大約 1/65536 的機會，16 個 nonce 幾乎一定用完
+	block := NewBlock([]*Transaction{coinbase}, bytes.Repeat([]byte{1}, 32), 1, 0x1f00ffff)
+	m := &Miner{2, 15, nil, 0}
+
+	if err := m.MineBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+	if block.Nonce < 0 || block.Nonce > 15 {
+		t.Errorf("nonce %d is out of the range 0-15", block.Nonce)
+	}
+	if bytes.Equal(coinbase.ID, coinbaseID) {
+		t.Error("the extra nonce of the coinbase was not changed")
+	}
+	if !bytes.Equal(coinbase.ID, coinbase.Hash()) || !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		t.Error("the coinbase ID or the Merkle root does not match the changed coinbase")
+	}
+	if !NewProof(block).Validate() || !bytes.Equal(block.Hash, NewProof(block).Hash()) {
+		t.Errorf("the mined block %x does not meet its target", block.Hash)
+	}
+}
+
+func TestMineNonceExhausted(t *testing.T) {
+	// target 是 0，每個 nonce 都不行
+	m := &Miner{3, 100, nil, 0}
+	if _, _, err := m.Mine(context.Background(), &ProofOfWork{&Block{}, big.NewInt(0)}); err != errNonceExhausted {
+		t.Fatalf("Mine returned %v, want %v", err, errNonceExhausted)
+	}
+}
+
+func TestMineStopsReporting(t *testing.T) {
+	var reports int64
+	m := &Miner{2, 0, func(float64) { atomic.AddInt64(&reports, 1) }, time.Millisecond}
+
+	// target 是 0，永遠挖不到，只能等 ctx 結束
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := m.Mine(ctx, &ProofOfWork{&Block{}, big.NewInt(0)}); err != context.DeadlineExceeded {
+		t.Fatalf("Mine returned %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	n := atomic.LoadInt64(&reports)
+	if n == 0 {
+		t.Fatal("HashRate was never called")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if after := atomic.LoadInt64(&reports); after != n {
+		t.Errorf("HashRate called %d times after Mine returned", after-n)
+	}
+}
@@ -0,0 +1,71 @@
+package blockchain
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestSpendMultisigCoins(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+
+	keys := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+	pubKeys := [][]byte{keys[0].PublicKey, keys[1].PublicKey, keys[2].PublicKey}
+	redeemScript, err := MultisigScript(2, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	multisig := &wallet.Multisig{Required: 2, PublicKeys: pubKeys, RedeemScript: redeemScript}
+	from := string(multisig.Address())
+
+	genesis := lastBlock(t, chain)
+	prevTX := genesis.Transactions[0]
+	pay := &Transaction{nil, []TxInput{{prevTX.ID, 0, nil, w.PublicKey, nil, 0}}, []TxOutput{
+		*NewTXOutput(40, from),
+		*NewTXOutput(prevTX.Outputs[0].Value-40, address),
+	}, 0}
+	if err := pay.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}); err != nil {
+		t.Fatal(err)
+	}
+	pay.ID = pay.Hash()
+	acceptOn(t, chain, genesis, address, pay)
+
+	u := &UTXOSet{chain}
+	coins, err := u.FindCoins(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := coinValues(coins); !sameValues(got, []int{40}) {
+		t.Fatalf("multisig address has coins %v, want [40]", got)
+	}
+
+	// 錢包檔只有第一把 key，簽不夠
+	wallets := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{string(keys[0].Address()): keys[0]}}
+	tx, err := newMultisigTransaction(wallets, multisig, from, address, 30, 1, TxOptions{}, u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete, err := chain.VerifyTransaction(tx); err != nil || complete {
+		t.Fatalf("transaction signed by 1 of 2 keys: complete %v, %v", complete, err)
+	}
+
+	// 另一個 key holder 補上簽章
+	prevTXs := map[string]Transaction{hex.EncodeToString(pay.ID): *pay}
+	if n, err := tx.SignMultisig(keys[2].PrivateKey, prevTXs); err != nil || n != 1 {
+		t.Fatalf("second key signed %d inputs: %v", n, err)
+	}
+	if complete, err := chain.VerifyTransaction(tx); err != nil || !complete {
+		t.Fatalf("transaction signed by 2 of 2 keys: complete %v, %v", complete, err)
+	}
+	acceptOn(t, chain, lastBlock(t, chain), address, tx)
+
+	if coins, err = u.FindCoins(from); err != nil {
+		t.Fatal(err)
+	}
+	if got := coinValues(coins); !sameValues(got, []int{9}) {
+		t.Errorf("multisig address has coins %v after spending, want the change [9]", got)
+	}
+}
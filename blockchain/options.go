@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"os"
+	"path/filepath"
+)
+
+const (
+	// DataDirEnv is the environment variable read by DefaultOptions for the data directory
+	DataDirEnv = "BLOCKCHAIN_DATADIR"
+	// NodeIDEnv is the environment variable read by DefaultOptions for the node ID
+	NodeIDEnv = "NODE_ID"
+
+	defaultDataDir = "./tmp"
+)
+
+// Options tells a node where to keep its data and which chain rules to use
+type Options struct {
+	// DataDir holds the databases and wallet files of every node on the host
+	DataDir string
+	// NodeID keeps the database and wallet file of several nodes in one DataDir apart
+	NodeID string
+	// Params are the consensus rules of the chain, DefaultParams when nil
+	Params *ChainParams
+}
+
+// DefaultOptions return Options with DataDir and NodeID from the environment,
+// DataDir is ./tmp when DataDirEnv is not set
+func DefaultOptions() Options {
+	dataDir := os.Getenv(DataDirEnv)
+	if dataDir == "" {
+		dataDir = defaultDataDir
+	}
+
+	return Options{
+		DataDir: dataDir,
+		NodeID:  os.Getenv(NodeIDEnv),
+		Params:  &DefaultParams,
+	}
+}
+
+// DBPath return the badger directory of the node
+func (o Options) DBPath() string {
+	return filepath.Join(o.dataDir(), o.nodeName("blocks"))
+}
+
+// WalletFile return the wallet file of the node
+func (o Options) WalletFile() string {
+	return filepath.Join(o.dataDir(), o.nodeName("wallets")+".data")
+}
+
+func (o Options) dataDir() string {
+	if o.DataDir == "" {
+		return defaultDataDir
+	}
+	return o.DataDir
+}
+
+// nodeName add the node ID to name, like blocks_3000
+func (o Options) nodeName(name string) string {
+	if o.NodeID == "" {
+		return name
+	}
+	return name + "_" + o.NodeID
+}
+
+func (o Options) params() *ChainParams {
+	if o.Params == nil {
+		return &DefaultParams
+	}
+	return o.Params
+}
@@ -0,0 +1,74 @@
+package blockchain
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestOptionsPaths(t *testing.T) {
+	tests := []struct {
+		opts   Options
+		db     string
+		wallet string
+	}{
+		{Options{}, filepath.Join("tmp", "blocks"), filepath.Join("tmp", "wallets.data")},
+		{Options{DataDir: "data"}, filepath.Join("data", "blocks"), filepath.Join("data", "wallets.data")},
+		{Options{DataDir: "data", NodeID: "3000"}, filepath.Join("data", "blocks_3000"), filepath.Join("data", "wallets_3000.data")},
+	}
+	for _, test := range tests {
+		if got := test.opts.DBPath(); got != test.db {
+			t.Errorf("%+v: database %s, want %s", test.opts, got, test.db)
+		}
+		if got := test.opts.WalletFile(); got != test.wallet {
+			t.Errorf("%+v: wallet file %s, want %s", test.opts, got, test.wallet)
+		}
+	}
+}
+
+func TestDefaultOptions(t *testing.T) {
+	defer os.Setenv(DataDirEnv, os.Getenv(DataDirEnv))
+	defer os.Setenv(NodeIDEnv, os.Getenv(NodeIDEnv))
+
+	os.Setenv(DataDirEnv, "")
+	os.Setenv(NodeIDEnv, "")
+	if opts := DefaultOptions(); opts.DataDir != defaultDataDir || opts.NodeID != "" || opts.Params != &DefaultParams {
+		t.Errorf("without the environment: %+v", opts)
+	}
+
+	os.Setenv(DataDirEnv, "data")
+	os.Setenv(NodeIDEnv, "3000")
+	if opts := DefaultOptions(); opts.DataDir != "data" || opts.NodeID != "3000" {
+		t.Errorf("%s=data %s=3000: %+v", DataDirEnv, NodeIDEnv, opts)
+	}
+}
+
+func TestNodesInOneDataDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 同一個目錄裡的兩個節點各有自己的鏈
+	var chains []*Blockchain
+	for _, id := range []string{"3000", "3001"} {
+		chain, err := InitBlockchain(string(wallet.MakeWallet().Address()), Options{dir, id, testParams()})
+		if err != nil {
+			t.Fatalf("node %s: %v", id, err)
+		}
+		defer chain.Database.Close()
+		chains = append(chains, chain)
+	}
+
+	if bytes.Equal(chains[0].LastHash, chains[1].LastHash) {
+		t.Error("the nodes share their genesis block")
+	}
+	if _, err := chains[1].GetBlockByHash(chains[0].LastHash); err == nil {
+		t.Error("the chain of node 3001 has the genesis block of node 3000")
+	}
+}
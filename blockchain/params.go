@@ -0,0 +1,119 @@
+package blockchain
+
+import "time"
+
+// ChainParams are the consensus rules which can differ between chains
+type ChainParams struct {
+	// PowLimitBits is the easiest target allowed, the genesis block uses it
+	PowLimitBits uint32
+	// TargetBlockTime is the expected time between two blocks
+	TargetBlockTime time.Duration
+	// RetargetInterval is the number of blocks between two difficulty adjustments
+	RetargetInterval int
+	// MaxFutureBlockTime is how far a block timestamp can be ahead of the local clock
+	MaxFutureBlockTime time.Duration
+	// InitialSubsidy is the reward of mining a block before the first halving
+	InitialSubsidy int
+	// HalvingInterval is the number of blocks between two halvings of the subsidy, 0 never halves it
+	HalvingInterval int
+	// MaxSupply is the most coins the subsidies ever create, 0 is no limit
+	MaxSupply int
+	// MaxMoney is the most coins an output, the outputs or inputs of a transaction and the fees of a block
+	// can add up to, 0 is only limited by int. Sums above it are rejected before they can overflow.
+	MaxMoney int
+	// CoinbaseMaturity is the number of blocks after the block of a coinbase its outputs can be spent,
+	// a reorganization can drop the coinbase before that. The genesis coinbase can always be spent.
+	CoinbaseMaturity int
+	// VersionHeights are the heights from which blocks must have at least a block version, by version,
+	// so a miner cannot skip the rules of a version by mining blocks of an older one.
+	// Blocks migrated from an older database keep their versions.
+	VersionHeights map[int]int
+}
+
+// DefaultParams are the parameters for a local test network.
+// 0x1f010000 is 1 << 240, the same target as 16 leading zero bits.
+// The subsidies add up to 20,685,000 coins, MaxSupply is never reached.
+var DefaultParams = ChainParams{
+	PowLimitBits:       0x1f010000,
+	TargetBlockTime:    10 * time.Second,
+	RetargetInterval:   20,
+	MaxFutureBlockTime: 2 * time.Hour,
+	InitialSubsidy:     100,
+	HalvingInterval:    105000,
+	MaxSupply:          21000000,
+	MaxMoney:           21000000,
+	CoinbaseMaturity:   10,
+	VersionHeights:     map[int]int{2: 0, 3: 0, 4: 0, 5: 0},
+}
+
+// Mature report whether the outputs of a transaction of the block at height, a coinbase when coinbase is true,
+// can be spent in the block at next
+func (p *ChainParams) Mature(coinbase bool, height, next int) bool {
+	return !coinbase || height == 0 || next-height >= p.CoinbaseMaturity
+}
+
+// MinBlockVersion return the lowest version a block at height may have
+func (p *ChainParams) MinBlockVersion(height int) int {
+	version := 1
+	for v, h := range p.VersionHeights {
+		if height >= h && v > version {
+			version = v
+		}
+	}
+	return version
+}
+
+// maxInt is the largest int
+const maxInt = int(^uint(0) >> 1)
+
+// ValidMoney report whether value is an amount of coins from 0 up to MaxMoney
+func (p *ChainParams) ValidMoney(value int) bool {
+	return value >= 0 && (p.MaxMoney <= 0 || value <= p.MaxMoney)
+}
+
+// addMoney return a+b of two valid amounts, ok is false when the sum overflows or is above MaxMoney
+func (p *ChainParams) addMoney(a, b int) (int, bool) {
+	if b > maxInt-a {
+		return 0, false
+	}
+	return a + b, p.ValidMoney(a + b)
+}
+
+// Subsidy is the new coins the coinbase of the block at height can claim on top of the fees.
+// It halves every HalvingInterval blocks and stops once MaxSupply coins are created.
+func (p *ChainParams) Subsidy(height int) int {
+	if height < 0 {
+		return 0
+	}
+
+	return p.Supply(height) - p.Supply(height-1)
+}
+
+// Supply is the coins created by the subsidies of the blocks from genesis up to height
+func (p *ChainParams) Supply(height int) int {
+	supply := 0
+
+	for era := 0; height >= 0; era++ {
+		reward := p.InitialSubsidy >> uint(era)
+		if reward == 0 || era >= 63 {
+			break
+		}
+
+		// 這個 halving 區間裡到 height 為止的區塊數
+		blocks := height + 1
+		if p.HalvingInterval > 0 && blocks > p.HalvingInterval {
+			blocks = p.HalvingInterval
+		}
+		supply += blocks * reward
+
+		if p.MaxSupply > 0 && supply >= p.MaxSupply {
+			return p.MaxSupply
+		}
+		if p.HalvingInterval <= 0 {
+			break
+		}
+		height -= p.HalvingInterval
+	}
+
+	return supply
+}
@@ -0,0 +1,72 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestSubsidy(t *testing.T) {
+	params := ChainParams{InitialSubsidy: 50, HalvingInterval: 10, MaxSupply: 610}
+
+	tests := []struct {
+		height  int
+		subsidy int
+	}{
+		{-1, 0},
+		{0, 50},
+		{9, 50},
+		{10, 25},
+		{13, 25},
+		// 第 14 個區塊只剩 10 就到 MaxSupply
+		{14, 10},
+		{15, 0},
+		{1000, 0},
+	}
+	for _, test := range tests {
+		if got := params.Subsidy(test.height); got != test.subsidy {
+			t.Errorf("subsidy at height %d is %d, want %d", test.height, got, test.subsidy)
+		}
+	}
+	if got := params.Supply(1000); got != 610 {
+		t.Errorf("supply %d, want MaxSupply 610", got)
+	}
+
+	// 沒有 MaxSupply 時 subsidy 一直減半到 0
+	params.MaxSupply = 0
+	if got := params.Subsidy(50); got != 1 {
+		t.Errorf("subsidy of the sixth era is %d, want 1", got)
+	}
+	if got := params.Subsidy(60); got != 0 {
+		t.Errorf("subsidy of the seventh era is %d, want 0", got)
+	}
+	if got := DefaultParams.Supply(1 << 30); got != 20685000 {
+		t.Errorf("default supply %d, want 20685000", got)
+	}
+}
+
+func TestCoinbaseOverSubsidy(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+	genesis := lastBlock(t, chain)
+	fee := spend(t, w, genesis.Transactions[0], 0, 3)
+
+	for _, reward := range []int{chain.Params.Subsidy(1) + 4, chain.Params.Subsidy(1) + 3} {
+		block := mineOn(t, chain, genesis, address, fee)
+		block.Transactions[0] = CoinbaseTx(address, "", reward)
+		block.MerkleRoot = block.HashTransactions()
+		if err := NewMiner().MineBlock(context.Background(), block); err != nil {
+			t.Fatal(err)
+		}
+
+		err := chain.AcceptBlock(block)
+		if reward > chain.Params.Subsidy(1)+3 {
+			if !errors.Is(err, ErrInvalidTransaction) {
+				t.Errorf("coinbase paying %d, more than the subsidy and the fee: %v, want %v", reward, err, ErrInvalidTransaction)
+			}
+		} else if err != nil {
+			t.Errorf("coinbase paying the subsidy and the fee: %v", err)
+		}
+	}
+}
@@ -0,0 +1,201 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"os"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// RawTxVersion is the version of the raw transaction format, which follows the magic bytes "rawtx".
+// After them comes the binary encoding of EncodingVersion with the transaction and the list of the outputs
+// its inputs spend.
+const RawTxVersion byte = 1
+
+var rawTxMagic = []byte("rawtx")
+
+// RawTransaction is a transaction on its way from the node which builds it to the key holders which sign it,
+// and back to a node which sends it. It carries the outputs spent by its inputs,
+// so it is signed and checked without the chain.
+type RawTransaction struct {
+	Transaction *Transaction
+	PrevOutputs []TxOutput // the output spent by every input, in the order of the inputs
+}
+
+// NewRawTransaction create the unsigned transaction paying amount from from to to with fee, like NewTransaction.
+// From does not need a key in the wallet file, but a multisig address must be in it for its redeem script.
+func NewRawTransaction(from, to string, amount, fee int, opts TxOptions, UTXO *UTXOSet) (*RawTransaction, error) {
+	input := func(txID []byte, out int) TxInput {
+		return TxInput{txID, out, nil, nil, nil, 0}
+	}
+
+	if wallet.IsScriptAddress(from) {
+		wallets, err := wallet.CreateWallets(UTXO.Blockchain.Options.WalletFile())
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		multisig, ok := wallets.GetMultisig(from)
+		if !ok {
+			return nil, fmt.Errorf("%w: the redeem script of %s is not in the wallet file, add it with createmultisig", ErrWalletNotFound, from)
+		}
+		input = multisigInput(multisig)
+	}
+
+	tx, err := newTransaction(from, to, amount, fee, opts, UTXO, input)
+	if err != nil {
+		return nil, err
+	}
+	tx.ID = tx.Hash()
+
+	prevTXs, err := UTXO.Blockchain.prevTransactions(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := &RawTransaction{tx, nil}
+	for _, in := range tx.Inputs {
+		raw.PrevOutputs = append(raw.PrevOutputs, prevTXs[hex.EncodeToString(in.ID)].Outputs[in.Out])
+	}
+
+	return raw, nil
+}
+
+// Serialize serialize the raw transaction in the raw transaction format of RawTxVersion
+func (raw *RawTransaction) Serialize() []byte {
+	e := newEncoder()
+	e.writeTransaction(raw.Transaction)
+	e.writeUint32(uint32(len(raw.PrevOutputs)))
+	for _, out := range raw.PrevOutputs {
+		e.writeOutput(out)
+	}
+
+	return append(append(append([]byte{}, rawTxMagic...), RawTxVersion), e.Bytes()...)
+}
+
+// DeserializeRawTransaction turn bytes back to a RawTransaction
+func DeserializeRawTransaction(data []byte) (*RawTransaction, error) {
+	if !bytes.HasPrefix(data, rawTxMagic) {
+		return nil, fmt.Errorf("%w: not a raw transaction", ErrInvalidEncoding)
+	}
+	data = data[len(rawTxMagic):]
+	if len(data) == 0 || data[0] != RawTxVersion {
+		return nil, fmt.Errorf("%w: unknown raw transaction version", ErrInvalidEncoding)
+	}
+
+	d := newDecoder(data[1:])
+	raw := &RawTransaction{d.readTransaction(), nil}
+	n := d.readCount()
+	for i := 0; i < n && d.err == nil; i++ {
+		raw.PrevOutputs = append(raw.PrevOutputs, d.readOutput())
+	}
+
+	if err := d.finish(); err != nil {
+		return nil, fmt.Errorf("raw transaction cannot be read: %w", err)
+	}
+	if len(raw.PrevOutputs) != len(raw.Transaction.Inputs) {
+		return nil, fmt.Errorf("%w: %d spent outputs for %d inputs", ErrInvalidEncoding, len(raw.PrevOutputs), len(raw.Transaction.Inputs))
+	}
+	for i, in := range raw.Transaction.Inputs {
+		if in.Out < 0 {
+			return nil, fmt.Errorf("%w: input %d spends output %d", ErrInvalidEncoding, i, in.Out)
+		}
+	}
+	return raw, nil
+}
+
+// prevOuts return the spent outputs by the outpointKey of the inputs, for the methods of Transaction taking them
+func (raw *RawTransaction) prevOuts() map[string]TxOutput {
+	prevOuts := make(map[string]TxOutput)
+	for i, in := range raw.Transaction.Inputs {
+		prevOuts[outpointKey(in)] = raw.PrevOutputs[i]
+	}
+	return prevOuts
+}
+
+// Sign add the signatures of the keys of wallets to the inputs spending their addresses,
+// P2PKH inputs and inputs of multisig addresses, and return how many signatures it added
+func (raw *RawTransaction) Sign(wallets *wallet.Wallets) (int, error) {
+	tx := raw.Transaction
+	prevOuts := raw.prevOuts()
+	signed := 0
+
+	for i, prevOut := range raw.PrevOutputs {
+		if !prevOut.keyLocked() || tx.Inputs[i].Out < 0 {
+			continue
+		}
+		for _, w := range wallets.Wallets {
+			if !bytes.Equal(wallet.PublicKeyHash(w.PublicKey), prevOut.PubKeyHash) {
+				continue
+			}
+
+			if err := tx.signInput(i, w.PrivateKey, prevOut); err != nil {
+				return 0, err
+			}
+			tx.Inputs[i].PubKey = w.PublicKey
+			signed++
+			break
+		}
+	}
+
+	for _, w := range wallets.Wallets {
+		n, err := tx.signMultisig(w.PrivateKey, prevOuts)
+		if err != nil {
+			return 0, err
+		}
+		signed += n
+	}
+
+	tx.ID = tx.Hash()
+	return signed, nil
+}
+
+// Signatures return how many signatures input inIndex has and how many it needs,
+// false when it does not spend a P2PKH or multisig output
+func (raw *RawTransaction) Signatures(inIndex int) (int, int, bool) {
+	in, prevOut := raw.Transaction.Inputs[inIndex], raw.PrevOutputs[inIndex]
+
+	if prevOut.keyLocked() {
+		if len(in.Signature) == 0 {
+			return 0, 1, true
+		}
+		return 1, 1, true
+	}
+
+	signatures, redeemScript, ok := parseMultisigUnlocking(in.Script)
+	if !ok || !isP2SH(prevOut.Script) {
+		return 0, 0, false
+	}
+	required, _, _ := parseMultisig(redeemScript)
+
+	have := 0
+	for _, signature := range signatures {
+		if len(signature) != 0 {
+			have++
+		}
+	}
+	return have, required, true
+}
+
+// Fee return the fee of the transaction, the value of the spent outputs the transaction does not pay.
+// The signatures sign the values of PrevOutputs, so they are invalid when the file understates them.
+func (raw *RawTransaction) Fee() int {
+	fee := 0
+	for _, out := range raw.PrevOutputs {
+		fee += out.Value
+	}
+	for _, out := range raw.Transaction.Outputs {
+		fee -= out.Value
+	}
+	return fee
+}
+
+// Verify check every input of the transaction satisfies the locking script of the output it spends,
+// it returns ErrMissingSignatures with the reason when the transaction is not fully signed
+func (raw *RawTransaction) Verify() error {
+	if err := raw.Transaction.verifyInputs(raw.prevOuts(), BlockVersion); err != nil {
+		return fmt.Errorf("%w: %v", ErrMissingSignatures, err)
+	}
+	return nil
+}
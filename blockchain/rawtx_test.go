@@ -0,0 +1,100 @@
+package blockchain
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+func TestRawTransactionNegativeOut(t *testing.T) {
+	tx := &Transaction{nil, []TxInput{{[]byte{1}, -1, nil, nil, nil, 0}}, []TxOutput{{1, []byte{1}, nil}}, 0}
+	raw := &RawTransaction{tx, []TxOutput{{2, []byte{1}, nil}}}
+
+	if _, err := DeserializeRawTransaction(raw.Serialize()); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("input spending output -1: %v, want ErrInvalidEncoding", err)
+	}
+}
+
+func TestRawTransactionHugeOut(t *testing.T) {
+	w := wallet.MakeWallet()
+	wallets := &wallet.Wallets{Wallets: map[string]*wallet.Wallet{string(w.Address()): w}}
+
+	// 以前會補出 1<<40 個 output
+	tx := &Transaction{nil, []TxInput{{[]byte{1}, 1 << 40, nil, nil, nil, 0}}, []TxOutput{*NewTXOutput(9, string(w.Address()))}, 0}
+	raw, err := DeserializeRawTransaction((&RawTransaction{tx, []TxOutput{*NewTXOutput(10, string(w.Address()))}}).Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed, err := raw.Sign(wallets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signed != 1 {
+		t.Errorf("signed %d inputs, want 1", signed)
+	}
+	if err := raw.Verify(); err != nil {
+		t.Errorf("signed transaction: %v", err)
+	}
+}
+
+func TestRawTransactionWorkflow(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	from, to := string(w.Address()), string(wallet.MakeWallet().Address())
+
+	raw, err := NewRawTransaction(from, to, 30, 2, TxOptions{}, &UTXOSet{chain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 在離線的機器上簽名
+	offline, err := DeserializeRawTransaction(raw.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, need, ok := offline.Signatures(0); have != 0 || need != 1 || !ok {
+		t.Errorf("unsigned input has %d of %d signatures, %v", have, need, ok)
+	}
+	if err := offline.Verify(); !errors.Is(err, ErrMissingSignatures) {
+		t.Errorf("unsigned transaction: %v, want %v", err, ErrMissingSignatures)
+	}
+
+	other := wallet.MakeWallet()
+	signed, err := offline.Sign(&wallet.Wallets{Wallets: map[string]*wallet.Wallet{string(other.Address()): other}})
+	if err != nil || signed != 0 {
+		t.Errorf("another wallet signed %d inputs: %v", signed, err)
+	}
+	signed, err = offline.Sign(&wallet.Wallets{Wallets: map[string]*wallet.Wallet{from: w}})
+	if err != nil || signed != 1 {
+		t.Fatalf("the wallet signed %d inputs: %v", signed, err)
+	}
+	if have, need, _ := offline.Signatures(0); have != 1 || need != 1 {
+		t.Errorf("signed input has %d of %d signatures", have, need)
+	}
+	if err := offline.Verify(); err != nil {
+		t.Fatalf("signed transaction: %v", err)
+	}
+	if fee := offline.Fee(); fee != 2 {
+		t.Errorf("fee %d, want 2", fee)
+	}
+
+	// 回到線上的節點送出
+	online, err := DeserializeRawTransaction(offline.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	understated := *online
+	understated.PrevOutputs = []TxOutput{online.PrevOutputs[0]}
+	understated.PrevOutputs[0].Value--
+	if err := understated.Verify(); !errors.Is(err, ErrMissingSignatures) {
+		t.Errorf("understated spent output: %v, want %v", err, ErrMissingSignatures)
+	}
+	acceptOn(t, chain, lastBlock(t, chain), from, online.Transaction)
+
+	data := raw.Serialize()
+	data[0]++
+	if _, err := DeserializeRawTransaction(data); !errors.Is(err, ErrInvalidEncoding) {
+		t.Errorf("wrong magic bytes: %v, want %v", err, ErrInvalidEncoding)
+	}
+}
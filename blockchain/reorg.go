@@ -0,0 +1,499 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/dgraph-io/badger"
+)
+
+// workPrefix is the key prefix of the cumulative work of every stored block
+var workPrefix = []byte("work-")
+
+// reorgKey marks a reorganization in progress, its value is the hash of the old tip followed by the hash of the new tip.
+// Every block is disconnected and connected in a transaction of its own, so a node stopped in the middle
+// has a consistent chain with a tip between them, and the next open finishes the switch with recoverReorg.
+var reorgKey = []byte("reorg")
+
+// TipChange report how the tip of the chain moved
+type TipChange struct {
+	Tip          *Block
+	Disconnected []*Block // the blocks removed from the chain, from the old tip down to the fork
+	Connected    []*Block // the blocks added to the chain, from the fork up to Tip
+}
+
+// Subscribe register fn to be called every time the tip of the chain changes.
+// fn is called by AcceptBlock before it returns, subscribe before the chain is shared between goroutines.
+func (chain *Blockchain) Subscribe(fn func(TipChange)) {
+	chain.subscribers = append(chain.subscribers, fn)
+}
+
+// AcceptBlock validate the block against the consensus rules and store it.
+// A block extending the last block becomes the new last block. A block of another branch is kept
+// as a side branch, and when its branch has more cumulative work than the chain the tip switches to it:
+// the blocks after the fork are disconnected and the branch's blocks connected, so the UTXO set follows the tip.
+// It returns ErrBlockExists for a stored block and ErrOrphanBlock when the previous block is missing.
+func (chain *Blockchain) AcceptBlock(block *Block) error {
+	if chain.HasBlock(block.Hash) {
+		return fmt.Errorf("%w: %x", ErrBlockExists, block.Hash)
+	}
+
+	// 空的 chain 接受的第一個區塊就是創世區塊
+	var prev *Block
+	if len(block.PrevHash) != 0 {
+		var err error
+		prev, err = chain.GetBlockByHash(block.PrevHash)
+		if errors.Is(err, ErrBlockNotFound) {
+			return fmt.Errorf("%w: %x of block %x", ErrOrphanBlock, block.PrevHash, block.Hash)
+		}
+		if err != nil {
+			return err
+		}
+	} else if len(chain.LastHash) != 0 {
+		return fmt.Errorf("%w: the chain already has a genesis block", ErrInvalidBlock)
+	}
+
+	if err := chain.validateHeader(block, prev); err != nil {
+		return err
+	}
+	// 新收到的區塊不會是遷移過來的 legacy 區塊
+	if err := checkBlock(block, false); err != nil {
+		return err
+	}
+
+	work, err := chain.ChainWork(block.PrevHash)
+	if err != nil {
+		return err
+	}
+	work.Add(work, CalcWork(block.Bits))
+
+	if bytes.Equal(block.PrevHash, chain.LastHash) {
+		if err := chain.validateTransactions(block, newBlockView(chainView{chain})); err != nil {
+			return err
+		}
+		if err := chain.connectBlock(block, work); err != nil {
+			return err
+		}
+
+		chain.notify(TipChange{block, nil, []*Block{block}})
+		return nil
+	}
+
+	// 其他分支的區塊先存起來，交易等到切換過去時才驗證
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return storeBlock(txn, block, work)
+	})
+	if err != nil {
+		return err
+	}
+
+	tipWork, err := chain.ChainWork(chain.LastHash)
+	if err != nil {
+		return err
+	}
+	if work.Cmp(tipWork) <= 0 {
+		return nil
+	}
+
+	return chain.reorganize(block)
+}
+
+// HasBlock report whether the block is stored, on the chain or on a side branch
+func (chain *Blockchain) HasBlock(hash []byte) bool {
+	if len(hash) == 0 {
+		return false
+	}
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(hash)
+		return err
+	})
+	return err == nil
+}
+
+// ChainWork return the cumulative work of the chain from genesis up to the block with the hash,
+// it is 0 for an empty hash
+func (chain *Blockchain) ChainWork(hash []byte) (*big.Int, error) {
+	work := new(big.Int)
+
+	// 沒有存 work 的舊區塊就往前加總
+	for len(hash) != 0 {
+		stored, ok, err := chain.storedWork(hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return work.Add(work, stored), nil
+		}
+
+		block, err := chain.GetBlockByHash(hash)
+		if err != nil {
+			return nil, err
+		}
+		work.Add(work, CalcWork(block.Bits))
+		hash = block.PrevHash
+	}
+
+	return work, nil
+}
+
+func (chain *Blockchain) storedWork(hash []byte) (*big.Int, bool, error) {
+	var work *big.Int
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(workPrefix, hash...))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			work = new(big.Int).SetBytes(val)
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, false, nil
+	}
+
+	return work, err == nil, err
+}
+
+// storeBlock store the block and its cumulative work in txn
+func storeBlock(txn *badger.Txn, block *Block, work *big.Int) error {
+	if err := txn.Set(block.Hash, block.Serialize()); err != nil {
+		return err
+	}
+
+	return txn.Set(append(workPrefix, block.Hash...), work.Bytes())
+}
+
+// connectBlock make the validated block on top of the last block the new last block and update the UTXO set,
+// the transaction index and the height index.
+// A block of a side branch is already stored and work is nil.
+func (chain *Blockchain) connectBlock(block *Block, work *big.Int) error {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		if work != nil {
+			if err := storeBlock(txn, block, work); err != nil {
+				return err
+			}
+		}
+
+		if err := (&UTXOSet{chain}).connect(txn, block); err != nil {
+			return err
+		}
+		if err := indexTransactions(txn, block); err != nil {
+			return err
+		}
+		if err := txn.Set(heightKey(block.Height), block.Hash); err != nil {
+			return err
+		}
+		// 從創世區塊開始的 chain，每個區塊都會被加進 transaction index 和 height index
+		if len(block.PrevHash) == 0 {
+			if err := txn.Set(txIndexKey, []byte{}); err != nil {
+				return err
+			}
+			if err := txn.Set(heightIndexKey, []byte{}); err != nil {
+				return err
+			}
+			if err := txn.Set(formatKey, []byte{EncodingVersion}); err != nil {
+				return err
+			}
+		}
+
+		return txn.Set([]byte("lh"), block.Hash)
+	})
+	if err != nil {
+		return err
+	}
+
+	chain.LastHash = block.Hash
+	return nil
+}
+
+// disconnectTip make the block before the last block the new last block and undo the UTXO set and
+// index changes of the last block, which is kept as a side branch
+func (chain *Blockchain) disconnectTip() (*Block, error) {
+	block, err := chain.LastBlock()
+	if err != nil {
+		return nil, err
+	}
+	if len(block.PrevHash) == 0 {
+		return nil, fmt.Errorf("%w: the genesis block cannot be disconnected", ErrInvalidBlock)
+	}
+
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		if err := (&UTXOSet{chain}).disconnect(txn, block); err != nil {
+			return err
+		}
+		if err := unindexTransactions(txn, block); err != nil {
+			return err
+		}
+		if err := txn.Delete(heightKey(block.Height)); err != nil {
+			return err
+		}
+
+		return txn.Set([]byte("lh"), block.PrevHash)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	chain.LastHash = block.PrevHash
+	return block, nil
+}
+
+// reorganize switch the tip to newTip of a side branch. When a block of the branch is invalid,
+// it is removed with every block on top of it and the chain goes back to the old tip.
+// Until the chain is back at one of the tips, reorgKey marks the switch so it is finished after a crash.
+func (chain *Blockchain) reorganize(newTip *Block) error {
+	oldTip, err := chain.LastBlock()
+	if err != nil {
+		return err
+	}
+
+	err = chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(reorgKey, append(append([]byte{}, oldTip.Hash...), newTip.Hash...))
+	})
+	if err != nil {
+		return err
+	}
+
+	disconnected, connected, err := chain.switchTip(newTip)
+	// 停在兩個 tip 中間時留著標記，下次打開 chain 時再切換
+	if err == nil || bytes.Equal(chain.LastHash, oldTip.Hash) {
+		if clearErr := chain.clearReorg(); clearErr != nil {
+			return clearErr
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	chain.notify(TipChange{newTip, disconnected, connected})
+	return nil
+}
+
+// switchTip disconnect the blocks of the chain down to the fork with newTip and connect the blocks up to newTip,
+// and return them. When a block of the branch is invalid, it is removed with every block on top of it
+// and the chain goes back to the tip it had.
+func (chain *Blockchain) switchTip(newTip *Block) ([]*Block, []*Block, error) {
+	oldTip, err := chain.LastBlock()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	detach, attach, err := chain.findFork(oldTip, newTip)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var disconnected, connected []*Block
+	for range detach {
+		block, err := chain.disconnectTip()
+		if err != nil {
+			return nil, nil, err
+		}
+		disconnected = append(disconnected, block)
+	}
+
+	for i := len(attach) - 1; i >= 0; i-- {
+		block := attach[i]
+
+		err := chain.validateTransactions(block, newBlockView(chainView{chain}))
+		if err == nil {
+			err = chain.connectBlock(block, nil)
+		}
+		if err != nil {
+			if errors.Is(err, ErrInvalidBlock) {
+				// 無效的區塊和接在它後面的區塊都刪掉，之後不會再切換到這個分支
+				if delErr := chain.removeBranch(block); delErr != nil {
+					return nil, nil, delErr
+				}
+			}
+			if restoreErr := chain.restore(connected, disconnected); restoreErr != nil {
+				return nil, nil, restoreErr
+			}
+			return nil, nil, err
+		}
+
+		connected = append(connected, block)
+	}
+
+	return disconnected, connected, nil
+}
+
+// recoverReorg finish a reorganization reorgKey marks, which was stopped in the middle:
+// the tip switches to the new tip, or back to the old tip when the new branch turns out invalid
+func (chain *Blockchain) recoverReorg() error {
+	var tips []byte
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(reorgKey)
+		if err != nil {
+			return err
+		}
+		tips, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(tips)%2 != 0 {
+		return fmt.Errorf("invalid reorganization marker %x", tips)
+	}
+	oldTip, newTip := tips[:len(tips)/2], tips[len(tips)/2:]
+
+	for _, hash := range [][]byte{newTip, oldTip} {
+		// 無效的新分支已經被刪掉了
+		tip, err := chain.GetBlockByHash(hash)
+		if errors.Is(err, ErrBlockNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if _, _, err = chain.switchTip(tip); err == nil {
+			break
+		}
+		if !errors.Is(err, ErrInvalidBlock) {
+			return err
+		}
+	}
+
+	return chain.clearReorg()
+}
+
+// clearReorg delete the mark of a reorganization after the chain reached one of its tips
+func (chain *Blockchain) clearReorg() error {
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(reorgKey)
+	})
+}
+
+// restore go back to the old tip after a failed reorganize:
+// disconnect the connected blocks and connect the disconnected ones again
+func (chain *Blockchain) restore(connected, disconnected []*Block) error {
+	for range connected {
+		if _, err := chain.disconnectTip(); err != nil {
+			return err
+		}
+	}
+
+	for i := len(disconnected) - 1; i >= 0; i-- {
+		if err := chain.connectBlock(disconnected[i], nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findFork return the blocks from oldTip and from newTip down to their common ancestor, which is not included
+func (chain *Blockchain) findFork(oldTip, newTip *Block) ([]*Block, []*Block, error) {
+	var detach, attach []*Block
+	var err error
+
+	a, b := oldTip, newTip
+	parent := func(block *Block) *Block {
+		if err != nil {
+			return block
+		}
+
+		var prev *Block
+		prev, err = chain.GetBlockByHash(block.PrevHash)
+		return prev
+	}
+
+	// 高度比較高的一方先往回走，高度相同後兩邊一起走到共同的區塊
+	for err == nil && a.Height > b.Height {
+		detach = append(detach, a)
+		a = parent(a)
+	}
+	for err == nil && b.Height > a.Height {
+		attach = append(attach, b)
+		b = parent(b)
+	}
+	for err == nil && !bytes.Equal(a.Hash, b.Hash) {
+		detach = append(detach, a)
+		attach = append(attach, b)
+		a, b = parent(a), parent(b)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return detach, attach, nil
+}
+
+// removeBlock delete an invalid block of a side branch
+func (chain *Blockchain) removeBlock(block *Block) error {
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		if err := txn.Delete(block.Hash); err != nil {
+			return err
+		}
+		if err := txn.Delete(append(legacyPrefix, block.Hash...)); err != nil {
+			return err
+		}
+
+		return txn.Delete(append(workPrefix, block.Hash...))
+	})
+}
+
+// removeBranch delete an invalid block of a side branch and every stored block on top of it,
+// so their work cannot make the chain switch to them again
+func (chain *Blockchain) removeBranch(block *Block) error {
+	children := make(map[string][]*Block)
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			// 區塊的 key 就是 32 bytes 的 hash，其他資料都有 prefix
+			if len(item.Key()) != 32 {
+				continue
+			}
+
+			var child *Block
+			err := item.Value(func(val []byte) error {
+				var err error
+				child, err = Deserialize(val)
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			prev := hex.EncodeToString(child.PrevHash)
+			children[prev] = append(children[prev], child)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	branch := []*Block{block}
+	for i := 0; i < len(branch); i++ {
+		branch = append(branch, children[hex.EncodeToString(branch[i].Hash)]...)
+	}
+
+	for _, b := range branch {
+		if err := chain.removeBlock(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (chain *Blockchain) notify(change TipChange) {
+	for _, fn := range chain.subscribers {
+		fn(change)
+	}
+}
@@ -0,0 +1,227 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+	"github.com/go-blockchain/wallet"
+)
+
+// missingSpend return a transaction spending an output which does not exist, a block with it is invalid
+func missingSpend(address string) *Transaction {
+	tx := &Transaction{nil, []TxInput{{bytes.Repeat([]byte{1}, 32), 0, nil, nil, nil, 0}}, []TxOutput{*NewTXOutput(1, address)}, 0}
+	tx.ID = tx.Hash()
+	return tx
+}
+
+func TestReorganizeToMoreWork(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+
+	genesis := lastBlock(t, chain)
+	a1 := acceptOn(t, chain, genesis, address)
+
+	var changes []TipChange
+	chain.Subscribe(func(change TipChange) { changes = append(changes, change) })
+
+	// 一樣多的 work 不切換
+	b1 := acceptOn(t, chain, genesis, address)
+	if !bytes.Equal(chain.LastHash, a1.Hash) {
+		t.Fatalf("tip moved to a branch with the same work")
+	}
+	if len(changes) != 0 {
+		t.Fatalf("%d tip changes for a side branch block", len(changes))
+	}
+
+	b2 := acceptOn(t, chain, b1, address)
+	if !bytes.Equal(chain.LastHash, b2.Hash) {
+		t.Fatalf("tip is %x, want the branch tip %x", chain.LastHash, b2.Hash)
+	}
+	if len(changes) != 1 {
+		t.Fatalf("%d tip changes, want 1", len(changes))
+	}
+	change := changes[0]
+	if len(change.Disconnected) != 1 || !bytes.Equal(change.Disconnected[0].Hash, a1.Hash) {
+		t.Errorf("disconnected %v, want block %x", change.Disconnected, a1.Hash)
+	}
+	if len(change.Connected) != 2 || !bytes.Equal(change.Connected[0].Hash, b1.Hash) || !bytes.Equal(change.Connected[1].Hash, b2.Hash) {
+		t.Errorf("connected %v, want blocks %x and %x", change.Connected, b1.Hash, b2.Hash)
+	}
+
+	// UTXO set 跟著新的 tip
+	for _, block := range []*Block{b1, b2} {
+		spendable, _, err := (UTXOSet{chain}).outputs(block.Transactions[0].ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(spendable.Outputs) != 1 {
+			t.Errorf("coinbase of block %d is not in the UTXO set", block.Height)
+		}
+	}
+	stale, _, err := (UTXOSet{chain}).outputs(a1.Transactions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stale.Outputs) != 0 {
+		t.Errorf("coinbase of the disconnected block is in the UTXO set")
+	}
+}
+
+func TestReorganizeRemovesInvalidBranch(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+
+	genesis := lastBlock(t, chain)
+	a1 := acceptOn(t, chain, genesis, address)
+	a2 := acceptOn(t, chain, a1, address)
+
+	// b1 的交易只有切換過去時才會驗證
+	b1 := acceptOn(t, chain, genesis, address, missingSpend(address))
+	b2 := acceptOn(t, chain, b1, address)
+	other := acceptOn(t, chain, b1, address)
+
+	b3 := mineOn(t, chain, b2, address)
+	if err := chain.AcceptBlock(b3); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("accept block on an invalid branch: %v, want ErrInvalidBlock", err)
+	}
+
+	if !bytes.Equal(chain.LastHash, a2.Hash) {
+		t.Errorf("tip is %x, want the old tip %x", chain.LastHash, a2.Hash)
+	}
+	for _, block := range []*Block{b1, b2, other, b3} {
+		if chain.HasBlock(block.Hash) {
+			t.Errorf("block %x of the invalid branch is still stored", block.Hash)
+		}
+	}
+	for _, block := range []*Block{genesis, a1, a2} {
+		if !chain.HasBlock(block.Hash) {
+			t.Errorf("block %x of the chain was removed", block.Hash)
+		}
+	}
+
+	// 原本的 chain 還能繼續延伸
+	acceptOn(t, chain, a2, address)
+}
+
+func TestAcceptBlockRejectsChangedTransactions(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+
+	genesis := lastBlock(t, chain)
+	acceptOn(t, chain, genesis, address)
+
+	// 改掉側鏈區塊的交易內容但保留 ID，merkle root 和區塊 hash 都不變
+	original := mineOn(t, chain, genesis, address)
+	changed, err := Deserialize(original.Serialize())
+	if err != nil {
+		t.Fatal(err)
+	}
+	changed.Transactions[0].Outputs[0].Value++
+	if !bytes.Equal(changed.HashTransactions(), original.MerkleRoot) {
+		t.Fatal("changing a transaction body changed the merkle root")
+	}
+
+	if err := chain.AcceptBlock(changed); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("accept changed block: %v, want ErrInvalidBlock", err)
+	}
+	if chain.HasBlock(original.Hash) {
+		t.Fatal("changed block is stored under the hash of the original block")
+	}
+	if err := chain.AcceptBlock(original); err != nil {
+		t.Fatalf("accept original block after the changed one: %v", err)
+	}
+}
+
+func TestCheckBlockRejectsDuplicateTransactions(t *testing.T) {
+	w := string(wallet.MakeWallet().Address())
+	a, b := missingSpend(w), missingSpend(w)
+	b.Outputs[0].Value = 2
+	b.ID = b.Hash()
+
+	block := NewBlock([]*Transaction{CoinbaseTx(w, "", 1), a, b}, nil, 0, 0)
+	if err := checkBlock(block, false); err != nil {
+		t.Fatalf("check block: %v", err)
+	}
+
+	// 奇數層的最後一個節點和自己配對，重複最後一筆交易得到一樣的 merkle root
+	block.Transactions = append(block.Transactions, b)
+	if !bytes.Equal(block.HashTransactions(), block.MerkleRoot) {
+		t.Fatal("duplicating the last transaction changed the merkle root")
+	}
+	if err := checkBlock(block, false); !errors.Is(err, ErrInvalidBlock) {
+		t.Fatalf("check block with a duplicate transaction: %v, want ErrInvalidBlock", err)
+	}
+}
+
+// TestRecoverStoppedReorganize stop a reorganization after disconnecting the old branch
+// and check opening the chain again finishes it, or goes back to the old tip when the new branch is invalid
+func TestRecoverStoppedReorganize(t *testing.T) {
+	for _, invalid := range []bool{false, true} {
+		chain, w := newTestChain(t)
+		address := string(w.Address())
+
+		genesis := lastBlock(t, chain)
+		a1 := acceptOn(t, chain, genesis, address)
+		a2 := acceptOn(t, chain, a1, address)
+
+		var txs []*Transaction
+		if invalid {
+			txs = append(txs, missingSpend(address))
+		}
+		b1 := acceptOn(t, chain, genesis, address, txs...)
+		b2 := acceptOn(t, chain, b1, address)
+
+		// b3 存起來但還沒切換過去
+		b3 := mineOn(t, chain, b2, address)
+		work, err := chain.ChainWork(b2.Hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = chain.Database.Update(func(txn *badger.Txn) error {
+			if err := storeBlock(txn, b3, work.Add(work, CalcWork(b3.Bits))); err != nil {
+				return err
+			}
+			return txn.Set(reorgKey, append(append([]byte{}, a2.Hash...), b3.Hash...))
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if _, err := chain.disconnectTip(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		chain.Database.Close()
+
+		chain, err = ContinueBlockchain("", chain.Options)
+		if err != nil {
+			t.Fatalf("invalid branch %v: open the stopped reorganization: %v", invalid, err)
+		}
+
+		want := b3
+		if invalid {
+			want = a2
+		}
+		if !bytes.Equal(chain.LastHash, want.Hash) {
+			t.Errorf("invalid branch %v: tip is block %d %x, want %x", invalid, lastBlock(t, chain).Height, chain.LastHash, want.Hash)
+		}
+		if invalid && chain.HasBlock(b1.Hash) {
+			t.Errorf("invalid block %x is still stored", b1.Hash)
+		}
+		err = chain.Database.View(func(txn *badger.Txn) error {
+			_, err := txn.Get(reorgKey)
+			return err
+		})
+		if err != badger.ErrKeyNotFound {
+			t.Errorf("invalid branch %v: reorganization marker after recovery: %v", invalid, err)
+		}
+		checkUTXO(t, chain, 0)
+
+		closeTestChain(chain)
+	}
+}
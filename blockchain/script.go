@@ -0,0 +1,695 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// Opcodes of the script engine, the numbers are the ones of Bitcoin Script.
+// A byte from 0x01 to 0x4b pushes that many following bytes.
+const (
+	OpFalse          byte = 0x00 // push an empty value
+	OpPushData1      byte = 0x4c // push the number of bytes in the next byte
+	OpPushData2      byte = 0x4d // push the number of bytes in the next 2 bytes, little endian
+	OpTrue           byte = 0x51 // push 1, OpTrue+n-1 pushes n up to 16
+	Op16             byte = 0x60
+	OpVerify         byte = 0x69 // fail unless the top value is true, and pop it
+	OpReturn         byte = 0x6a // fail, the output can never be spent
+	OpDrop           byte = 0x75
+	OpDup            byte = 0x76
+	OpEqual          byte = 0x87 // pop two values and push whether they are equal
+	OpEqualVerify    byte = 0x88 // OpEqual then OpVerify
+	OpSha256         byte = 0xa8 // replace the top value with its sha256
+	OpHash160        byte = 0xa9 // replace the top value with its ripemd160(sha256), the hash of addresses
+	OpCheckSig       byte = 0xac // pop a public key and a signature and push whether it signs the transaction
+	OpCheckSigVerify byte = 0xad
+	// OpCheckMultisig pop n, n public keys, m and a signature for each key, empty for a key which did not sign,
+	// and push whether at least m keys signed the transaction and every signature is valid
+	OpCheckMultisig       byte = 0xae
+	OpCheckMultisigVerify byte = 0xaf
+	// OpCheckSequenceVerify fail unless the Sequence of the input is at least the top number, which stays on the stack
+	OpCheckSequenceVerify byte = 0xb2
+)
+
+const (
+	maxScriptSize  = 10000
+	maxStackSize   = 1000
+	maxElementSize = 520
+	maxNumberSize  = 5
+)
+
+var opNames = map[byte]string{
+	OpFalse:               "OP_FALSE",
+	OpVerify:              "OP_VERIFY",
+	OpReturn:              "OP_RETURN",
+	OpDrop:                "OP_DROP",
+	OpDup:                 "OP_DUP",
+	OpEqual:               "OP_EQUAL",
+	OpEqualVerify:         "OP_EQUALVERIFY",
+	OpSha256:              "OP_SHA256",
+	OpHash160:             "OP_HASH160",
+	OpCheckSig:            "OP_CHECKSIG",
+	OpCheckSigVerify:      "OP_CHECKSIGVERIFY",
+	OpCheckMultisig:       "OP_CHECKMULTISIG",
+	OpCheckMultisigVerify: "OP_CHECKMULTISIGVERIFY",
+	OpCheckSequenceVerify: "OP_CHECKSEQUENCEVERIFY",
+}
+
+// instruction is one opcode of a script and the bytes it pushes
+type instruction struct {
+	op   byte
+	data []byte
+}
+
+// ScriptBuilder build a script from opcodes and pushed values
+type ScriptBuilder struct {
+	script []byte
+}
+
+// NewScriptBuilder return an empty ScriptBuilder
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+// AddOp add an opcode
+func (b *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	b.script = append(b.script, op)
+	return b
+}
+
+// AddData add the opcode pushing data
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	switch n := len(data); {
+	case n == 0:
+		b.script = append(b.script, OpFalse)
+	case n <= 0x4b:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OpPushData1, byte(n))
+	default:
+		b.script = append(b.script, OpPushData2, byte(n), byte(n>>8))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+// AddInt add the opcode pushing a number, a larger one than 16 is pushed as its scriptNumber
+func (b *ScriptBuilder) AddInt(n int) *ScriptBuilder {
+	if n == 0 {
+		return b.AddOp(OpFalse)
+	}
+	if n > 16 {
+		return b.AddData(scriptNumber(n))
+	}
+	return b.AddOp(OpTrue + byte(n-1))
+}
+
+// scriptNumber return the bytes of a non-negative number on the stack: little endian without trailing zeros,
+// and a zero byte added when the last byte has the sign bit
+func scriptNumber(n int) []byte {
+	var v []byte
+	for ; n > 0; n >>= 8 {
+		v = append(v, byte(n))
+	}
+	if len(v) > 0 && v[len(v)-1]&0x80 != 0 {
+		v = append(v, 0)
+	}
+	return v
+}
+
+// readNumber read a non-negative scriptNumber of at most maxNumberSize bytes
+func readNumber(v []byte) (int, error) {
+	if len(v) > maxNumberSize {
+		return 0, fmt.Errorf("%w: number of %d bytes", ErrInvalidScript, len(v))
+	}
+	if len(v) > 0 && v[len(v)-1]&0x80 != 0 {
+		return 0, fmt.Errorf("%w: %x is a negative number", ErrInvalidScript, v)
+	}
+	// 數字必須是最短的寫法，同一個數字才只有一種 bytes
+	if len(v) > 0 && v[len(v)-1] == 0 && (len(v) == 1 || v[len(v)-2]&0x80 == 0) {
+		return 0, fmt.Errorf("%w: %x is not a minimal number", ErrInvalidScript, v)
+	}
+
+	n := 0
+	for i := len(v) - 1; i >= 0; i-- {
+		n = n<<8 | int(v[i])
+	}
+	return n, nil
+}
+
+// Script return the built script
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// P2PKHScript return the locking script paying to the public key hash of an address:
+// OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func P2PKHScript(pubKeyHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OpDup).AddOp(OpHash160).AddData(pubKeyHash).
+		AddOp(OpEqualVerify).AddOp(OpCheckSig).Script()
+}
+
+// HashLockScript return the locking script spent by whoever knows the preimage of the sha256 hash:
+// OP_SHA256 <hash> OP_EQUAL. It is unlocked by the script pushing the preimage.
+func HashLockScript(hash []byte) []byte {
+	return NewScriptBuilder().AddOp(OpSha256).AddData(hash).AddOp(OpEqual).Script()
+}
+
+// P2SHScript return the locking script paying to the hash of a redeem script, like a multisig address:
+// OP_HASH160 <scriptHash> OP_EQUAL. It is unlocked by the script pushing the values the redeem script needs
+// and then the redeem script, which runs on those values after the hash matched.
+func P2SHScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OpHash160).AddData(scriptHash).AddOp(OpEqual).Script()
+}
+
+// RelativeLockScript return the locking script paying to the public key hash of an address
+// which can only be spent blocks after the block of its output, by an input whose Sequence is at least blocks:
+// <blocks> OP_CHECKSEQUENCEVERIFY OP_DROP OP_DUP OP_HASH160 <pubKeyHash> OP_EQUALVERIFY OP_CHECKSIG
+func RelativeLockScript(blocks int, pubKeyHash []byte) []byte {
+	return append(NewScriptBuilder().AddInt(blocks).AddOp(OpCheckSequenceVerify).AddOp(OpDrop).Script(),
+		P2PKHScript(pubKeyHash)...)
+}
+
+// parseRelativeLock return the blocks and the public key hash of a RelativeLockScript
+func parseRelativeLock(script []byte) (int, []byte, bool) {
+	instructions, err := parseScript(script)
+	if err != nil || len(instructions) != 8 || !isPush(instructions[0].op) {
+		return 0, nil, false
+	}
+
+	blocks := 0
+	if first := instructions[0]; first.op >= OpTrue && first.op <= Op16 {
+		blocks = int(first.op-OpTrue) + 1
+	} else if blocks, err = readNumber(first.data); err != nil {
+		return 0, nil, false
+	}
+
+	pubKeyHash := instructions[5].data
+	if blocks == 0 || !bytes.Equal(script, RelativeLockScript(blocks, pubKeyHash)) {
+		return 0, nil, false
+	}
+	return blocks, pubKeyHash, true
+}
+
+// isP2SH report whether the script is a P2SHScript
+func isP2SH(script []byte) bool {
+	return len(script) == 23 && script[0] == OpHash160 && script[1] == 20 && script[22] == OpEqual
+}
+
+// MultisigScript return the redeem script of an m-of-n multisig address, which needs signatures
+// of required of the pubKeys: OP_m <pubKey>... OP_n OP_CHECKMULTISIG
+func MultisigScript(required int, pubKeys [][]byte) ([]byte, error) {
+	if required < 1 || required > len(pubKeys) || len(pubKeys) > 16 {
+		return nil, fmt.Errorf("%w: %d-of-%d multisig", ErrInvalidScript, required, len(pubKeys))
+	}
+
+	b := NewScriptBuilder().AddInt(required)
+	for _, pubKey := range pubKeys {
+		if len(pubKey) != 64 {
+			return nil, fmt.Errorf("%w: public key of %d bytes", ErrInvalidScript, len(pubKey))
+		}
+		b.AddData(pubKey)
+	}
+	script := b.AddInt(len(pubKeys)).AddOp(OpCheckMultisig).Script()
+
+	// 花費時 redeem script 會被 push 到 stack 上，不能超過一個值的大小
+	if len(script) > maxElementSize {
+		return nil, fmt.Errorf("%w: multisig of %d keys is too big", ErrInvalidScript, len(pubKeys))
+	}
+	return script, nil
+}
+
+// parseMultisig return the number of signatures and the public keys of a MultisigScript
+func parseMultisig(script []byte) (int, [][]byte, bool) {
+	instructions, err := parseScript(script)
+	if err != nil || len(instructions) < 4 {
+		return 0, nil, false
+	}
+
+	first, last := instructions[0], instructions[len(instructions)-1]
+	n := len(instructions) - 3
+	if first.op < OpTrue || first.op > Op16 || instructions[n+1].op != OpTrue+byte(n-1) || last.op != OpCheckMultisig {
+		return 0, nil, false
+	}
+
+	var pubKeys [][]byte
+	for _, ins := range instructions[1 : n+1] {
+		if !isPush(ins.op) || len(ins.data) != 64 {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, ins.data)
+	}
+
+	required := int(first.op-OpTrue) + 1
+	return required, pubKeys, required <= n
+}
+
+// multisigUnlockingScript return the unlocking script of an input spending a multisig address,
+// it pushes the signature of every key of the redeem script, empty when the key did not sign, and the redeem script
+func multisigUnlockingScript(signatures [][]byte, redeemScript []byte) []byte {
+	b := NewScriptBuilder()
+	for _, signature := range signatures {
+		b.AddData(signature)
+	}
+	return b.AddData(redeemScript).Script()
+}
+
+// parseMultisigUnlocking return the signatures and the redeem script of a multisigUnlockingScript
+func parseMultisigUnlocking(script []byte) ([][]byte, []byte, bool) {
+	instructions, err := parseScript(script)
+	if err != nil || len(instructions) == 0 {
+		return nil, nil, false
+	}
+	for _, ins := range instructions {
+		if !isPush(ins.op) || (ins.op >= OpTrue && ins.op <= Op16) {
+			return nil, nil, false
+		}
+	}
+
+	redeemScript := instructions[len(instructions)-1].data
+	_, pubKeys, ok := parseMultisig(redeemScript)
+	if !ok || len(instructions) != len(pubKeys)+1 {
+		return nil, nil, false
+	}
+
+	var signatures [][]byte
+	for _, ins := range instructions[:len(pubKeys)] {
+		signatures = append(signatures, ins.data)
+	}
+	return signatures, redeemScript, true
+}
+
+// ScriptHash return the hash of a locking script, which is the PubKeyHash of the outputs locked with it
+func ScriptHash(script []byte) []byte {
+	return wallet.PublicKeyHash(script)
+}
+
+// parseScript split the script into its instructions
+func parseScript(script []byte) ([]instruction, error) {
+	if len(script) > maxScriptSize {
+		return nil, fmt.Errorf("%w: script has %d bytes", ErrInvalidScript, len(script))
+	}
+
+	var instructions []instruction
+	for i := 0; i < len(script); {
+		op := script[i]
+		i++
+
+		n := 0
+		switch {
+		case op >= 0x01 && op <= 0x4b:
+			n = int(op)
+		case op == OpPushData1:
+			if i+1 > len(script) {
+				return nil, fmt.Errorf("%w: OP_PUSHDATA1 without a length", ErrInvalidScript)
+			}
+			n = int(script[i])
+			i++
+		case op == OpPushData2:
+			if i+2 > len(script) {
+				return nil, fmt.Errorf("%w: OP_PUSHDATA2 without a length", ErrInvalidScript)
+			}
+			n = int(binary.LittleEndian.Uint16(script[i:]))
+			i += 2
+		}
+
+		if i+n > len(script) {
+			return nil, fmt.Errorf("%w: push of %d bytes past the end of the script", ErrInvalidScript, n)
+		}
+		instructions = append(instructions, instruction{op, script[i : i+n]})
+		i += n
+	}
+
+	return instructions, nil
+}
+
+// isPush report whether the opcode only pushes a value
+func isPush(op byte) bool {
+	return op <= OpPushData2 || (op >= OpTrue && op <= Op16)
+}
+
+// DisassembleScript return the script in a readable form, pushed values in hex
+func DisassembleScript(script []byte) (string, error) {
+	instructions, err := parseScript(script)
+	if err != nil {
+		return "", err
+	}
+
+	var words []string
+	for _, ins := range instructions {
+		switch {
+		case ins.op >= OpTrue && ins.op <= Op16:
+			words = append(words, fmt.Sprintf("OP_%d", ins.op-OpTrue+1))
+		case isPush(ins.op) && ins.op != OpFalse:
+			words = append(words, hex.EncodeToString(ins.data))
+		case opNames[ins.op] != "":
+			words = append(words, opNames[ins.op])
+		default:
+			words = append(words, fmt.Sprintf("OP_UNKNOWN_%02x", ins.op))
+		}
+	}
+
+	return strings.Join(words, " "), nil
+}
+
+// scriptContext is what the scripts of an input check outside the stack:
+// checkSig check a signature of the input against a public key, and sequence is the Sequence of the input.
+// With strict the unlocking script must be the only one which unlocks with its values, see verifyScripts.
+type scriptContext struct {
+	checkSig func(signature, pubKey []byte) bool
+	sequence int
+	strict   bool
+}
+
+// scriptStack is the stack of values the scripts of one input work on
+type scriptStack [][]byte
+
+func (s *scriptStack) push(v []byte) error {
+	if len(v) > maxElementSize {
+		return fmt.Errorf("%w: value of %d bytes", ErrInvalidScript, len(v))
+	}
+	if len(*s) >= maxStackSize {
+		return fmt.Errorf("%w: stack has more than %d values", ErrInvalidScript, maxStackSize)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+func (s *scriptStack) pop() ([]byte, error) {
+	if len(*s) == 0 {
+		return nil, fmt.Errorf("%w: stack is empty", ErrInvalidScript)
+	}
+	v := (*s)[len(*s)-1]
+	*s = (*s)[:len(*s)-1]
+	return v, nil
+}
+
+// popNumber pop a number from 0 to 16 pushed by OP_FALSE to OP_16
+func (s *scriptStack) popNumber() (int, error) {
+	v, err := s.pop()
+	if err != nil {
+		return 0, err
+	}
+	if len(v) > 1 || (len(v) == 1 && v[0] > 16) {
+		return 0, fmt.Errorf("%w: %x is not a number from 0 to 16", ErrInvalidScript, v)
+	}
+	if len(v) == 0 {
+		return 0, nil
+	}
+	return int(v[0]), nil
+}
+
+// popN pop n values and return them in the order they were pushed
+func (s *scriptStack) popN(n int) ([][]byte, error) {
+	values := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		v, err := s.pop()
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// isTrue is false for an empty value or one of only zeros
+func isTrue(v []byte) bool {
+	for _, b := range v {
+		if b != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func boolValue(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return nil
+}
+
+// executeScript run the instructions of script on the stack
+func executeScript(script []byte, stack *scriptStack, ctx scriptContext) error {
+	instructions, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	for _, ins := range instructions {
+		if err := execute(ins, stack, ctx); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// execute run one instruction
+func execute(ins instruction, stack *scriptStack, ctx scriptContext) error {
+	switch op := ins.op; {
+	case op >= OpTrue && op <= Op16:
+		return stack.push([]byte{op - OpTrue + 1})
+
+	case isPush(op):
+		return stack.push(ins.data)
+
+	case op == OpVerify:
+		v, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if !isTrue(v) {
+			return fmt.Errorf("%w: OP_VERIFY of a false value", ErrInvalidScript)
+		}
+
+	case op == OpReturn:
+		return fmt.Errorf("%w: OP_RETURN", ErrInvalidScript)
+
+	case op == OpDrop:
+		_, err := stack.pop()
+		return err
+
+	case op == OpDup:
+		v, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		stack.push(v)
+		return stack.push(v)
+
+	case op == OpEqual || op == OpEqualVerify:
+		a, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		b, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if op == OpEqualVerify {
+			if !bytes.Equal(a, b) {
+				return fmt.Errorf("%w: OP_EQUALVERIFY of different values", ErrInvalidScript)
+			}
+			return nil
+		}
+		return stack.push(boolValue(bytes.Equal(a, b)))
+
+	case op == OpSha256 || op == OpHash160:
+		v, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		if op == OpHash160 {
+			return stack.push(wallet.PublicKeyHash(v))
+		}
+		hash := sha256.Sum256(v)
+		return stack.push(hash[:])
+
+	case op == OpCheckSig || op == OpCheckSigVerify:
+		pubKey, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		signature, err := stack.pop()
+		if err != nil {
+			return err
+		}
+		valid := ctx.checkSig(signature, pubKey)
+		if op == OpCheckSigVerify {
+			if !valid {
+				return fmt.Errorf("%w: OP_CHECKSIGVERIFY of an invalid signature", ErrInvalidScript)
+			}
+			return nil
+		}
+		return stack.push(boolValue(valid))
+
+	case op == OpCheckMultisig || op == OpCheckMultisigVerify:
+		valid, err := checkMultisig(stack, ctx)
+		if err != nil {
+			return err
+		}
+		if op == OpCheckMultisigVerify {
+			if !valid {
+				return fmt.Errorf("%w: OP_CHECKMULTISIGVERIFY without enough valid signatures", ErrInvalidScript)
+			}
+			return nil
+		}
+		return stack.push(boolValue(valid))
+
+	case op == OpCheckSequenceVerify:
+		if len(*stack) == 0 {
+			return fmt.Errorf("%w: stack is empty", ErrInvalidScript)
+		}
+		blocks, err := readNumber((*stack)[len(*stack)-1])
+		if err != nil {
+			return err
+		}
+		if ctx.sequence < blocks {
+			return fmt.Errorf("%w: OP_CHECKSEQUENCEVERIFY of %d blocks with sequence %d", ErrInvalidScript, blocks, ctx.sequence)
+		}
+
+	default:
+		return fmt.Errorf("%w: unknown opcode %02x", ErrInvalidScript, op)
+	}
+
+	return nil
+}
+
+// checkMultisig pop the values of OP_CHECKMULTISIG and report whether at least m keys signed, exactly m with ctx.strict.
+// An invalid signature makes it false even when enough other keys signed.
+func checkMultisig(stack *scriptStack, ctx scriptContext) (bool, error) {
+	n, err := stack.popNumber()
+	if err != nil {
+		return false, err
+	}
+	pubKeys, err := stack.popN(n)
+	if err != nil {
+		return false, err
+	}
+	m, err := stack.popNumber()
+	if err != nil {
+		return false, err
+	}
+	if m < 1 || m > n {
+		return false, fmt.Errorf("%w: %d-of-%d multisig", ErrInvalidScript, m, n)
+	}
+	signatures, err := stack.popN(n)
+	if err != nil {
+		return false, err
+	}
+
+	signed := 0
+	for i, signature := range signatures {
+		// 還沒簽的 key 是空的值
+		if len(signature) == 0 {
+			continue
+		}
+		if !ctx.checkSig(signature, pubKeys[i]) {
+			return false, nil
+		}
+		signed++
+	}
+
+	// 多出來的簽章任何人都能拿掉，交易的 ID 就會改變
+	if ctx.strict {
+		return signed == m, nil
+	}
+	return signed >= m, nil
+}
+
+// verifyScripts run the unlocking script of an input and then the locking script of the output it spends,
+// the input may spend the output when the top value is true at the end.
+// The unlocking script may only push values, so it cannot change what the locking script checks.
+// For a P2SHScript the last value pushed is the redeem script, which then runs on the values pushed before it.
+// With ctx.strict every value must be pushed like ScriptBuilder.AddData pushes it and the stack must end with
+// only the true value, so nobody can push a value another way or push one more and change the transaction's ID.
+func verifyScripts(unlocking, locking []byte, ctx scriptContext) error {
+	instructions, err := parseScript(unlocking)
+	if err != nil {
+		return err
+	}
+	b := NewScriptBuilder()
+	for _, ins := range instructions {
+		if !isPush(ins.op) {
+			return fmt.Errorf("%w: unlocking script does more than push values", ErrInvalidScript)
+		}
+		b.AddData(ins.data)
+	}
+	if ctx.strict && !bytes.Equal(b.Script(), unlocking) {
+		return fmt.Errorf("%w: unlocking script does not push its values the shortest way", ErrInvalidScript)
+	}
+
+	var stack scriptStack
+	if err := executeScript(unlocking, &stack, ctx); err != nil {
+		return err
+	}
+	redeemStack := append(scriptStack{}, stack...)
+
+	if err := executeScript(locking, &stack, ctx); err != nil {
+		return err
+	}
+	if !endsTrue(stack) {
+		return fmt.Errorf("%w: script ends with a false value", ErrInvalidScript)
+	}
+	if !isP2SH(locking) {
+		if ctx.strict && len(stack) != 1 {
+			return fmt.Errorf("%w: script ends with %d values", ErrInvalidScript, len(stack))
+		}
+		return nil
+	}
+
+	redeemScript, err := redeemStack.pop()
+	if err != nil {
+		return err
+	}
+	if err := executeScript(redeemScript, &redeemStack, ctx); err != nil {
+		return fmt.Errorf("redeem script: %w", err)
+	}
+	if !endsTrue(redeemStack) {
+		return fmt.Errorf("%w: redeem script ends with a false value", ErrInvalidScript)
+	}
+	if ctx.strict && len(redeemStack) != 1 {
+		return fmt.Errorf("%w: redeem script ends with %d values", ErrInvalidScript, len(redeemStack))
+	}
+	return nil
+}
+
+// endsTrue report whether the top value of the stack is true
+func endsTrue(stack scriptStack) bool {
+	return len(stack) != 0 && isTrue(stack[len(stack)-1])
+}
+
+// isLowS report whether s is at most half the order of the curve, N-s is the other s of the same signature
+func isLowS(s *big.Int) bool {
+	halfOrder := new(big.Int).Rsh(elliptic.P256().Params().N, 1)
+	return s.Cmp(halfOrder) <= 0
+}
+
+// verifySignature check signature, r and s of 32 bytes each, signs hash with the public key of x and y of 32 bytes each
+func verifySignature(hash, signature, pubKey []byte) bool {
+	if len(signature) != 64 || len(pubKey) != 64 {
+		return false
+	}
+
+	curve := elliptic.P256()
+	x := new(big.Int).SetBytes(pubKey[:32])
+	y := new(big.Int).SetBytes(pubKey[32:])
+	if !curve.IsOnCurve(x, y) {
+		return false
+	}
+
+	r := new(big.Int).SetBytes(signature[:32])
+	s := new(big.Int).SetBytes(signature[32:])
+	rawPubKey := ecdsa.PublicKey{Curve: curve, X: x, Y: y}
+	return ecdsa.Verify(&rawPubKey, hash, r, s)
+}
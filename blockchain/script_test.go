@@ -0,0 +1,276 @@
+package blockchain
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// testContext check signatures made by testSign, the signature of a key is "sig" followed by the key.
+// The scripts are strict like in a block of BlockVersion.
+func testContext(sequence int) scriptContext {
+	return scriptContext{func(signature, pubKey []byte) bool { return bytes.Equal(signature, testSign(pubKey)) }, sequence, true}
+}
+
+func testSign(pubKey []byte) []byte {
+	return append([]byte("sig"), pubKey...)
+}
+
+func testKey(i byte) []byte {
+	return bytes.Repeat([]byte{i}, 64)
+}
+
+func TestScriptNumber(t *testing.T) {
+	for _, n := range []int{0, 1, 16, 17, 127, 128, 255, 256, 1 << 20, 1<<31 - 1} {
+		got, err := readNumber(scriptNumber(n))
+		if err != nil || got != n {
+			t.Errorf("read scriptNumber(%d) = %d, %v", n, got, err)
+		}
+	}
+
+	invalid := map[string][]byte{
+		"zero byte":     {0},
+		"trailing zero": {1, 0},
+		"negative":      {0x80},
+		"too long":      {1, 2, 3, 4, 5, 6},
+	}
+	for name, v := range invalid {
+		if _, err := readNumber(v); !errors.Is(err, ErrInvalidScript) {
+			t.Errorf("%s %x: %v, want ErrInvalidScript", name, v, err)
+		}
+	}
+	// 最後一個 byte 有 sign bit 時要多一個 0
+	if n, err := readNumber([]byte{0x80, 0}); err != nil || n != 128 {
+		t.Errorf("read 8000 = %d, %v, want 128", n, err)
+	}
+}
+
+func TestP2PKHScript(t *testing.T) {
+	w, other := wallet.MakeWallet(), wallet.MakeWallet()
+	hash := sha256.Sum256([]byte("transaction"))
+	ctx := scriptContext{func(signature, pubKey []byte) bool { return verifySignature(hash[:], signature, pubKey) }, 0, true}
+	locking := P2PKHScript(wallet.PublicKeyHash(w.PublicKey))
+
+	signature, err := SignHash(w.PrivateKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherSignature, err := SignHash(other.PrivateKey, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name      string
+		unlocking []byte
+		valid     bool
+	}{
+		{"signed", NewScriptBuilder().AddData(signature).AddData(w.PublicKey).Script(), true},
+		{"other key", NewScriptBuilder().AddData(otherSignature).AddData(other.PublicKey).Script(), false},
+		{"other signature", NewScriptBuilder().AddData(otherSignature).AddData(w.PublicKey).Script(), false},
+		{"no signature", NewScriptBuilder().AddData(w.PublicKey).Script(), false},
+	}
+	for _, test := range tests {
+		err := verifyScripts(test.unlocking, locking, ctx)
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidScript) {
+			t.Errorf("%s: %v, want ErrInvalidScript", test.name, err)
+		}
+	}
+}
+
+func TestMultisigScript(t *testing.T) {
+	keys := [][]byte{testKey(1), testKey(2), testKey(3)}
+	redeemScript, err := MultisigScript(2, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	required, pubKeys, ok := parseMultisig(redeemScript)
+	if !ok || required != 2 || len(pubKeys) != 3 {
+		t.Fatalf("parse multisig: %d of %d keys, %t", required, len(pubKeys), ok)
+	}
+	locking := P2SHScript(ScriptHash(redeemScript))
+
+	tests := []struct {
+		name       string
+		signatures [][]byte
+		valid      bool
+	}{
+		// 多的簽章可以被拿掉，所以剛好 m 個才有效
+		{"all signed", [][]byte{testSign(keys[0]), testSign(keys[1]), testSign(keys[2])}, false},
+		{"2 signed", [][]byte{testSign(keys[0]), nil, testSign(keys[2])}, true},
+		{"1 signed", [][]byte{nil, testSign(keys[1]), nil}, false},
+		{"invalid signature", [][]byte{testSign(keys[0]), testSign(keys[1]), testSign(keys[0])}, false},
+		{"wrong order", [][]byte{testSign(keys[1]), testSign(keys[0]), nil}, false},
+	}
+	for _, test := range tests {
+		unlocking := multisigUnlockingScript(test.signatures, redeemScript)
+		err := verifyScripts(unlocking, locking, testContext(0))
+		if test.valid && err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidScript) {
+			t.Errorf("%s: %v, want ErrInvalidScript", test.name, err)
+		}
+	}
+
+	// 其他的 redeem script 和 hash 不合
+	other, _ := MultisigScript(1, keys)
+	unlocking := multisigUnlockingScript([][]byte{testSign(keys[0]), nil, nil}, other)
+	if err := verifyScripts(unlocking, locking, testContext(0)); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("other redeem script: %v, want ErrInvalidScript", err)
+	}
+
+	if _, err := MultisigScript(4, keys); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("4-of-3 multisig: %v, want ErrInvalidScript", err)
+	}
+}
+
+func TestRelativeLockScript(t *testing.T) {
+	key := testKey(1)
+	unlocking := NewScriptBuilder().AddData(testSign(key)).AddData(key).Script()
+
+	for _, blocks := range []int{1, 16, 17, 1000} {
+		locking := RelativeLockScript(blocks, wallet.PublicKeyHash(key))
+		if got, pubKeyHash, ok := parseRelativeLock(locking); !ok || got != blocks || !bytes.Equal(pubKeyHash, wallet.PublicKeyHash(key)) {
+			t.Errorf("parse relative lock of %d blocks: %d, %t", blocks, got, ok)
+		}
+
+		if err := verifyScripts(unlocking, locking, testContext(blocks)); err != nil {
+			t.Errorf("%d blocks with sequence %d: %v", blocks, blocks, err)
+		}
+		if err := verifyScripts(unlocking, locking, testContext(blocks-1)); !errors.Is(err, ErrInvalidScript) {
+			t.Errorf("%d blocks with sequence %d: %v, want ErrInvalidScript", blocks, blocks-1, err)
+		}
+	}
+}
+
+func TestUnlockingScriptOnlyPushes(t *testing.T) {
+	preimage := []byte("secret")
+	hash := sha256.Sum256(preimage)
+	locking := HashLockScript(hash[:])
+
+	if err := verifyScripts(NewScriptBuilder().AddData(preimage).Script(), locking, testContext(0)); err != nil {
+		t.Errorf("preimage: %v", err)
+	}
+	if err := verifyScripts(NewScriptBuilder().AddData([]byte("guess")).Script(), locking, testContext(0)); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("other preimage: %v, want ErrInvalidScript", err)
+	}
+
+	// 解鎖腳本不能執行 opcode，否則可以改掉鎖定腳本檢查的值
+	unlocking := NewScriptBuilder().AddData(preimage).AddOp(OpSha256).AddData(hash[:]).AddOp(OpEqualVerify).AddOp(OpTrue).Script()
+	if err := verifyScripts(unlocking, []byte{OpTrue}, testContext(0)); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("unlocking script with opcodes: %v, want ErrInvalidScript", err)
+	}
+
+	if err := verifyScripts(nil, []byte{OpTrue, OpReturn}, testContext(0)); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("OP_RETURN: %v, want ErrInvalidScript", err)
+	}
+	if err := verifyScripts(nil, []byte{OpFalse}, testContext(0)); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("script ending false: %v, want ErrInvalidScript", err)
+	}
+}
+
+func TestStrictUnlockingScript(t *testing.T) {
+	key := testKey(1)
+	locking := P2PKHScript(wallet.PublicKeyHash(key))
+	signature := testSign(key)
+
+	valid := NewScriptBuilder().AddData(signature).AddData(key).Script()
+	if err := verifyScripts(valid, locking, testContext(0)); err != nil {
+		t.Fatalf("valid unlocking script: %v", err)
+	}
+
+	// 同樣的值用 OP_PUSHDATA1 push
+	reencoded := append([]byte{OpPushData1, byte(len(signature))}, signature...)
+	reencoded = append(reencoded, NewScriptBuilder().AddData(key).Script()...)
+	// 多 push 一個值，OP_CHECKSIG 之後它還留在 stack 上
+	padded := append(NewScriptBuilder().AddData([]byte{7}).Script(), valid...)
+	// 1 用 OP_1 push 而不是 push 1 byte
+	smallNumber := append([]byte{OpTrue}, valid...)
+
+	tests := map[string][]byte{
+		"re-encoded push": reencoded,
+		"padded":          padded,
+		"OP_1 push":       smallNumber,
+	}
+	for name, unlocking := range tests {
+		if err := verifyScripts(unlocking, locking, testContext(0)); !errors.Is(err, ErrInvalidScript) {
+			t.Errorf("%s: %v, want ErrInvalidScript", name, err)
+		}
+		// 舊版本的區塊不檢查
+		lax := testContext(0)
+		lax.strict = false
+		if err := verifyScripts(unlocking, locking, lax); err != nil {
+			t.Errorf("%s without strict: %v", name, err)
+		}
+	}
+
+	// P2SH 的 redeem script 執行完也只能剩一個值
+	redeemScript := []byte{OpTrue}
+	p2sh := P2SHScript(ScriptHash(redeemScript))
+	if err := verifyScripts(NewScriptBuilder().AddData(redeemScript).Script(), p2sh, testContext(0)); err != nil {
+		t.Errorf("redeem script: %v", err)
+	}
+	unlocking := NewScriptBuilder().AddData([]byte{7}).AddData(redeemScript).Script()
+	if err := verifyScripts(unlocking, p2sh, testContext(0)); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("padded redeem stack: %v, want ErrInvalidScript", err)
+	}
+}
+
+func TestInputHasOneForm(t *testing.T) {
+	w := wallet.MakeWallet()
+	prevTX := Transaction{[]byte{1}, nil, []TxOutput{*NewTXOutput(10, string(w.Address()))}, 0}
+	prevTXs := map[string]Transaction{"01": prevTX}
+
+	tx := &Transaction{nil, []TxInput{{prevTX.ID, 0, nil, w.PublicKey, nil, 0}}, []TxOutput{*NewTXOutput(9, string(w.Address()))}, 0}
+	if err := tx.Sign(w.PrivateKey, prevTXs); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.verifyInputs(tx.spentOutputs(prevTXs), BlockVersion); err != nil {
+		t.Fatalf("signed transaction: %v", err)
+	}
+
+	// 同一個簽章改放在 Script 裡，交易的 ID 就不一樣了
+	in := &tx.Inputs[0]
+	in.Script = in.UnlockingScript()
+	in.Signature, in.PubKey = nil, nil
+	if err := tx.verifyInputs(tx.spentOutputs(prevTXs), BlockVersion); !errors.Is(err, ErrInvalidScript) {
+		t.Errorf("signature in the script: %v, want ErrInvalidScript", err)
+	}
+	if err := tx.verifyInputs(tx.spentOutputs(prevTXs), 3); err != nil {
+		t.Errorf("signature in the script in a version 3 block: %v", err)
+	}
+}
+
+func TestSignMultisigStopsAtRequired(t *testing.T) {
+	wallets := []*wallet.Wallet{wallet.MakeWallet(), wallet.MakeWallet(), wallet.MakeWallet()}
+	redeemScript, err := MultisigScript(2, [][]byte{wallets[0].PublicKey, wallets[1].PublicKey, wallets[2].PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := ScriptHash(redeemScript)
+	prevTX := Transaction{[]byte{1}, nil, []TxOutput{{10, hash, P2SHScript(hash)}}, 0}
+	prevTXs := map[string]Transaction{"01": prevTX}
+
+	unsigned := multisigUnlockingScript(make([][]byte, 3), redeemScript)
+	tx := &Transaction{nil, []TxInput{{prevTX.ID, 0, nil, nil, unsigned, 0}}, []TxOutput{*NewTXOutput(9, string(wallets[0].Address()))}, 0}
+
+	for i, want := range []int{1, 1, 0} {
+		n, err := tx.SignMultisig(wallets[i].PrivateKey, prevTXs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != want {
+			t.Errorf("key %d signed %d inputs, want %d", i, n, want)
+		}
+	}
+	if err := tx.verifyInputs(tx.spentOutputs(prevTXs), BlockVersion); err != nil {
+		t.Errorf("2-of-3 signed transaction: %v", err)
+	}
+}
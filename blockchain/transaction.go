@@ -3,81 +3,261 @@ package blockchain
 import (
 	"bytes"
 	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"fmt"
-	"log"
 	"math/big"
 	"strings"
+	"time"
 
 	"github.com/go-blockchain/wallet"
 )
 
+// LockTimeThreshold splits the values of Transaction.LockTime, smaller values are block heights
+// and larger ones unix times
+const LockTimeThreshold = 500000000
+
 // Transaction store input and output. Every block has a slice of transaction.
 type Transaction struct {
-	ID      []byte
-	Inputs  []TxInput
-	Outputs []TxOutput
+	ID       []byte
+	Inputs   []TxInput
+	Outputs  []TxOutput
+	LockTime int64 // the transaction is not valid in a block below this height or before this unix time, 0 for none
 }
 
-// CoinbaseTx create the first transaction for gensis block
-func CoinbaseTx(to, data string) *Transaction {
+// CoinbaseTx create the transaction which pays the mining reward, the subsidy of the block's height
+// plus the fees of the block's transactions. It is the first transaction of every block.
+// Without data, random data is used so two coinbases to the same address get different IDs.
+// To must be a valid address, like for NewTXOutput.
+func CoinbaseTx(to, data string, reward int) *Transaction {
 	if data == "" {
-		data = fmt.Sprintf("Coins to %s", to)
+		randData := make([]byte, 24)
+		_, err := rand.Read(randData)
+		Handle(err)
+		data = fmt.Sprintf("%x", randData)
 	}
 
-	txin := TxInput{[]byte{}, -1, nil, []byte(data)}
-	txout := NewTXOutput(100, to)
+	txin := TxInput{[]byte{}, -1, nil, []byte(data), nil, 0}
+	txout := NewTXOutput(reward, to)
 
-	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}}
+	tx := Transaction{nil, []TxInput{txin}, []TxOutput{*txout}, 0}
 	tx.SetID()
 
 	return &tx
 }
 
-// NewTransaction create a new Transaction for general block
-func NewTransaction(from, to string, amount int, UTXO *UTXOSet) *Transaction {
+// TxOptions are the locks, fee rate and coin selection of a new transaction,
+// the zero value has no locks and no fee rate and uses DefaultCoinSelector and no dust limit
+type TxOptions struct {
+	LockTime   int64        // the height or unix time the transaction is valid from, see LockTimeThreshold
+	LockBlocks int          // the blocks after the block of the transaction the payment can be spent
+	FeeRate    int          // the fee per 1000 serialized bytes paid on top of the fixed fee
+	Selector   CoinSelector // picks the coins the transaction spends
+	DustLimit  int          // change up to DustLimit is left to the miner, see SelectionTarget
+}
+
+// rateFee return the fee of size bytes at the fee rate, rounded up
+func (opts TxOptions) rateFee(size int) int {
+	return (size*opts.FeeRate + 999) / 1000
+}
+
+// NewTransaction create a new Transaction for general block which pays amount to to and leaves fee to the miner,
+// it returns ErrInsufficientFunds when from cannot pay the amount and the fee.
+// From may be a multisig address of the wallet file when the file has enough of its keys,
+// otherwise it returns ErrMissingSignatures and the transaction is built with NewMultisigTransaction.
+func NewTransaction(from, to string, amount, fee int, opts TxOptions, UTXO *UTXOSet) (*Transaction, error) {
+	wallets, err := wallet.CreateWallets(UTXO.Blockchain.Options.WalletFile())
+	if err != nil {
+		return nil, err
+	}
+
+	if multisig, ok := wallets.GetMultisig(from); ok {
+		tx, err := newMultisigTransaction(wallets, multisig, from, to, amount, fee, opts, UTXO)
+		if err != nil {
+			return nil, err
+		}
+
+		complete, err := UTXO.Blockchain.VerifyTransaction(tx)
+		if err != nil {
+			return nil, err
+		}
+		if !complete {
+			return nil, fmt.Errorf("%w: the wallet has fewer than %d keys of %s", ErrMissingSignatures, multisig.Required, from)
+		}
+		return tx, nil
+	}
+
+	if _, ok := wallets.Wallets[from]; !ok {
+		return nil, fmt.Errorf("%w: %s", ErrWalletNotFound, from)
+	}
+	w := wallets.GetWallet(from)
+
+	tx, err := newTransaction(from, to, amount, fee, opts, UTXO, func(txID []byte, out int) TxInput {
+		return TxInput{txID, out, nil, w.PublicKey, nil, 0}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := UTXO.Blockchain.SignTransaction(tx, w.PrivateKey); err != nil {
+		return nil, err
+	}
+	// ID 包含簽章，所以在簽完之後才計算
+	tx.ID = tx.Hash()
+
+	return tx, nil
+}
+
+// NewMultisigTransaction create a new Transaction like NewTransaction which spends the coins of from,
+// a multisig address of the wallet file. It is signed with the keys of the multisig in the wallet file,
+// which may be none, and the other key holders add their signatures with SignMultisig.
+func NewMultisigTransaction(from, to string, amount, fee int, opts TxOptions, UTXO *UTXOSet) (*Transaction, error) {
+	wallets, err := wallet.CreateWallets(UTXO.Blockchain.Options.WalletFile())
+	if err != nil {
+		return nil, err
+	}
+
+	multisig, ok := wallets.GetMultisig(from)
+	if !ok {
+		return nil, fmt.Errorf("%w: %s is not a multisig address", ErrWalletNotFound, from)
+	}
+
+	return newMultisigTransaction(wallets, multisig, from, to, amount, fee, opts, UTXO)
+}
+
+// newMultisigTransaction create the transaction spending the coins of the multisig
+// and sign it with the keys of the multisig in wallets
+func newMultisigTransaction(wallets *wallet.Wallets, multisig *wallet.Multisig, from, to string, amount, fee int, opts TxOptions, UTXO *UTXOSet) (*Transaction, error) {
+	tx, err := newTransaction(from, to, amount, fee, opts, UTXO, multisigInput(multisig))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, pubKey := range multisig.PublicKeys {
+		w, ok := wallets.FindWallet(pubKey)
+		if !ok {
+			continue
+		}
+		if _, err := UTXO.Blockchain.SignMultisigTransaction(tx, w.PrivateKey); err != nil {
+			return nil, err
+		}
+	}
+	tx.ID = tx.Hash()
+
+	return tx, nil
+}
+
+// multisigInput return the function making the unsigned inputs spending outputs of the multisig
+func multisigInput(multisig *wallet.Multisig) func(txID []byte, out int) TxInput {
+	// 每把 key 先留一個空的簽章
+	unsigned := multisigUnlockingScript(make([][]byte, len(multisig.PublicKeys)), multisig.RedeemScript)
+
+	return func(txID []byte, out int) TxInput {
+		return TxInput{txID, out, nil, nil, unsigned, 0}
+	}
+}
+
+// newTransaction create the unsigned transaction paying amount from from to to with fee and the options of opts,
+// input make the input spending an output of from. The coins are picked by opts.Selector, and the fee grows
+// with the size of the transaction at opts.FeeRate. Change too small to be worth spending, or not more than
+// the dust limit, is left to the miner.
+func newTransaction(from, to string, amount, fee int, opts TxOptions, UTXO *UTXOSet, input func(txID []byte, out int) TxInput) (*Transaction, error) {
 	var inputs []TxInput
 	var outputs []TxOutput
 
-	wallets, err := wallet.CreateWallets()
-	Handle(err)
-	w := wallets.GetWallet(from)
-	pubKeyHash := wallet.PublicKeyHash(w.PublicKey)
+	if err := checkAddress(from); err != nil {
+		return nil, err
+	}
+	if err := checkAddress(to); err != nil {
+		return nil, err
+	}
+	if fee < 0 || opts.FeeRate < 0 {
+		return nil, fmt.Errorf("%w: fee %d and fee rate %d must not be negative", ErrInvalidTransaction, fee, opts.FeeRate)
+	}
+	if opts.LockTime < 0 || opts.LockBlocks < 0 {
+		return nil, fmt.Errorf("%w: lock time %d and lock blocks %d must not be negative", ErrInvalidTransaction, opts.LockTime, opts.LockBlocks)
+	}
+	if opts.DustLimit < 0 {
+		return nil, fmt.Errorf("%w: dust limit %d must not be negative", ErrInvalidTransaction, opts.DustLimit)
+	}
+	selector := opts.Selector
+	if selector == nil {
+		selector = CoinSelectors[DefaultCoinSelector]
+	}
 
-	acc, validOutputs := UTXO.FindSpendableOutputs(pubKeyHash, amount)
+	payment := NewTXOutput(amount, to)
+	if opts.LockBlocks > 0 {
+		var err error
+		if payment, err = NewRelativeLockOutput(amount, to, opts.LockBlocks); err != nil {
+			return nil, err
+		}
+	}
+	change := NewTXOutput(0, from)
 
-	// 檢查是否超過可傳送的金額
-	if amount > acc {
-		log.Panic("Error: not enough funds")
+	coins, err := UTXO.SpendableCoins(from)
+	if err != nil {
+		return nil, err
 	}
 
-	// create Input by looping validOutputs (spendable outputs)
-	for txid, outs := range validOutputs {
-		txID, err := hex.DecodeString(txid)
-		Handle(err)
+	// 依照大小估計手續費：沒有 input 的交易、每個 input 和找零的 output
+	base := &Transaction{nil, nil, []TxOutput{*payment}, opts.LockTime}
+	withChange := &Transaction{nil, nil, []TxOutput{*payment, *change}, opts.LockTime}
+	target := SelectionTarget{
+		Amount:    amount + fee + opts.rateFee(len(base.Serialize())),
+		InputFee:  opts.rateFee(estimateInputSize(input(make([]byte, 32), 0))),
+		ChangeFee: opts.rateFee(len(withChange.Serialize()) - len(base.Serialize())),
+		DustLimit: opts.DustLimit,
+	}
 
-		for _, out := range outs {
-			// create Input
-			inputs = append(inputs, TxInput{txID, out, nil, w.PublicKey})
+	selected := selector(coins, target)
+	if selected == nil {
+		// 能付的是扣掉花費手續費後的有效價值
+		available := 0
+		for _, coin := range positiveCoins(coins, target) {
+			available += target.effectiveValue(coin)
 		}
+		return nil, fmt.Errorf("%w: %s has %d, needs %d", ErrInsufficientFunds, from, available, target.Amount)
 	}
 
-	//  create Output
-	outputs = append(outputs, *NewTXOutput(amount, to))
+	value := 0
+	for _, coin := range selected {
+		in := input(coin.TxID, coin.Index)
+		// 有相對鎖定的 output 要用足夠的 Sequence 才能花
+		in.Sequence = coin.Output.RelativeLock()
+		inputs = append(inputs, in)
+		value += target.effectiveValue(coin)
+	}
+
+	outputs = append(outputs, *payment)
 
-	if amount < acc {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	// 剩下的扣掉手續費找回給自己，輸入與輸出的差額就是手續費。
+	// 不值得再花費的零錢 (dust) 不找零，留給礦工
+	if left := value - target.Amount; left > target.CostOfChange() {
+		change.Value = left - target.ChangeFee
+		outputs = append(outputs, *change)
 	}
 
-	tx := Transaction{nil, inputs, outputs}
-	tx.ID = tx.Hash()
-	UTXO.Blockchain.SignTransaction(&tx, w.PrivateKey)
+	return &Transaction{nil, inputs, outputs, opts.LockTime}, nil
+}
 
-	return &tx
+// estimateInputSize return the serialized size of the input once it is signed, a P2PKH input
+// with a signature and a public key and a multisig input with the signatures of as many keys as it needs
+func estimateInputSize(in TxInput) int {
+	if len(in.Script) == 0 {
+		// 未簽名的 raw transaction 還沒有 public key
+		in.Signature, in.PubKey = make([]byte, 64), make([]byte, 64)
+	} else if signatures, redeemScript, ok := parseMultisigUnlocking(in.Script); ok {
+		required, _, _ := parseMultisig(redeemScript)
+		for i := 0; i < required; i++ {
+			signatures[i] = make([]byte, 64)
+		}
+		in.Script = multisigUnlockingScript(signatures, redeemScript)
+	}
+
+	without := &Transaction{}
+	with := &Transaction{nil, []TxInput{in}, nil, 0}
+	return len(with.Serialize()) - len(without.Serialize())
 }
 
 func (tx *Transaction) String() string {
@@ -91,50 +271,128 @@ func (tx *Transaction) String() string {
 		lines = append(lines, fmt.Sprintf("      Out %d:", input.Out))
 		lines = append(lines, fmt.Sprintf("    	 Signature %x:", input.Signature))
 		lines = append(lines, fmt.Sprintf("      PubKey %x:", input.PubKey))
+		if len(input.Script) != 0 {
+			lines = append(lines, fmt.Sprintf("      Script %s:", disassemble(input.Script)))
+		}
+		if input.Sequence != 0 {
+			lines = append(lines, fmt.Sprintf("      Sequence %d:", input.Sequence))
+		}
 	}
 
 	for i, output := range tx.Outputs {
 		lines = append(lines, fmt.Sprintf("    Output %d:", i))
 		lines = append(lines, fmt.Sprintf("      Value %d:", output.Value))
-		lines = append(lines, fmt.Sprintf("      Script %x:", output.PubKeyHash))
+		lines = append(lines, fmt.Sprintf("      PubKeyHash %x:", output.PubKeyHash))
+		if len(output.Script) != 0 {
+			lines = append(lines, fmt.Sprintf("      Script %s:", disassemble(output.Script)))
+		}
+	}
+
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("    LockTime %s:", lockTimeString(tx.LockTime)))
 	}
 
 	return strings.Join(lines, "\n")
 }
 
-// Serialize serialize the transaction with gob
-func (tx *Transaction) Serialize() []byte {
-	var encoded bytes.Buffer
-	enc := gob.NewEncoder(&encoded)
-	err := enc.Encode(tx)
+// disassemble return the readable script, or its bytes when it cannot be parsed
+func disassemble(script []byte) string {
+	s, err := DisassembleScript(script)
 	if err != nil {
-		log.Panic(err)
+		return fmt.Sprintf("%x", script)
 	}
+	return s
+}
 
-	return encoded.Bytes()
+// Serialize serialize the transaction with the binary encoding of EncodingVersion
+func (tx *Transaction) Serialize() []byte {
+	e := newEncoder()
+	e.writeTransaction(tx)
+	return e.Bytes()
 }
 
-// Hash return the hash of the transaction as the transaction ID
+// DeserializeTransaction turn bytes back to Transaction
+func DeserializeTransaction(data []byte) (Transaction, error) {
+	d := newDecoder(data)
+	tx := d.readTransaction()
+	if err := d.finish(); err != nil {
+		return Transaction{}, err
+	}
+	return *tx, nil
+}
+
+// Hash return the hash of the transaction as the transaction ID. It is hashed with encoding version 3,
+// the last one which changed transactions, and with version 2 when it uses no lock,
+// so the IDs from before locks stay the same.
 func (tx *Transaction) Hash() []byte {
 	var hash [32]byte
 	txCopy := *tx
 	txCopy.ID = []byte{}
 
-	hash = sha256.Sum256(txCopy.Serialize())
+	version := byte(3)
+	if !tx.usesLocks() {
+		version = 2
+	}
+	e := newEncoderVersion(version)
+	e.writeTransaction(&txCopy)
+
+	hash = sha256.Sum256(e.Bytes())
 	return hash[:]
 }
 
+// usesLocks report whether the transaction has a LockTime or an input with a Sequence
+func (tx *Transaction) usesLocks() bool {
+	if tx.LockTime != 0 {
+		return true
+	}
+	for _, in := range tx.Inputs {
+		if in.Sequence != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// IsFinal report whether the lock time of the transaction has passed in a block at height,
+// whose previous block has the median time medianTime
+func (tx *Transaction) IsFinal(height int, medianTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	if tx.LockTime < LockTimeThreshold {
+		return int64(height) >= tx.LockTime
+	}
+	return medianTime >= tx.LockTime
+}
+
+// lockTimeString return the readable lock time, a height or a time
+func lockTimeString(lockTime int64) string {
+	if lockTime < LockTimeThreshold {
+		return fmt.Sprintf("height %d", lockTime)
+	}
+	return time.Unix(lockTime, 0).UTC().Format(time.RFC3339)
+}
+
 // SetID generate transaction's ID with sha256 in 32 bytes
 func (tx *Transaction) SetID() {
-	var encoded bytes.Buffer
-	var hash [32]byte
+	tx.ID = tx.Hash()
+}
 
-	encode := gob.NewEncoder(&encoded)
-	err := encode.Encode(tx)
-	Handle(err)
+// SetExtraNonce change the extra nonce of a coinbase transaction and its ID.
+// A coinbase input has no signature, so the miner keeps the extra nonce there.
+func (tx *Transaction) SetExtraNonce(extraNonce uint64) {
+	tx.Inputs[0].Signature = ToHex(int64(extraNonce))
+	tx.ID = tx.Hash()
+}
 
-	hash = sha256.Sum256(encoded.Bytes())
-	tx.ID = hash[:]
+// OutputValue return the sum of the outputs' values
+func (tx *Transaction) OutputValue() int {
+	value := 0
+	for _, out := range tx.Outputs {
+		value += out.Value
+	}
+
+	return value
 }
 
 // IsCoinbase check whether the transaction is coinbase transaction
@@ -142,91 +400,244 @@ func (tx *Transaction) IsCoinbase() bool {
 	return len(tx.Inputs) == 1 && len(tx.Inputs[0].ID) == 0 && tx.Inputs[0].Out == -1
 }
 
-// Sign create all signature to all inputs of the transaction
-func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) {
+// Sign create the signatures of all inputs of the transaction with privKey,
+// the inputs must spend P2PKH outputs of the key's address, with or without a relative lock
+func (tx *Transaction) Sign(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) error {
 	if tx.IsCoinbase() {
-		return
+		return nil
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("ERROR: Previous transaction is not correct")
+	for inIndex, in := range tx.Inputs {
+		prevTX := prevTXs[hex.EncodeToString(in.ID)]
+		if prevTX.ID == nil {
+			return fmt.Errorf("%w: %x", ErrTxNotFound, in.ID)
+		}
+		if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+			return fmt.Errorf("%w: output %d of %x does not exist", ErrInvalidTransaction, in.Out, in.ID)
+		}
+		if !prevTX.Outputs[in.Out].keyLocked() {
+			return fmt.Errorf("%w: input %d spends a script output, build its unlocking script with SignatureHash and SignHash", ErrInvalidTransaction, inIndex)
 		}
 	}
 
-	txCopy := tx.TrimmedCopy()
-
-	// 不懂
-	for inIndex, in := range txCopy.Inputs {
+	for inIndex, in := range tx.Inputs {
 		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inIndex].Signature = nil
-		txCopy.Inputs[inIndex].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inIndex].PubKey = nil
 
-		r, s, err := ecdsa.Sign(rand.Reader, &privKey, txCopy.ID)
-		Handle(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+		if err := tx.signInput(inIndex, privKey, prevTX.Outputs[in.Out]); err != nil {
+			return err
+		}
+	}
 
-		tx.Inputs[inIndex].Signature = signature
+	return nil
+}
+
+// signInput sign input inIndex spending the P2PKH output prevOut with privKey
+func (tx *Transaction) signInput(inIndex int, privKey ecdsa.PrivateKey, prevOut TxOutput) error {
+	signature, err := SignHash(privKey, tx.SignatureHash(inIndex, prevOut))
+	if err != nil {
+		return err
 	}
+
+	tx.Inputs[inIndex].Signature = signature
+	return nil
 }
 
-// Verify 完全不懂
-func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+// SignMultisig add the signatures of privKey to the inputs spending a multisig address the key belongs to
+// which do not have enough signatures yet, and return how many inputs it signed. The inputs must have the multisig unlocking script of
+// NewMultisigTransaction, the signatures of the other keys are kept. The ID is set again since it covers the signatures.
+func (tx *Transaction) SignMultisig(privKey ecdsa.PrivateKey, prevTXs map[string]Transaction) (int, error) {
+	return tx.signMultisig(privKey, tx.spentOutputs(prevTXs))
+}
+
+// signMultisig is SignMultisig with the spent outputs by their outpointKey
+func (tx *Transaction) signMultisig(privKey ecdsa.PrivateKey, prevOuts map[string]TxOutput) (int, error) {
 	if tx.IsCoinbase() {
-		return true
+		return 0, nil
 	}
 
-	for _, in := range tx.Inputs {
-		if prevTXs[hex.EncodeToString(in.ID)].ID == nil {
-			log.Panic("Previous Transaction does not exist")
+	pubKey := append(padBytes(privKey.PublicKey.X.Bytes(), 32), padBytes(privKey.PublicKey.Y.Bytes(), 32)...)
+	signed := 0
+
+	for inIndex, in := range tx.Inputs {
+		prevOut, ok := prevOuts[outpointKey(in)]
+		if !ok {
+			return 0, fmt.Errorf("%w: output %d of %x", ErrTxNotFound, in.Out, in.ID)
+		}
+
+		signatures, redeemScript, ok := parseMultisigUnlocking(in.Script)
+		if !ok || !isP2SH(prevOut.Script) || !bytes.Equal(prevOut.PubKeyHash, ScriptHash(redeemScript)) {
+			continue
+		}
+
+		// 簽章已經夠了就不再加，多的簽章會讓 input 無效
+		required, pubKeys, _ := parseMultisig(redeemScript)
+		have := 0
+		for _, signature := range signatures {
+			if len(signature) != 0 {
+				have++
+			}
 		}
+		if have >= required {
+			continue
+		}
+
+		for i, key := range pubKeys {
+			if !bytes.Equal(key, pubKey) {
+				continue
+			}
+
+			signature, err := SignHash(privKey, tx.SignatureHash(inIndex, prevOut))
+			if err != nil {
+				return 0, err
+			}
+			signatures[i] = signature
+			tx.Inputs[inIndex].Script = multisigUnlockingScript(signatures, redeemScript)
+			signed++
+			break
+		}
+	}
+
+	if signed > 0 {
+		tx.ID = tx.Hash()
 	}
+	return signed, nil
+}
+
+// SignatureHash return the hash the signatures of input inIndex sign: the hash of the transaction
+// without any signatures and unlocking scripts, with the PubKeyHash or Script of prevOut,
+// the output the input spends, in place of the input's PubKey, hashed again with the Value of prevOut
+func (tx *Transaction) SignatureHash(inIndex int, prevOut TxOutput) []byte {
+	return tx.signatureHash(inIndex, prevOut, BlockVersion)
+}
 
+// signatureHash is SignatureHash with the rules of a block of version, before version 3 the Value is not hashed
+func (tx *Transaction) signatureHash(inIndex int, prevOut TxOutput, version int) []byte {
 	txCopy := tx.TrimmedCopy()
-	curve := elliptic.P256()
 
-	for inIndex, in := range txCopy.Inputs {
-		prevTX := prevTXs[hex.EncodeToString(in.ID)]
-		txCopy.Inputs[inIndex].Signature = nil
-		txCopy.Inputs[inIndex].PubKey = prevTX.Outputs[in.Out].PubKeyHash
-		txCopy.ID = txCopy.Hash()
-		txCopy.Inputs[inIndex].PubKey = nil
+	txCopy.Inputs[inIndex].PubKey = prevOut.PubKeyHash
+	if len(prevOut.Script) != 0 {
+		txCopy.Inputs[inIndex].PubKey = prevOut.Script
+	}
+
+	hash := txCopy.Hash()
+	if version < 3 {
+		return hash
+	}
+
+	// 簽章也涵蓋花費的金額，離線簽名的人才不會被少報的金額騙，以為手續費很少
+	e := newEncoder()
+	e.writeBytes(hash)
+	e.writeInt(int64(prevOut.Value))
+	sum := sha256.Sum256(e.Bytes())
+	return sum[:]
+}
+
+// SignHash sign the hash with privKey, the signature is r and s padded to 32 bytes each
+func SignHash(privKey ecdsa.PrivateKey, hash []byte) ([]byte, error) {
+	r, s, err := ecdsa.Sign(rand.Reader, &privKey, hash)
+	if err != nil {
+		return nil, err
+	}
+
+	// s 和 N-s 都是有效的簽章，只用比較小的那個，否則任何人都能改掉簽章和交易的 ID
+	if !isLowS(s) {
+		s.Sub(privKey.Curve.Params().N, s)
+	}
+
+	// r 和 s 各補滿 32 bytes，驗證時才能從中間切開
+	return append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...), nil
+}
+
+// Verify check every input satisfies the locking script of the output it spends,
+// a missing previous transaction makes the transaction invalid
+func (tx *Transaction) Verify(prevTXs map[string]Transaction) bool {
+	return tx.VerifyScripts(prevTXs) == nil
+}
 
-		r := big.Int{}
-		s := big.Int{}
-		sigLen := len(in.Signature)
-		r.SetBytes(in.Signature[:(sigLen / 2)])
-		s.SetBytes(in.Signature[(sigLen / 2):])
+// VerifyScripts run the unlocking script of every input and the locking script of the output it spends,
+// and return why an input cannot spend its output
+func (tx *Transaction) VerifyScripts(prevTXs map[string]Transaction) error {
+	return tx.verifyInputs(tx.spentOutputs(prevTXs), BlockVersion)
+}
 
-		x := big.Int{}
-		y := big.Int{}
-		keyLen := len(in.PubKey)
-		x.SetBytes(in.PubKey[:(keyLen / 2)])
-		y.SetBytes(in.PubKey[(keyLen / 2):])
+// spentOutputs return the outputs of prevTXs the inputs spend by their outpointKey,
+// the outputs which are not in prevTXs are left out
+func (tx *Transaction) spentOutputs(prevTXs map[string]Transaction) map[string]TxOutput {
+	prevOuts := make(map[string]TxOutput)
+	for _, in := range tx.Inputs {
+		prevTX, ok := prevTXs[hex.EncodeToString(in.ID)]
+		if ok && in.Out >= 0 && in.Out < len(prevTX.Outputs) {
+			prevOuts[outpointKey(in)] = prevTX.Outputs[in.Out]
+		}
+	}
+	return prevOuts
+}
+
+// verifyInputs is VerifyScripts with the rules of a block of version,
+// from version 3 a signature whose s is above N/2 is invalid and signatures sign the value they spend.
+// From version 4 the scripts are strict, see verifyScripts, and an input spending a keyLocked output
+// has only Signature and PubKey and any other input only Script, so an input has one form.
+func (tx *Transaction) verifyInputs(prevOuts map[string]TxOutput, version int) error {
+	if tx.IsCoinbase() {
+		return nil
+	}
+
+	for inIndex, in := range tx.Inputs {
+		prevOut, ok := prevOuts[outpointKey(in)]
+		if !ok {
+			return fmt.Errorf("%w: output %d of %x spent by input %d", ErrTxNotFound, in.Out, in.ID, inIndex)
+		}
 
-		rawPubKey := ecdsa.PublicKey{curve, &x, &y}
-		if ecdsa.Verify(&rawPubKey, txCopy.ID, &r, &s) == false {
-			return false
+		if version >= 4 && prevOut.keyLocked() && len(in.Script) != 0 {
+			return fmt.Errorf("input %d: %w: an input spending a key locked output has a script", inIndex, ErrInvalidScript)
+		}
+		if version >= 4 && !prevOut.keyLocked() && (len(in.Signature) != 0 || len(in.PubKey) != 0) {
+			return fmt.Errorf("input %d: %w: an input with a script has a signature or a public key", inIndex, ErrInvalidScript)
+		}
+
+		// 只有遇到 OP_CHECKSIG 才需要計算簽章的 hash
+		var hash []byte
+		check := func(signature, pubKey []byte) bool {
+			if hash == nil {
+				hash = tx.signatureHash(inIndex, prevOut, version)
+			}
+			if version >= 3 && len(signature) == 64 && !isLowS(new(big.Int).SetBytes(signature[32:])) {
+				return false
+			}
+			return verifySignature(hash, signature, pubKey)
+		}
+
+		if err := verifyScripts(in.UnlockingScript(), prevOut.LockingScript(), scriptContext{check, in.Sequence, version >= 4}); err != nil {
+			return fmt.Errorf("input %d: %w", inIndex, err)
 		}
 	}
-	return true
+
+	return nil
+}
+
+// padBytes left pad b with zeros to size bytes
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
 }
 
-// TrimmedCopy return copy of the transaction with input's Sig and PubKey trimmed
+// TrimmedCopy return copy of the transaction with input's Sig, PubKey and Script trimmed,
+// the signatures cover everything else
 func (tx *Transaction) TrimmedCopy() Transaction {
 	var inputs []TxInput
 	var outputs []TxOutput
 
 	for _, in := range tx.Inputs {
-		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil})
+		inputs = append(inputs, TxInput{in.ID, in.Out, nil, nil, nil, in.Sequence})
 	}
 
 	for _, out := range tx.Outputs {
-		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash})
+		outputs = append(outputs, TxOutput{out.Value, out.PubKeyHash, out.Script})
 	}
 
-	txCopy := Transaction{tx.ID, inputs, outputs}
+	txCopy := Transaction{tx.ID, inputs, outputs, tx.LockTime}
 	return txCopy
 }
@@ -2,7 +2,8 @@ package blockchain
 
 import (
 	"bytes"
-	"encoding/gob"
+	"fmt"
+	"sort"
 
 	"github.com/go-blockchain/wallet"
 )
@@ -13,36 +14,87 @@ type TxInput struct {
 	Out       int
 	Signature []byte
 	PubKey    []byte
+	Script    []byte // the unlocking script, without it the input pushes Signature and PubKey
+	Sequence  int    // the relative lock, the input is only valid Sequence blocks after the block of the output it spends
 }
 
-// TxOutputs has a list of TxOutput
+// TxOutputs is the record of the UTXO set for one transaction, the height of its block,
+// whether it is a coinbase and its unspent outputs sorted by their index in the transaction
 type TxOutputs struct {
-	Outputs []TxOutput
+	Height   int
+	Coinbase bool
+	Outputs  []UnspentOutput
 }
 
-// TxOutput has Value which is the transaction token,
-// and the Pubkey is for unlocking the Value field.
-// In bitcoin, the Pubkey is derived from a complicated scripting language called 'script'
-// we just use arbitrary key to represent the user's address
+// UnspentOutput is an output which is not spent yet and its index in the transaction
+type UnspentOutput struct {
+	Index  int
+	Output TxOutput
+}
+
+// TxOutput has Value which is the transaction token, locked with a script like in bitcoin.
+// Most outputs pay to an address and have no Script, they are locked with the P2PKH script of PubKeyHash.
+// An output with a Script has the ScriptHash of it as PubKeyHash, which is the address it is indexed by,
+// except the P2SHScript of a multisig address whose PubKeyHash is the hash of the redeem script,
+// and the RelativeLockScript whose PubKeyHash is the address it pays to.
 type TxOutput struct {
 	Value      int    // how much token be send
 	PubKeyHash []byte // the token receiver's address
+	Script     []byte // the locking script, P2PKHScript(PubKeyHash) without it
 }
 
-// NewTXOutput create a new TxOutput with value and address
+// NewTXOutput create a new TxOutput with value and address, which must be valid
 func NewTXOutput(value int, address string) *TxOutput {
-	txo := &TxOutput{value, nil}
+	txo := &TxOutput{value, nil, nil}
 	txo.Lock([]byte(address))
 	return txo
 }
 
+// NewRelativeLockOutput create a new TxOutput with value to the address, which can only be spent
+// blocks after the block of the transaction
+func NewRelativeLockOutput(value int, address string, blocks int) (*TxOutput, error) {
+	if err := checkAddress(address); err != nil {
+		return nil, err
+	}
+	if wallet.IsScriptAddress(address) {
+		return nil, fmt.Errorf("%w: a relative lock pays to a public key address, not %s", ErrInvalidTransaction, address)
+	}
+	if blocks <= 0 {
+		return nil, fmt.Errorf("%w: relative lock of %d blocks", ErrInvalidTransaction, blocks)
+	}
+
+	txo := NewTXOutput(value, address)
+	txo.Script = RelativeLockScript(blocks, txo.PubKeyHash)
+	return txo, nil
+}
+
+// NewScriptOutput create a new TxOutput with value locked with the script
+func NewScriptOutput(value int, script []byte) *TxOutput {
+	return &TxOutput{value, ScriptHash(script), script}
+}
+
 // DeserializeOutputs turn bytes back to TxOutputs
-func DeserializeOutputs(data []byte) TxOutputs {
+func DeserializeOutputs(data []byte) (TxOutputs, error) {
 	var outputs TxOutputs
-	decode := gob.NewDecoder(bytes.NewReader(data))
-	err := decode.Decode(&outputs)
-	Handle(err)
-	return outputs
+	d := newDecoder(data)
+
+	// 舊版的紀錄沒有高度和 coinbase，只能重建
+	if d.err == nil && d.version < 4 {
+		d.err = fmt.Errorf("%w: record of version %d has no height or coinbase", ErrInvalidEncoding, d.version)
+	}
+	outputs.Height = int(d.readInt())
+	outputs.Coinbase = d.readBool()
+
+	n := d.readCount()
+	for i := 0; i < n && d.err == nil; i++ {
+		index := int(d.readInt())
+		outputs.Outputs = append(outputs.Outputs, UnspentOutput{index, d.readOutput()})
+	}
+
+	if err := d.finish(); err != nil {
+		return TxOutputs{}, fmt.Errorf("UTXO record cannot be read, rebuild the UTXO set with reindexutxo: %w", err)
+	}
+	return outputs, nil
 }
 
 // type TxInput
@@ -55,27 +107,145 @@ func (in *TxInput) UsesKey(pubKeyHash []byte) bool {
 	return bytes.Compare(lockingHash, pubKeyHash) == 0
 }
 
+// UnlockingScript return the script run before the locking script of the spent output,
+// it pushes Signature and PubKey for an input without a Script
+func (in *TxInput) UnlockingScript() []byte {
+	if len(in.Script) != 0 {
+		return in.Script
+	}
+	return NewScriptBuilder().AddData(in.Signature).AddData(in.PubKey).Script()
+}
+
 // type TxOutput
 
-// Lock get address's public key, and assign into output's PubKeyHash
+// LockingScript return the script an input spending the output must satisfy
+func (out *TxOutput) LockingScript() []byte {
+	if len(out.Script) != 0 {
+		return out.Script
+	}
+	return P2PKHScript(out.PubKeyHash)
+}
+
+// Lock get address's public key, and assign into output's PubKeyHash,
+// the output of a script address is locked with the P2SHScript of the hash.
+// It panics on an invalid address, check it with checkAddress first.
 func (out *TxOutput) Lock(address []byte) {
 	pubKeyHash := wallet.Base58Decode(address)
 	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
 	out.PubKeyHash = pubKeyHash
+	out.Script = nil
+	if wallet.IsScriptAddress(string(address)) {
+		out.Script = P2SHScript(pubKeyHash)
+	}
+}
+
+// checkAddress return an ErrInvalidAddress error when the address is not valid
+func checkAddress(address string) error {
+	if !wallet.ValidateAddress(address) {
+		return fmt.Errorf("%w: %q", ErrInvalidAddress, address)
+	}
+	return nil
+}
+
+// Address return the address the output pays to, the script address of the hash for an output with a Script
+func (out *TxOutput) Address() string {
+	if !out.keyLocked() {
+		return string(wallet.ScriptAddress(out.PubKeyHash))
+	}
+	return string(wallet.PubKeyHashAddress(out.PubKeyHash))
 }
 
-// IsLockedWithKey check the pubKeyHash is equal to output's PubKeyHash so that you can unlock output with the key
+// hashMatchesScript report whether PubKeyHash is the address of the Script,
+// the hash of the Script or for a P2SHScript the hash it contains
+func (out *TxOutput) hashMatchesScript() bool {
+	if len(out.Script) == 0 {
+		return true
+	}
+	if bytes.Equal(out.Script, P2SHScript(out.PubKeyHash)) {
+		return true
+	}
+	if _, pubKeyHash, ok := parseRelativeLock(out.Script); ok && bytes.Equal(out.PubKeyHash, pubKeyHash) {
+		return true
+	}
+	return bytes.Equal(out.PubKeyHash, ScriptHash(out.Script))
+}
+
+// keyLocked report whether the output is spent with a signature and the public key of PubKeyHash,
+// an output without a Script or with a RelativeLockScript
+func (out *TxOutput) keyLocked() bool {
+	return len(out.Script) == 0 || out.RelativeLock() != 0
+}
+
+// RelativeLock return the blocks after the block of its transaction the output can be spent,
+// 0 for an output without a relative lock
+func (out *TxOutput) RelativeLock() int {
+	blocks, pubKeyHash, ok := parseRelativeLock(out.Script)
+	if !ok || !bytes.Equal(pubKeyHash, out.PubKeyHash) {
+		return 0
+	}
+	return blocks
+}
+
+// IsLockedWithKey check the output is key locked and pubKeyHash is equal to output's PubKeyHash so that you can unlock output with the key,
+// a script output whose hash is pubKeyHash cannot be unlocked with the key
 func (out *TxOutput) IsLockedWithKey(pubKeyHash []byte) bool {
-	return bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+	return out.keyLocked() && bytes.Compare(out.PubKeyHash, pubKeyHash) == 0
+}
+
+// paysTo report whether the output pays to the address of hash, a script address when script is true.
+// A key address only gets the key locked outputs of its hash and a script address the other outputs,
+// so a P2SH output of a key address's hash is not the key's coin.
+func (out *TxOutput) paysTo(hash []byte, script bool) bool {
+	return bytes.Equal(out.PubKeyHash, hash) && out.keyLocked() != script
 }
 
 // type TxOutputs
 
+// Get return the unspent output with the index
+func (outs *TxOutputs) Get(index int) (TxOutput, bool) {
+	i := sort.Search(len(outs.Outputs), func(i int) bool { return outs.Outputs[i].Index >= index })
+	if i < len(outs.Outputs) && outs.Outputs[i].Index == index {
+		return outs.Outputs[i].Output, true
+	}
+
+	return TxOutput{}, false
+}
+
+// Add put the output with the index back, keeping the outputs sorted.
+// It reports false when the index is already there.
+func (outs *TxOutputs) Add(index int, out TxOutput) bool {
+	i := sort.Search(len(outs.Outputs), func(i int) bool { return outs.Outputs[i].Index >= index })
+	if i < len(outs.Outputs) && outs.Outputs[i].Index == index {
+		return false
+	}
+
+	outs.Outputs = append(outs.Outputs, UnspentOutput{})
+	copy(outs.Outputs[i+1:], outs.Outputs[i:])
+	outs.Outputs[i] = UnspentOutput{index, out}
+	return true
+}
+
+// Remove spend the output with the index and return it
+func (outs *TxOutputs) Remove(index int) (TxOutput, bool) {
+	i := sort.Search(len(outs.Outputs), func(i int) bool { return outs.Outputs[i].Index >= index })
+	if i == len(outs.Outputs) || outs.Outputs[i].Index != index {
+		return TxOutput{}, false
+	}
+
+	out := outs.Outputs[i].Output
+	outs.Outputs = append(outs.Outputs[:i], outs.Outputs[i+1:]...)
+	return out, true
+}
+
 // Serialize turn TxOutputs into bytes
 func (outs *TxOutputs) Serialize() []byte {
-	var buffer bytes.Buffer
-	encode := gob.NewEncoder(&buffer)
-	err := encode.Encode(outs)
-	Handle(err)
-	return buffer.Bytes()
+	e := newEncoder()
+	e.writeInt(int64(outs.Height))
+	e.writeBool(outs.Coinbase)
+	e.writeUint32(uint32(len(outs.Outputs)))
+	for _, unspent := range outs.Outputs {
+		e.writeInt(int64(unspent.Index))
+		e.writeOutput(unspent.Output)
+	}
+	return e.Bytes()
 }
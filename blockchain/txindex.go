@@ -0,0 +1,120 @@
+package blockchain
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// The transaction index maps the ID of every transaction of the chain to its block:
+//
+//	tx-<txid> → <block hash><position of the transaction in the block>
+//
+// Blocks are indexed when they are connected and unindexed when they are disconnected.
+// txIndexKey is set once every block of the chain is indexed, a chain created before the index
+// has none until reindexutxo builds it, and FindTransaction walks the chain until then.
+var (
+	txPrefix   = []byte("tx-")
+	txIndexKey = []byte("txindex")
+)
+
+// HasTxIndex report whether every transaction of the chain is in the transaction index
+func (chain *Blockchain) HasTxIndex() (bool, error) {
+	var indexed bool
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(txIndexKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		indexed = err == nil
+		return err
+	})
+	return indexed, err
+}
+
+// ReindexTransactions rebuild the transaction index from the blocks of the chain
+func (chain *Blockchain) ReindexTransactions() error {
+	err := chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Delete(txIndexKey)
+	})
+	if err != nil {
+		return err
+	}
+	if err := (&UTXOSet{chain}).DeleteByPrefix(txPrefix); err != nil {
+		return err
+	}
+
+	iter := chain.CreateIterator()
+	for len(iter.CurrentHash) != 0 {
+		block, err := iter.Next()
+		if err != nil {
+			return err
+		}
+
+		err = chain.Database.Update(func(txn *badger.Txn) error {
+			return indexTransactions(txn, block)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return chain.Database.Update(func(txn *badger.Txn) error {
+		return txn.Set(txIndexKey, []byte{})
+	})
+}
+
+// indexTransactions add the block's transactions to the transaction index in txn
+func indexTransactions(txn *badger.Txn, block *Block) error {
+	for i, tx := range block.Transactions {
+		location := append(append([]byte{}, block.Hash...), ToHex(int64(i))[4:]...)
+		if err := txn.Set(append(txPrefix, tx.ID...), location); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// unindexTransactions remove the block's transactions from the transaction index in txn
+func unindexTransactions(txn *badger.Txn, block *Block) error {
+	for _, tx := range block.Transactions {
+		if err := txn.Delete(append(txPrefix, tx.ID...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// txLocation return the hash of the block with the transaction and its position in the block,
+// found is false when the transaction is not in the index
+func (chain *Blockchain) txLocation(ID []byte) ([]byte, int, bool, error) {
+	var hash []byte
+	var position int
+
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(txPrefix, ID...))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			if len(val) <= 4 {
+				return fmt.Errorf("invalid transaction index value of %x", ID)
+			}
+			hash = append([]byte{}, val[:len(val)-4]...)
+			position = int(binary.BigEndian.Uint32(val[len(val)-4:]))
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, 0, false, nil
+	}
+	if err != nil {
+		return nil, 0, false, err
+	}
+
+	return hash, position, true, nil
+}
@@ -0,0 +1,70 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestFindTransaction(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+
+	genesis := lastBlock(t, chain)
+	tx := spend(t, w, genesis.Transactions[0], 0, 1)
+	block := acceptOn(t, chain, acceptOn(t, chain, genesis, address), address, tx)
+
+	indexed, err := chain.HasTxIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !indexed {
+		t.Fatal("a new chain has no transaction index")
+	}
+	if hash, position, found, err := chain.txLocation(tx.ID); err != nil || !found || !bytes.Equal(hash, block.Hash) || position != 1 {
+		t.Errorf("index location %x %d %v %v, want %x 1", hash, position, found, err, block.Hash)
+	}
+
+	// 有索引和沒有索引時都要找得到
+	for _, index := range []bool{true, false} {
+		if !index {
+			err := chain.Database.Update(func(txn *badger.Txn) error {
+				return txn.Delete(txIndexKey)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, want := range []*Transaction{genesis.Transactions[0], tx} {
+			got, err := chain.FindTransaction(want.ID)
+			if err != nil {
+				t.Fatalf("index %v: %v", index, err)
+			}
+			if !bytes.Equal(got.ID, want.ID) {
+				t.Errorf("index %v: found %x, want %x", index, got.ID, want.ID)
+			}
+		}
+	}
+
+	if err := chain.ReindexTransactions(); err != nil {
+		t.Fatal(err)
+	}
+	if indexed, err := chain.HasTxIndex(); err != nil || !indexed {
+		t.Fatalf("no transaction index after reindexing: %v", err)
+	}
+
+	// 斷開的區塊的交易要從索引移除
+	if _, err := chain.DisconnectBlock(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, found, err := chain.txLocation(tx.ID); err != nil || found {
+		t.Errorf("the transaction of the disconnected block is still indexed: %v", err)
+	}
+	if _, err := chain.FindTransaction(tx.ID); !errors.Is(err, ErrTxNotFound) {
+		t.Errorf("FindTransaction of a disconnected transaction returned %v, want %v", err, ErrTxNotFound)
+	}
+}
@@ -0,0 +1,147 @@
+package blockchain
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger"
+)
+
+// undoPrefix is the key prefix of the undo data of every block on the chain
+var undoPrefix = []byte("undo-")
+
+// SpentOutput is an output spent by an input of a block, the height of the block of its transaction
+// and whether that transaction is a coinbase
+type SpentOutput struct {
+	TxID     []byte
+	Out      int
+	Height   int
+	Coinbase bool
+	Output   TxOutput
+}
+
+// BlockUndo is the undo data of a block, the outputs spent by its inputs in the order of the inputs.
+// It is stored when the block is connected, so the block can be disconnected without reading the chain.
+type BlockUndo struct {
+	Spent []SpentOutput
+}
+
+// Serialize turn BlockUndo into bytes
+func (u *BlockUndo) Serialize() []byte {
+	e := newEncoder()
+	e.writeUint32(uint32(len(u.Spent)))
+	for _, s := range u.Spent {
+		e.writeBytes(s.TxID)
+		e.writeInt(int64(s.Out))
+		e.writeInt(int64(s.Height))
+		e.writeBool(s.Coinbase)
+		e.writeOutput(s.Output)
+	}
+	return e.Bytes()
+}
+
+// DeserializeUndo turn bytes back to BlockUndo, the heights of undo data older than version 3 are 0
+// and the outputs of undo data older than version 4 are not from a coinbase
+func DeserializeUndo(data []byte) (BlockUndo, error) {
+	var undo BlockUndo
+	d := newDecoder(data)
+
+	n := d.readCount()
+	for i := 0; i < n && d.err == nil; i++ {
+		txID := d.readBytes()
+		out := int(d.readInt())
+		height, coinbase := 0, false
+		if d.version >= 3 {
+			height = int(d.readInt())
+		}
+		if d.version >= 4 {
+			coinbase = d.readBool()
+		}
+		undo.Spent = append(undo.Spent, SpentOutput{txID, out, height, coinbase, d.readOutput()})
+	}
+
+	if err := d.finish(); err != nil {
+		return BlockUndo{}, err
+	}
+	return undo, nil
+}
+
+// blockUndo read the undo data of the block in txn. Blocks connected before undo data was stored have none,
+// it is rebuilt from the transactions before the block, which must be the tip of the chain.
+func (chain *Blockchain) blockUndo(txn *badger.Txn, block *Block) (BlockUndo, error) {
+	item, err := txn.Get(append(undoPrefix, block.Hash...))
+	if err == nil {
+		var undo BlockUndo
+		err = item.Value(func(val []byte) error {
+			undo, err = DeserializeUndo(val)
+			return err
+		})
+		return undo, err
+	}
+	if err != badger.ErrKeyNotFound {
+		return BlockUndo{}, err
+	}
+
+	var undo BlockUndo
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		for _, in := range tx.Inputs {
+			prevTX, height, err := chain.findTransaction(in.ID)
+			if err != nil {
+				return BlockUndo{}, err
+			}
+			if in.Out < 0 || in.Out >= len(prevTX.Outputs) {
+				return BlockUndo{}, fmt.Errorf("%w: output %d of %x does not exist", ErrInvalidTransaction, in.Out, in.ID)
+			}
+
+			undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, height, prevTX.IsCoinbase(), prevTX.Outputs[in.Out]})
+		}
+	}
+
+	return undo, nil
+}
+
+// DisconnectBlock remove the last block from the chain and delete it, the block before it becomes the last block.
+// The UTXO set is restored from the block's undo data. The genesis block cannot be disconnected.
+func (chain *Blockchain) DisconnectBlock() (*Block, error) {
+	block, err := chain.disconnectTip()
+	if err != nil {
+		return nil, err
+	}
+
+	// 刪掉區塊，否則它的 work 比較多，下一個區塊進來時又會切換回去
+	if err := chain.removeBlock(block); err != nil {
+		return nil, err
+	}
+
+	tip, err := chain.LastBlock()
+	if err != nil {
+		return nil, err
+	}
+
+	chain.notify(TipChange{tip, []*Block{block}, nil})
+	return block, nil
+}
+
+// Rollback disconnect the blocks after height, the block at height becomes the last block
+func (chain *Blockchain) Rollback(height int) error {
+	if height < 0 {
+		return fmt.Errorf("height %d is negative", height)
+	}
+
+	for {
+		tip, err := chain.LastBlock()
+		if err != nil {
+			return err
+		}
+		if tip.Height <= height {
+			return nil
+		}
+
+		if _, err := chain.DisconnectBlock(); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package blockchain
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/dgraph-io/badger"
+)
+
+func TestStoredUndo(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	genesis := lastBlock(t, chain)
+	coinbase := genesis.Transactions[0]
+
+	block := acceptOn(t, chain, genesis, string(w.Address()), spend(t, w, coinbase, 0, 1))
+
+	var undo BlockUndo
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(undoPrefix, block.Hash...))
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			undo, err = DeserializeUndo(val)
+			return err
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := BlockUndo{[]SpentOutput{{coinbase.ID, 0, 0, true, coinbase.Outputs[0]}}}
+	if !reflect.DeepEqual(undo, want) {
+		t.Errorf("undo data %+v, want %+v", undo, want)
+	}
+}
+
+func TestRollback(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	address := string(w.Address())
+
+	genesis := lastBlock(t, chain)
+	first := acceptOn(t, chain, genesis, address)
+	second := acceptOn(t, chain, first, address, spend(t, w, genesis.Transactions[0], 0, 1))
+	third := acceptOn(t, chain, second, address)
+	before := storedUTXO(t, chain)
+
+	if err := chain.Rollback(-1); err == nil {
+		t.Error("rolled back to a negative height")
+	}
+	if err := chain.Rollback(5); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, third.Hash) || !reflect.DeepEqual(storedUTXO(t, chain), before) {
+		t.Error("rolling back to a height above the tip changed the chain")
+	}
+
+	if err := chain.Rollback(1); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(chain.LastHash, first.Hash) {
+		t.Errorf("last block %x after the rollback, want %x", chain.LastHash, first.Hash)
+	}
+	checkUTXO(t, chain, 0)
+	// 斷開的區塊被刪掉了
+	for _, block := range []*Block{second, third} {
+		if _, err := chain.GetBlockByHash(block.Hash); !errors.Is(err, ErrBlockNotFound) {
+			t.Errorf("block %d after the rollback: %v, want %v", block.Height, err, ErrBlockNotFound)
+		}
+	}
+
+	if err := chain.Rollback(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := chain.DisconnectBlock(); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("disconnecting the genesis block returned %v, want %v", err, ErrInvalidBlock)
+	}
+	checkUTXO(t, chain, 1)
+}
@@ -3,9 +3,10 @@ package blockchain
 import (
 	"bytes"
 	"encoding/hex"
-	"log"
+	"fmt"
 
 	"github.com/dgraph-io/badger"
+	"github.com/go-blockchain/wallet"
 )
 
 var (
@@ -18,88 +19,210 @@ type UTXOSet struct {
 	Blockchain *Blockchain
 }
 
-// FindSpendableOutputs take address we want to check and amount we want to send
-func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int) {
+// Coin is an unspent output of the UTXO set, with the height of the block of its transaction
+// and whether that transaction is a coinbase
+type Coin struct {
+	TxID     []byte
+	Index    int
+	Output   TxOutput
+	Height   int
+	Coinbase bool
+}
+
+// FindSpendableOutputs take address we want to check and amount we want to send,
+// the address index is used when the chain keeps it.
+// Only outputs which can be spent in the next block are taken, not immature coinbases
+// or outputs whose relative lock has not passed.
+func (u UTXOSet) FindSpendableOutputs(pubKeyHash []byte, amount int) (int, map[string][]int, error) {
 	unspendOuts := make(map[string][]int)
 	accumulated := 0
-	db := u.Blockchain.Database
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+	coins, err := u.SpendableCoins(string(wallet.PubKeyHashAddress(pubKeyHash)))
+	if err != nil {
+		return 0, nil, err
+	}
 
-		it := txn.NewIterator(opts)
+	for _, coin := range coins {
+		if accumulated >= amount {
+			break
+		}
+
+		accumulated += coin.Output.Value
+		txID := hex.EncodeToString(coin.TxID)
+		unspendOuts[txID] = append(unspendOuts[txID], coin.Index)
+	}
+
+	return accumulated, unspendOuts, nil
+}
+
+// FindCoins find the unspent outputs paying to the address, which must be valid,
+// the address index is used when the chain keeps it
+func (u UTXOSet) FindCoins(address string) ([]Coin, error) {
+	var coins []Coin
+
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	script := wallet.IsScriptAddress(address)
+
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		indexed, err := hasAddressIndex(txn)
+		if err != nil {
+			return err
+		}
+		if indexed {
+			outputs, err := addressOutputs(txn, pubKeyHash)
+			if err != nil {
+				return err
+			}
+			for _, out := range outputs {
+				// 索引裡沒有 script、高度和 coinbase，要從 UTXO 紀錄讀出來
+				outs, _, err := readOutputs(txn, out.TxID)
+				if err != nil {
+					return err
+				}
+				output, ok := outs.Get(out.Index)
+				if !ok {
+					return fmt.Errorf("address index has output %d of %x, which is not in the UTXO set, rebuild it with reindexutxo", out.Index, out.TxID)
+				}
+				// 同一個 hash 的 key address 和 script address 在索引裡是一起的
+				if output.paysTo(pubKeyHash, script) {
+					coins = append(coins, Coin{out.TxID, out.Index, output, outs.Height, outs.Coinbase})
+				}
+			}
+			return nil
+		}
+
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
 		defer it.Close()
 
 		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
 			item := it.Item()
-			k := item.Key()
+			txID := bytes.TrimPrefix(item.KeyCopy(nil), utxoPrefix)
 
 			err := item.Value(func(val []byte) error {
-				k = bytes.TrimPrefix(k, utxoPrefix)
-				txID := hex.EncodeToString(k)
-				outs := DeserializeOutputs(val)
-
-				for outIdx, out := range outs.Outputs {
-					if out.IsLockedWithKey(pubKeyHash) && accumulated < amount {
-						accumulated += out.Value
-						unspendOuts[txID] = append(unspendOuts[txID], outIdx)
+				outs, err := DeserializeOutputs(val)
+				if err != nil {
+					return err
+				}
 
+				for _, unspent := range outs.Outputs {
+					if unspent.Output.paysTo(pubKeyHash, script) {
+						coins = append(coins, Coin{txID, unspent.Index, unspent.Output, outs.Height, outs.Coinbase})
 					}
 				}
 				return nil
 			})
-			Handle(err)
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
-	Handle(err)
 
-	return accumulated, unspendOuts
+	return coins, err
 }
 
-// FindUnspentTransactions find the transactions which have unspent output
-func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) []TxOutput {
-	var UTXOs []TxOutput
+// SpendableCoins find the coins paying to the address which can be spent in the next block
+func (u UTXOSet) SpendableCoins(address string) ([]Coin, error) {
+	coins, err := u.FindCoins(address)
+	if err != nil {
+		return nil, err
+	}
+	next, err := u.nextHeight()
+	if err != nil {
+		return nil, err
+	}
 
-	db := u.Blockchain.Database
+	var spendable []Coin
+	for _, coin := range coins {
+		if u.Spendable(coin, next) {
+			spendable = append(spendable, coin)
+		}
+	}
+	return spendable, nil
+}
 
-	err := db.View(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
+// Spendable report whether the coin can be spent in the block at next:
+// a coinbase must be mature and the relative lock of the output must have passed
+func (u UTXOSet) Spendable(coin Coin, next int) bool {
+	return u.Blockchain.Params.Mature(coin.Coinbase, coin.Height, next) && unlocked(coin.Output, coin.Height, next)
+}
 
-		it := txn.NewIterator(opts)
-		defer it.Close()
+// nextHeight return the height of the next block on top of the last block
+func (u UTXOSet) nextHeight() (int, error) {
+	tip, err := u.Blockchain.LastBlock()
+	if err != nil {
+		return 0, err
+	}
+	return tip.Height + 1, nil
+}
 
-		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
-			item := it.Item()
-			err := item.Value(func(val []byte) error {
-				outs := DeserializeOutputs(val)
+// unlocked report whether the output of a transaction of the block at height can be spent in the block at next
+func unlocked(out TxOutput, height, next int) bool {
+	return next >= height+out.RelativeLock()
+}
 
-				for _, out := range outs.Outputs {
-					if out.IsLockedWithKey(pubKeyHash) {
-						UTXOs = append(UTXOs, out)
-					}
-				}
-				return nil
-			})
-			Handle(err)
+// outputs return the unspent outputs stored for the transaction ID
+func (u UTXOSet) outputs(txID []byte) (TxOutputs, bool, error) {
+	var outs TxOutputs
+	found := false
 
-		}
-		return nil
+	err := u.Blockchain.Database.View(func(txn *badger.Txn) error {
+		var err error
+		outs, found, err = readOutputs(txn, txID)
+		return err
 	})
-	Handle(err)
 
-	return UTXOs
+	return outs, found, err
 }
 
-// Reindex clear all prefix outputs and create new unspent transaction outputs
-func (u UTXOSet) Reindex() {
+// readOutputs read the unspent outputs of the transaction ID in txn
+func readOutputs(txn *badger.Txn, txID []byte) (TxOutputs, bool, error) {
+	var outs TxOutputs
+
+	item, err := txn.Get(append(utxoPrefix, txID...))
+	if err == badger.ErrKeyNotFound {
+		return outs, false, nil
+	}
+	if err != nil {
+		return outs, false, err
+	}
+
+	err = item.Value(func(val []byte) error {
+		outs, err = DeserializeOutputs(val)
+		return err
+	})
+	return outs, err == nil, err
+}
+
+// FindUnspentTransactions find the unspent outputs locked with the pubkey hash of a key address,
+// the address index is used when the chain keeps it
+func (u UTXOSet) FindUnspentTransactions(pubKeyHash []byte) ([]TxOutput, error) {
+	var UTXOs []TxOutput
+
+	coins, err := u.FindCoins(string(wallet.PubKeyHashAddress(pubKeyHash)))
+	for _, coin := range coins {
+		UTXOs = append(UTXOs, coin.Output)
+	}
+
+	return UTXOs, err
+}
+
+// Reindex clear all prefix outputs and create new unspent transaction outputs,
+// the address index is rebuilt too when the chain keeps it
+func (u UTXOSet) Reindex() error {
 	db := u.Blockchain.Database
 
-	u.DeleteByPrefix(utxoPrefix)
+	if err := u.DeleteByPrefix(utxoPrefix); err != nil {
+		return err
+	}
 
-	UTXO := u.Blockchain.FindUTXO()
+	UTXO, err := u.Blockchain.FindUTXO()
+	if err != nil {
+		return err
+	}
 
-	err := db.Update(func(txn *badger.Txn) error {
+	err = db.Update(func(txn *badger.Txn) error {
 		for txID, outs := range UTXO {
 			key, err := hex.DecodeString(txID)
 			if err != nil {
@@ -108,78 +231,172 @@ func (u UTXOSet) Reindex() {
 
 			key = append(utxoPrefix, key...)
 
-			err = txn.Set(key, outs.Serialize())
-			Handle(err)
+			if err := txn.Set(key, outs.Serialize()); err != nil {
+				return err
+			}
 		}
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
 
-	Handle(err)
+	indexed, err := u.Blockchain.HasAddressIndex()
+	if err != nil || !indexed {
+		return err
+	}
+	return u.Blockchain.ReindexAddresses()
 }
 
 // Update 主要在更新資料庫的 output，例如幫 output 加上 prefix
-func (u *UTXOSet) Update(block *Block) {
+func (u *UTXOSet) Update(block *Block) error {
 	db := u.Blockchain.Database
 
-	err := db.Update(func(txn *badger.Txn) error {
-		for _, tx := range block.Transactions {
-			if tx.IsCoinbase() == false {
-				for _, in := range tx.Inputs {
-					updatedOuts := TxOutputs{}
-					inID := append(utxoPrefix, in.ID...)
-					item, err := txn.Get(inID)
-					Handle(err)
-
-					var outs TxOutputs
-					err = item.Value(func(val []byte) error {
-						outs = DeserializeOutputs(val)
-						return nil
-					})
-					Handle(err)
-
-					for outIdx, out := range outs.Outputs {
-						// 此 output index 沒有列在 input.Out 裡頭，代表此 output 為 unspent
-						if outIdx != in.Out {
-							updatedOuts.Outputs = append(updatedOuts.Outputs, out)
-						}
-					}
+	return db.Update(func(txn *badger.Txn) error {
+		return u.connect(txn, block)
+	})
+}
 
-					if len(updatedOuts.Outputs) == 0 {
-						// 若沒有任何 unspent output，就刪掉這個 transaction
-						if err := txn.Delete(inID); err != nil {
-							log.Panic(err)
-						}
-					} else {
-						// 將 unspent output 寫入資料庫
-						if err := txn.Set(inID, updatedOuts.Serialize()); err != nil {
-							log.Panic(err)
-						}
+// connect spend the outputs the block's inputs spend and add the outputs it creates in txn,
+// the spent outputs are stored as the block's undo data.
+// Every record is changed in memory and written once at the end, so several inputs spending
+// outputs of the same transaction, even one created earlier in the block, all see the same record.
+func (u *UTXOSet) connect(txn *badger.Txn, block *Block) error {
+	var undo BlockUndo
+	records := make(map[string]*TxOutputs)
+
+	for _, tx := range block.Transactions {
+		if tx.IsCoinbase() == false {
+			for _, in := range tx.Inputs {
+				inID := hex.EncodeToString(in.ID)
+
+				outs, ok := records[inID]
+				if !ok {
+					stored, found, err := readOutputs(txn, in.ID)
+					if err != nil {
+						return err
 					}
+					if !found {
+						return fmt.Errorf("%w: outputs of %s are not in the UTXO set", ErrInvalidTransaction, inID)
+					}
+					outs = &stored
+					records[inID] = outs
+				}
+
+				// 從紀錄中移除被花掉的 output，並留下 undo data
+				out, ok := outs.Remove(in.Out)
+				if !ok {
+					return fmt.Errorf("%w: output %d of %s is not in the UTXO set", ErrInvalidTransaction, in.Out, inID)
 				}
+				undo.Spent = append(undo.Spent, SpentOutput{in.ID, in.Out, outs.Height, outs.Coinbase, out})
 			}
+		}
+
+		// 處理 coinbase input 產生的新 outputs (以此獎勵挖礦)
+		newOutputs := &TxOutputs{Height: block.Height, Coinbase: tx.IsCoinbase()}
+		for outIdx, out := range tx.Outputs {
+			newOutputs.Add(outIdx, out)
+		}
+		records[hex.EncodeToString(tx.ID)] = newOutputs
+	}
+
+	for txID, outs := range records {
+		key, err := hex.DecodeString(txID)
+		if err != nil {
+			return err
+		}
+		key = append(utxoPrefix, key...)
 
-			// 處理 coinbase input 產生的新 outputs (以此獎勵挖礦)
-			newOutputs := TxOutputs{}
-			for _, out := range tx.Outputs {
-				newOutputs.Outputs = append(newOutputs.Outputs, out)
+		if len(outs.Outputs) == 0 {
+			// 若沒有任何 unspent output，就刪掉這個 transaction
+			if err := txn.Delete(key); err != nil {
+				return err
 			}
+		} else if err := txn.Set(key, outs.Serialize()); err != nil {
+			// 將 unspent output 寫入資料庫
+			return err
+		}
+	}
 
-			// 將新的 outputs 存入資料庫
-			txID := append(utxoPrefix, tx.ID...)
-			if err := txn.Set(txID, newOutputs.Serialize()); err != nil {
-				log.Panic(err)
+	indexed, err := hasAddressIndex(txn)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		if err := indexBlock(txn, block, undo.Spent); err != nil {
+			return err
+		}
+	}
+
+	return txn.Set(append(undoPrefix, block.Hash...), undo.Serialize())
+}
+
+// disconnect undo connect in txn: remove the outputs the block created and give back the outputs
+// it spent from the block's undo data. The block must be the tip of the chain.
+func (u *UTXOSet) disconnect(txn *badger.Txn, block *Block) error {
+	undo, err := u.Blockchain.blockUndo(txn, block)
+	if err != nil {
+		return err
+	}
+	spent := undo.Spent
+
+	indexed, err := hasAddressIndex(txn)
+	if err != nil {
+		return err
+	}
+	if indexed {
+		if err := unindexBlock(txn, block, spent); err != nil {
+			return err
+		}
+	}
+
+	// 從最後一筆交易往回處理，同一個區塊裡被花掉的 output 才會正確地先加回再刪除
+	for i := len(block.Transactions) - 1; i >= 0; i-- {
+		tx := block.Transactions[i]
+
+		if err := txn.Delete(append(utxoPrefix, tx.ID...)); err != nil {
+			return err
+		}
+
+		if tx.IsCoinbase() {
+			continue
+		}
+
+		// undo data 依照 input 的順序，這筆交易的是最後 len(tx.Inputs) 個
+		if len(spent) < len(tx.Inputs) {
+			return fmt.Errorf("undo data of block %x is missing spent outputs", block.Hash)
+		}
+		n := len(spent) - len(tx.Inputs)
+		for _, s := range spent[n:] {
+			if err := u.restore(txn, s); err != nil {
+				return err
 			}
 		}
+		spent = spent[:n]
+	}
 
-		return nil
-	})
+	return txn.Delete(append(undoPrefix, block.Hash...))
+}
 
-	Handle(err)
+// restore put a spent output back at its index in txn
+func (u *UTXOSet) restore(txn *badger.Txn, spent SpentOutput) error {
+	outs, found, err := readOutputs(txn, spent.TxID)
+	if err != nil {
+		return err
+	}
+	if !found {
+		outs.Height, outs.Coinbase = spent.Height, spent.Coinbase
+	}
+
+	if !outs.Add(spent.Out, spent.Output) {
+		return fmt.Errorf("output %d of %x is already unspent", spent.Out, spent.TxID)
+	}
+	return txn.Set(append(utxoPrefix, spent.TxID...), outs.Serialize())
 }
 
 // CountTransactions counts the transactions with unspent outputs
-func (u *UTXOSet) CountTransactions() int {
+func (u *UTXOSet) CountTransactions() (int, error) {
 	db := u.Blockchain.Database
 	counter := 0
 
@@ -193,12 +410,12 @@ func (u *UTXOSet) CountTransactions() int {
 		}
 		return nil
 	})
-	Handle(err)
-	return counter
+
+	return counter, err
 }
 
 // DeleteByPrefix delete all data with prefix
-func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
+func (u *UTXOSet) DeleteByPrefix(prefix []byte) error {
 	// 建立一個可一次刪除多筆資料的 function
 	deleteKeys := func(keysForDelete [][]byte) error {
 		if err := u.Blockchain.Database.Update(func(txn *badger.Txn) error {
@@ -215,7 +432,7 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 	}
 
 	collectSize := 100000
-	u.Blockchain.Database.View(func(txn *badger.Txn) error {
+	return u.Blockchain.Database.View(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		it := txn.NewIterator(opts)
@@ -230,7 +447,7 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 			keysCollected++
 			if keysCollected == collectSize {
 				if err := deleteKeys(keysForDelete); err != nil {
-					log.Panic(err)
+					return err
 				}
 				keysForDelete = make([][]byte, 0, collectSize)
 				keysCollected = 0
@@ -239,7 +456,7 @@ func (u *UTXOSet) DeleteByPrefix(prefix []byte) {
 
 		if keysCollected > 0 {
 			if err := deleteKeys(keysForDelete); err != nil {
-				log.Panic(err)
+				return err
 			}
 		}
 
@@ -0,0 +1,235 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger"
+	"github.com/go-blockchain/wallet"
+)
+
+// storedUTXO read every record of the UTXO set
+func storedUTXO(t *testing.T, chain *Blockchain) map[string]TxOutputs {
+	t.Helper()
+
+	UTXO := make(map[string]TxOutputs)
+	err := chain.Database.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(utxoPrefix); it.ValidForPrefix(utxoPrefix); it.Next() {
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				outs, err := DeserializeOutputs(val)
+				UTXO[hex.EncodeToString(item.Key()[len(utxoPrefix):])] = outs
+				return err
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return UTXO
+}
+
+// checkUTXO compare the UTXO set with the one FindUTXO rebuilds from the chain
+func checkUTXO(t *testing.T, chain *Blockchain, step int) {
+	t.Helper()
+
+	want, err := chain.FindUTXO()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := storedUTXO(t, chain)
+
+	for txID, outs := range want {
+		stored, ok := got[txID]
+		if !ok {
+			t.Fatalf("step %d: outputs of %s are missing from the UTXO set", step, txID)
+		}
+		if !bytes.Equal(stored.Serialize(), outs.Serialize()) {
+			t.Fatalf("step %d: outputs of %s are %+v, FindUTXO has %+v", step, txID, stored, outs)
+		}
+	}
+	for txID := range got {
+		if _, ok := want[txID]; !ok {
+			t.Fatalf("step %d: UTXO set has outputs of %s which FindUTXO does not", step, txID)
+		}
+	}
+}
+
+// testCoin is an unspent output the test can spend with the key of owner
+type testCoin struct {
+	tx    *Transaction
+	index int
+	owner *wallet.Wallet
+}
+
+// randomBlockTxs build up to 4 transactions of random coins of the UTXO set paying random wallets.
+// A transaction may spend outputs of a transaction before it in the block.
+func randomBlockTxs(t *testing.T, rng *rand.Rand, chain *Blockchain, wallets []*wallet.Wallet, txs map[string]*Transaction) []*Transaction {
+	t.Helper()
+
+	tip := lastBlock(t, chain)
+	owners := make(map[string]*wallet.Wallet)
+	for _, w := range wallets {
+		owners[hex.EncodeToString(wallet.PublicKeyHash(w.PublicKey))] = w
+	}
+
+	var coins []testCoin
+	for txID, outs := range storedUTXO(t, chain) {
+		if !chain.Params.Mature(outs.Coinbase, outs.Height, tip.Height+1) {
+			continue
+		}
+		for _, out := range outs.Outputs {
+			coins = append(coins, testCoin{txs[txID], out.Index, owners[hex.EncodeToString(out.Output.PubKeyHash)]})
+		}
+	}
+	// map 的順序是隨機的，排序後才能用 seed 重現
+	sort.Slice(coins, func(i, j int) bool {
+		if c := bytes.Compare(coins[i].tx.ID, coins[j].tx.ID); c != 0 {
+			return c < 0
+		}
+		return coins[i].index < coins[j].index
+	})
+
+	var block []*Transaction
+	for n := rng.Intn(5); n > 0 && len(coins) > 0; n-- {
+		// 選一個 coin，再加上同一個 owner 的其他 coin
+		first := coins[rng.Intn(len(coins))]
+		var spend, rest []testCoin
+		for _, coin := range coins {
+			if coin.owner == first.owner && (coin == first || rng.Intn(3) == 0) {
+				spend = append(spend, coin)
+			} else {
+				rest = append(rest, coin)
+			}
+		}
+		coins = rest
+
+		tx := &Transaction{}
+		prevTXs := make(map[string]Transaction)
+		value := 0
+		for _, coin := range spend {
+			tx.Inputs = append(tx.Inputs, TxInput{coin.tx.ID, coin.index, nil, coin.owner.PublicKey, nil, 0})
+			prevTXs[hex.EncodeToString(coin.tx.ID)] = *coin.tx
+			value += coin.tx.Outputs[coin.index].Value
+		}
+
+		for outputs := 1 + rng.Intn(3); value > 0; outputs-- {
+			amount := value
+			if outputs > 1 {
+				amount = 1 + rng.Intn(value)
+			}
+			to := wallets[rng.Intn(len(wallets))]
+			tx.Outputs = append(tx.Outputs, *NewTXOutput(amount, string(to.Address())))
+			value -= amount
+		}
+
+		if err := tx.Sign(first.owner.PrivateKey, prevTXs); err != nil {
+			t.Fatal(err)
+		}
+		tx.ID = tx.Hash()
+		txs[hex.EncodeToString(tx.ID)] = tx
+		block = append(block, tx)
+
+		for i := range tx.Outputs {
+			coins = append(coins, testCoin{tx, i, owners[hex.EncodeToString(tx.Outputs[i].PubKeyHash)]})
+		}
+	}
+
+	return block
+}
+
+// TestUTXOConnectDisconnect connect random blocks and disconnect them again in a random order,
+// and check after every step the UTXO set kept by connect and disconnect is the one FindUTXO rebuilds
+func TestUTXOConnectDisconnect(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	chain.Params.CoinbaseMaturity = 1
+
+	seed := time.Now().UnixNano()
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed %d", seed)
+
+	wallets := []*wallet.Wallet{w, wallet.MakeWallet(), wallet.MakeWallet()}
+	txs := make(map[string]*Transaction)
+	genesis := lastBlock(t, chain)
+	for _, tx := range genesis.Transactions {
+		txs[hex.EncodeToString(tx.ID)] = tx
+	}
+
+	for step := 0; step < 60; step++ {
+		tip := lastBlock(t, chain)
+
+		if tip.Height > 0 && rng.Intn(3) == 0 {
+			if _, err := chain.DisconnectBlock(); err != nil {
+				t.Fatalf("step %d: disconnect block %d: %v", step, tip.Height, err)
+			}
+		} else {
+			to := wallets[rng.Intn(len(wallets))]
+			block := acceptOn(t, chain, tip, string(to.Address()), randomBlockTxs(t, rng, chain, wallets, txs)...)
+			txs[hex.EncodeToString(block.Transactions[0].ID)] = block.Transactions[0]
+		}
+
+		checkUTXO(t, chain, step)
+	}
+}
+
+// TestFindCoinsOfAddressKind pay a P2SH output with the hash of a key address and check
+// only the script address of the hash finds it, with and without the address index
+func TestFindCoinsOfAddressKind(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+	victim := wallet.MakeWallet()
+	hash := wallet.PublicKeyHash(victim.PublicKey)
+
+	genesis := lastBlock(t, chain)
+	prevTX := genesis.Transactions[0]
+	tx := &Transaction{nil, []TxInput{{prevTX.ID, 0, nil, w.PublicKey, nil, 0}}, []TxOutput{
+		{5, hash, P2SHScript(hash)},
+		*NewTXOutput(3, string(victim.Address())),
+		*NewTXOutput(prevTX.Outputs[0].Value-8, string(w.Address())),
+	}, 0}
+	if err := tx.Sign(w.PrivateKey, map[string]Transaction{hex.EncodeToString(prevTX.ID): *prevTX}); err != nil {
+		t.Fatal(err)
+	}
+	tx.ID = tx.Hash()
+	acceptOn(t, chain, genesis, string(w.Address()), tx)
+
+	u := UTXOSet{chain}
+	for _, indexed := range []bool{false, true} {
+		if indexed {
+			if err := chain.EnableAddressIndex(); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		coins, err := u.FindCoins(string(victim.Address()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := coinValues(coins); !sameValues(got, []int{3}) {
+			t.Errorf("indexed %v: key address has coins %v, want [3]", indexed, got)
+		}
+		coins, err = u.FindCoins(string(wallet.ScriptAddress(hash)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := coinValues(coins); !sameValues(got, []int{5}) {
+			t.Errorf("indexed %v: script address has coins %v, want [5]", indexed, got)
+		}
+	}
+
+	if _, err := NewRawTransaction(string(victim.Address()), string(w.Address()), 4, 0, TxOptions{}, &u); err == nil {
+		t.Error("the key address spent the P2SH output of its hash")
+	}
+}
@@ -0,0 +1,507 @@
+package blockchain
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// medianTimeBlocks is the number of blocks used for the median time past
+const medianTimeBlocks = 11
+
+// utxoView is the set of unspent outputs a block is validated against
+type utxoView interface {
+	// prevTx return the transaction of the output spent by in and the height of its block,
+	// ok is false when that output is not unspent
+	prevTx(in TxInput) (tx Transaction, height int, ok bool, err error)
+	// hasTx check a transaction with the ID is already in the chain
+	hasTx(ID []byte) (bool, error)
+}
+
+// chainView is the utxoView of the UTXO set stored in the database
+type chainView struct {
+	chain *Blockchain
+}
+
+func (v chainView) prevTx(in TxInput) (Transaction, int, bool, error) {
+	outs, ok, err := UTXOSet{v.chain}.outputs(in.ID)
+	if err != nil || !ok {
+		return Transaction{}, 0, false, err
+	}
+	if _, unspent := outs.Get(in.Out); !unspent {
+		return Transaction{}, 0, false, nil
+	}
+
+	tx, err := v.chain.FindTransaction(in.ID)
+	if errors.Is(err, ErrTxNotFound) {
+		return Transaction{}, 0, false, nil
+	}
+	if err != nil {
+		return Transaction{}, 0, false, err
+	}
+	if in.Out < 0 || in.Out >= len(tx.Outputs) {
+		return Transaction{}, 0, false, nil
+	}
+
+	return tx, outs.Height, true, nil
+}
+
+func (v chainView) hasTx(ID []byte) (bool, error) {
+	_, err := v.chain.FindTransaction(ID)
+	if errors.Is(err, ErrTxNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// blockView keeps the outputs created and spent by the transactions validated so far on top of base.
+// With a nil base it holds the whole UTXO set in memory, which is used to replay the chain.
+type blockView struct {
+	base    utxoView
+	created map[string]viewTx
+	spent   map[string]bool
+}
+
+// viewTx is a transaction connected to a blockView and the height of its block
+type viewTx struct {
+	tx     Transaction
+	height int
+}
+
+func newBlockView(base utxoView) *blockView {
+	return &blockView{base, make(map[string]viewTx), make(map[string]bool)}
+}
+
+func outpointKey(in TxInput) string {
+	return fmt.Sprintf("%x:%d", in.ID, in.Out)
+}
+
+func (v *blockView) prevTx(in TxInput) (Transaction, int, bool, error) {
+	if v.spent[outpointKey(in)] {
+		return Transaction{}, 0, false, nil
+	}
+
+	if c, ok := v.created[hex.EncodeToString(in.ID)]; ok {
+		return c.tx, c.height, in.Out >= 0 && in.Out < len(c.tx.Outputs), nil
+	}
+
+	if v.base == nil {
+		return Transaction{}, 0, false, nil
+	}
+	return v.base.prevTx(in)
+}
+
+func (v *blockView) hasTx(ID []byte) (bool, error) {
+	if _, ok := v.created[hex.EncodeToString(ID)]; ok {
+		return true, nil
+	}
+
+	if v.base == nil {
+		return false, nil
+	}
+	return v.base.hasTx(ID)
+}
+
+// connect mark the outputs spent by tx and add the outputs it creates in a block at height
+func (v *blockView) connect(tx *Transaction, height int) {
+	if !tx.IsCoinbase() {
+		for _, in := range tx.Inputs {
+			v.spent[outpointKey(in)] = true
+		}
+	}
+
+	v.created[hex.EncodeToString(tx.ID)] = viewTx{*tx, height}
+}
+
+// blockContext is what the values, lock times, spent coinbases and signatures of a transaction are checked against:
+// the height of the block it is in, the median time past of the block before it, the params of the chain
+// and the version of the block, whose rules apply. The next block has the current BlockVersion.
+type blockContext struct {
+	height     int
+	medianTime int64
+	params     *ChainParams
+	version    int
+}
+
+// blockContext return the context of the transactions of block, whose previous block is stored
+func (chain *Blockchain) blockContext(block *Block) (blockContext, error) {
+	if len(block.PrevHash) == 0 {
+		return blockContext{block.Height, 0, chain.Params, block.Version}, nil
+	}
+
+	prev, err := chain.GetBlockByHash(block.PrevHash)
+	if err != nil {
+		return blockContext{}, err
+	}
+	mtp, err := chain.MedianTimePast(prev)
+	if err != nil {
+		return blockContext{}, err
+	}
+	return blockContext{block.Height, mtp, chain.Params, block.Version}, nil
+}
+
+// nextBlockContext return the context of the transactions of the next block on top of the last block
+func (chain *Blockchain) nextBlockContext() (blockContext, error) {
+	tip, err := chain.LastBlock()
+	if err != nil {
+		return blockContext{}, err
+	}
+	mtp, err := chain.MedianTimePast(tip)
+	if err != nil {
+		return blockContext{}, err
+	}
+	return blockContext{tip.Height + 1, mtp, chain.Params, BlockVersion}, nil
+}
+
+// MedianTimePast return the median timestamp of the last medianTimeBlocks blocks up to prev
+func (chain *Blockchain) MedianTimePast(prev *Block) (int64, error) {
+	var timestamps []int64
+
+	iter := Iterator{prev.Hash, chain.Database}
+	for i := 0; i < medianTimeBlocks; i++ {
+		block, err := iter.Next()
+		if err != nil {
+			return 0, err
+		}
+		timestamps = append(timestamps, block.Timestamp)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+	return timestamps[len(timestamps)/2], nil
+}
+
+// ValidateBlock check the block follows every consensus rule before it is stored on top of the last block:
+// the header links to the last block, the timestamp, target bits and proof of work are right,
+// and every transaction spends unspent outputs with valid signatures.
+// A broken rule is reported as an ErrInvalidBlock error.
+func (chain *Blockchain) ValidateBlock(block *Block) error {
+	if !bytes.Equal(block.PrevHash, chain.LastHash) {
+		return fmt.Errorf("%w: previous block %x is not the last block", ErrInvalidBlock, block.PrevHash)
+	}
+
+	// 空的 chain 接受的第一個區塊就是創世區塊
+	var prev *Block
+	if len(chain.LastHash) != 0 {
+		var err error
+		if prev, err = chain.GetBlockByHash(block.PrevHash); err != nil {
+			return err
+		}
+	}
+
+	return chain.validateBlock(block, prev, newBlockView(chainView{chain}))
+}
+
+// ValidateTransaction check tx could be mined in the next block: its inputs spend unspent outputs
+// of the UTXO set with valid signatures and its locks have passed. A coinbase is only valid inside a block.
+func (chain *Blockchain) ValidateTransaction(tx *Transaction) error {
+	if tx.IsCoinbase() {
+		return fmt.Errorf("%w: coinbase %x outside a block", ErrInvalidTransaction, tx.ID)
+	}
+
+	ctx, err := chain.nextBlockContext()
+	if err != nil {
+		return err
+	}
+	_, err = validateTransaction(tx, chainView{chain}, ctx)
+	return err
+}
+
+// VerifyChain replay the whole chain from genesis and return the first invalid block and the reason.
+// The block is nil when every block is valid, or when the chain cannot be read.
+func (chain *Blockchain) VerifyChain() (*Block, error) {
+	var hashes [][]byte
+
+	iter := chain.CreateIterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, block.Hash)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	view := newBlockView(nil)
+	var prev *Block
+
+	// 從創世區塊開始驗證
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := chain.GetBlockByHash(hashes[i])
+		if err != nil {
+			return nil, err
+		}
+
+		if err := chain.validateBlock(block, prev, view); err != nil {
+			return block, err
+		}
+
+		prev = block
+	}
+
+	return nil, nil
+}
+
+// validateBlock check the block on top of prev, prev is nil for the genesis block.
+// The outputs of the block are connected to the view.
+func (chain *Blockchain) validateBlock(block, prev *Block, view *blockView) error {
+	if err := chain.validateHeader(block, prev); err != nil {
+		return err
+	}
+
+	legacy, err := chain.isLegacyBlock(block.Hash)
+	if err != nil {
+		return err
+	}
+	if err := checkBlock(block, legacy); err != nil {
+		return err
+	}
+
+	return chain.validateTransactions(block, view)
+}
+
+// checkBlock check the rules which do not depend on the chain: the block has transactions
+// with distinct IDs matching its merkle root, and only the first one is a coinbase.
+// The IDs are the hashes of the transactions, except in a legacy block migrated from gob,
+// so the merkle root and the block hash cover the whole transactions.
+func checkBlock(block *Block, legacy bool) error {
+	if len(block.Transactions) == 0 {
+		return fmt.Errorf("%w: block has no transactions", ErrInvalidBlock)
+	}
+
+	// 重複的交易會得到一樣的 merkle root，例如奇數層最後一個節點和自己配對
+	seen := make(map[string]bool)
+	for _, tx := range block.Transactions {
+		if !legacy && !bytes.Equal(tx.ID, tx.Hash()) {
+			return fmt.Errorf("%w: transaction %x has a wrong ID", ErrInvalidBlock, tx.ID)
+		}
+		id := hex.EncodeToString(tx.ID)
+		if seen[id] {
+			return fmt.Errorf("%w: transaction %x is in the block twice", ErrInvalidBlock, tx.ID)
+		}
+		seen[id] = true
+	}
+
+	if !bytes.Equal(block.MerkleRoot, block.HashTransactions()) {
+		return fmt.Errorf("%w: merkle root %x does not match the transactions", ErrInvalidBlock, block.MerkleRoot)
+	}
+
+	for i, tx := range block.Transactions {
+		if i == 0 && !tx.IsCoinbase() {
+			return fmt.Errorf("%w: first transaction %x is not a coinbase", ErrInvalidBlock, tx.ID)
+		}
+		if i > 0 && tx.IsCoinbase() {
+			return fmt.Errorf("%w: transaction %x is a second coinbase", ErrInvalidBlock, tx.ID)
+		}
+	}
+
+	return nil
+}
+
+// validateTransactions check the transactions of a block which passed checkBlock against the view,
+// and that the coinbase does not claim more than the subsidy and the fees.
+// The IDs and signatures of a block migrated from gob are not checked.
+// The outputs of the block are connected to the view.
+func (chain *Blockchain) validateTransactions(block *Block, view *blockView) error {
+	legacy, err := chain.isLegacyBlock(block.Hash)
+	if err != nil {
+		return err
+	}
+	ctx, err := chain.blockContext(block)
+	if err != nil {
+		return err
+	}
+
+	fees := 0
+	for _, tx := range block.Transactions {
+		fee, err := validateTx(tx, view, legacy, ctx)
+		if err != nil {
+			if errors.Is(err, ErrInvalidTransaction) {
+				return blockTxError{err}
+			}
+			return err
+		}
+		var ok bool
+		if fees, ok = chain.Params.addMoney(fees, fee); !ok {
+			return blockTxError{fmt.Errorf("%w: the fees of the block add up to more than MaxMoney", ErrInvalidTransaction)}
+		}
+
+		view.connect(tx, block.Height)
+	}
+
+	// coinbase 最多只能拿到補貼加上區塊裡所有交易的手續費，
+	// 它的 outputs 已經檢查過不會溢位
+	coinbase := block.Transactions[0]
+	subsidy := chain.Params.Subsidy(block.Height)
+	if reward := coinbase.OutputValue(); reward-fees > subsidy {
+		return blockTxError{fmt.Errorf("%w: coinbase %x pays %d, more than the subsidy %d and the fees %d",
+			ErrInvalidTransaction, coinbase.ID, reward, subsidy, fees)}
+	}
+
+	return nil
+}
+
+// validateHeader check the header links to prev and has the right version, timestamp, target bits and proof of work
+func (chain *Blockchain) validateHeader(block, prev *Block) error {
+	if block.Version < 1 || block.Version > BlockVersion {
+		return fmt.Errorf("%w: unknown block version %d", ErrInvalidBlock, block.Version)
+	}
+	if min := chain.Params.MinBlockVersion(block.Height); block.Version < min {
+		// 轉換過來的舊區塊在規則生效前就已經在 chain 上了
+		legacy, err := chain.isLegacyBlock(block.Hash)
+		if err != nil {
+			return err
+		}
+		if !legacy {
+			return fmt.Errorf("%w: version %d is below version %d required from height %d", ErrInvalidBlock, block.Version, min, block.Height)
+		}
+	}
+
+	if prev == nil {
+		if block.Height != 0 || len(block.PrevHash) != 0 {
+			return fmt.Errorf("%w: genesis block must have height 0 and no previous hash", ErrInvalidBlock)
+		}
+	} else {
+		if !bytes.Equal(block.PrevHash, prev.Hash) {
+			return fmt.Errorf("%w: previous hash %x does not match block %x", ErrInvalidBlock, block.PrevHash, prev.Hash)
+		}
+		// 版本不能降低，否則礦工可以用舊版本避開新的規則
+		if block.Version < prev.Version {
+			return fmt.Errorf("%w: version %d is below version %d of the previous block", ErrInvalidBlock, block.Version, prev.Version)
+		}
+		if block.Height != prev.Height+1 {
+			return fmt.Errorf("%w: height %d does not follow height %d", ErrInvalidBlock, block.Height, prev.Height)
+		}
+
+		mtp, err := chain.MedianTimePast(prev)
+		if err != nil {
+			return err
+		}
+		if block.Timestamp <= mtp {
+			return fmt.Errorf("%w: timestamp %d is not after the median time past %d", ErrInvalidBlock, block.Timestamp, mtp)
+		}
+	}
+
+	maxTime := time.Now().Add(chain.Params.MaxFutureBlockTime).Unix()
+	if block.Timestamp > maxTime {
+		return fmt.Errorf("%w: timestamp %d is too far in the future", ErrInvalidBlock, block.Timestamp)
+	}
+
+	return chain.validateProof(block, prev)
+}
+
+// validateTransaction check the ID and outputs of tx, and unless it is a coinbase
+// that every input spends an unspent output of the view and satisfies its locking script
+// and the outputs do not pay more than the inputs. Its lock time and the relative locks of its inputs
+// must have passed in the block of ctx, and the coinbases it spends must be mature. It returns the fee of tx, which is 0 for a coinbase,
+// the reward of the coinbase is checked with the fees of the whole block.
+// A broken rule is reported as an ErrInvalidTransaction error.
+func validateTransaction(tx *Transaction, view utxoView, ctx blockContext) (int, error) {
+	return validateTx(tx, view, false, ctx)
+}
+
+// validateTx is validateTransaction, a legacy transaction of a block migrated from gob
+// is trusted to have the right ID and signatures
+func validateTx(tx *Transaction, view utxoView, legacy bool, ctx blockContext) (int, error) {
+	if !legacy && !bytes.Equal(tx.ID, tx.Hash()) {
+		return 0, fmt.Errorf("%w: transaction %x has a wrong ID", ErrInvalidTransaction, tx.ID)
+	}
+
+	exists, err := view.hasTx(tx.ID)
+	if err != nil {
+		return 0, err
+	}
+	if exists {
+		return 0, fmt.Errorf("%w: transaction %x already exists", ErrInvalidTransaction, tx.ID)
+	}
+
+	if len(tx.Inputs) == 0 || len(tx.Outputs) == 0 {
+		return 0, fmt.Errorf("%w: transaction %x has no inputs or no outputs", ErrInvalidTransaction, tx.ID)
+	}
+
+	if tx.LockTime < 0 {
+		return 0, fmt.Errorf("%w: transaction %x has a negative lock time", ErrInvalidTransaction, tx.ID)
+	}
+	if !tx.IsFinal(ctx.height, ctx.medianTime) {
+		return 0, fmt.Errorf("%w: transaction %x is locked until %s", ErrInvalidTransaction, tx.ID, lockTimeString(tx.LockTime))
+	}
+
+	out := 0
+	for _, output := range tx.Outputs {
+		if output.Value < 0 || (output.Value == 0 && !tx.IsCoinbase()) {
+			return 0, fmt.Errorf("%w: transaction %x has an output which is not positive", ErrInvalidTransaction, tx.ID)
+		}
+		// 金額有上限，加總時才不會溢位變成負的手續費
+		var ok bool
+		if out, ok = ctx.params.addMoney(out, output.Value); !ok {
+			return 0, fmt.Errorf("%w: the outputs of transaction %x add up to more than MaxMoney", ErrInvalidTransaction, tx.ID)
+		}
+		// 有 script 的 output 以 script 的 hash 作為地址
+		if !output.hashMatchesScript() {
+			return 0, fmt.Errorf("%w: transaction %x has an output whose PubKeyHash is not the hash of its script", ErrInvalidTransaction, tx.ID)
+		}
+	}
+
+	if tx.IsCoinbase() {
+		return 0, nil
+	}
+
+	prevTXs := make(map[string]Transaction)
+	seen := make(map[string]bool)
+	in := 0
+
+	for i, input := range tx.Inputs {
+		key := outpointKey(input)
+		if seen[key] {
+			return 0, fmt.Errorf("%w: transaction %x spends %s twice", ErrInvalidTransaction, tx.ID, key)
+		}
+		seen[key] = true
+
+		prevTX, height, ok, err := view.prevTx(input)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return 0, fmt.Errorf("%w: input %d of transaction %x spends a missing or spent output %s", ErrInvalidTransaction, i, tx.ID, key)
+		}
+
+		// 相對鎖定：花費的 output 所在的區塊之後要再經過 Sequence 個區塊
+		if input.Sequence < 0 {
+			return 0, fmt.Errorf("%w: input %d of transaction %x has a negative sequence", ErrInvalidTransaction, i, tx.ID)
+		}
+		if ctx.height < height+input.Sequence {
+			return 0, fmt.Errorf("%w: input %d of transaction %x is locked until height %d", ErrInvalidTransaction, i, tx.ID, height+input.Sequence)
+		}
+		if ctx.version >= 2 && !ctx.params.Mature(prevTX.IsCoinbase(), height, ctx.height) {
+			return 0, fmt.Errorf("%w: input %d of transaction %x spends coinbase %x of height %d before height %d",
+				ErrInvalidTransaction, i, tx.ID, prevTX.ID, height, height+ctx.params.CoinbaseMaturity)
+		}
+
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+		if in, ok = ctx.params.addMoney(in, prevTX.Outputs[input.Out].Value); !ok {
+			return 0, fmt.Errorf("%w: the inputs of transaction %x add up to more than MaxMoney", ErrInvalidTransaction, tx.ID)
+		}
+	}
+
+	if out > in {
+		return 0, fmt.Errorf("%w: transaction %x pays %d, more than its inputs %d", ErrInvalidTransaction, tx.ID, out, in)
+	}
+
+	if !legacy {
+		if err := tx.verifyInputs(tx.spentOutputs(prevTXs), ctx.version); err != nil {
+			return 0, fmt.Errorf("%w: transaction %x cannot spend its inputs: %v", ErrInvalidTransaction, tx.ID, err)
+		}
+	}
+
+	return in - out, nil
+}
@@ -0,0 +1,79 @@
+package blockchain
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/go-blockchain/wallet"
+)
+
+// withVersion mine the block again with the given version
+func withVersion(t *testing.T, block *Block, version int) *Block {
+	t.Helper()
+
+	block.Version = version
+	if err := NewMiner().MineBlock(context.Background(), block); err != nil {
+		t.Fatal(err)
+	}
+	return block
+}
+
+func TestMinBlockVersion(t *testing.T) {
+	params := ChainParams{VersionHeights: map[int]int{2: 5, 3: 10, 4: 10}}
+
+	tests := map[int]int{0: 1, 4: 1, 5: 2, 9: 2, 10: 4, 100: 4}
+	for height, want := range tests {
+		if got := params.MinBlockVersion(height); got != want {
+			t.Errorf("height %d: version %d, want %d", height, got, want)
+		}
+	}
+}
+
+func TestOldBlockVersionAfterActivation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "blockchain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := testParams()
+	params.VersionHeights = map[int]int{4: 2}
+	chain, err := OpenBlockchain(Options{DataDir: dir, Params: params})
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	defer closeTestChain(chain)
+	address := string(wallet.MakeWallet().Address())
+
+	// 生效前還可以用 version 1
+	genesis := NewBlock([]*Transaction{CoinbaseTx(address, "", params.Subsidy(0))}, []byte{}, 0, params.PowLimitBits)
+	genesis = withVersion(t, genesis, 1)
+	if err := chain.AcceptBlock(genesis); err != nil {
+		t.Fatal(err)
+	}
+	prev := withVersion(t, mineOn(t, chain, genesis, address), 1)
+	if err := chain.AcceptBlock(prev); err != nil {
+		t.Fatalf("version 1 block before activation: %v", err)
+	}
+
+	for version := 1; version < 4; version++ {
+		block := withVersion(t, mineOn(t, chain, prev, address), version)
+		if err := chain.AcceptBlock(block); !errors.Is(err, ErrInvalidBlock) {
+			t.Errorf("version %d block after activation: %v, want ErrInvalidBlock", version, err)
+		}
+	}
+	acceptOn(t, chain, prev, address)
+}
+
+func TestOldBlockVersionRejected(t *testing.T) {
+	chain, w := newTestChain(t)
+	defer closeTestChain(chain)
+
+	// 預設從 genesis 開始就要 BlockVersion
+	block := withVersion(t, mineOn(t, chain, lastBlock(t, chain), string(w.Address())), 1)
+	if err := chain.AcceptBlock(block); !errors.Is(err, ErrInvalidBlock) {
+		t.Errorf("version 1 block: %v, want ErrInvalidBlock", err)
+	}
+}
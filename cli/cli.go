@@ -1,90 +1,232 @@
 package cli
 
 import (
+	"context"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/go-blockchain/blockchain"
+	"github.com/go-blockchain/network"
 	"github.com/go-blockchain/wallet"
 )
 
 // CommandLine is for blockchain cli
-type CommandLine struct{}
+type CommandLine struct {
+	options blockchain.Options
+}
 
 func (cli *CommandLine) printUsage() {
-	fmt.Println("Usage:")
-	fmt.Println(" getbalance -address ADDRESS - get the balance for specific address")
-	fmt.Println(" createblockchain -address ADDRESS - create a blockchain")
+	fmt.Println("Usage: [-datadir DIR] [-node NODE_ID] COMMAND")
+	fmt.Printf(" -datadir DIR - directory of the databases and wallet files, default $%s or ./tmp\n", blockchain.DataDirEnv)
+	fmt.Printf(" -node NODE_ID - every node ID has its own database and wallet file, default $%s\n", blockchain.NodeIDEnv)
+	fmt.Println("Commands:")
+	fmt.Println(" getbalance -address ADDRESS - get the balance for specific address, and apart from it the coinbase rewards which cannot be spent yet")
+	fmt.Println(" createblockchain -address ADDRESS [-addrindex] - create a blockchain, with -addrindex it keeps the address index")
 	fmt.Println(" printchain - prints the blocks in the chain")
-	fmt.Println(" send -from FROM -to TO -amount AMOUNT - send amount from FROM to TO")
+	fmt.Println(" getblock HASH|HEIGHT - prints the block with the hash, or the block of the chain at the height")
+	fmt.Println(" verifychain - replays the chain from genesis and reports the first invalid block")
+	fmt.Println(" rollback -to HEIGHT - disconnects and deletes the blocks after HEIGHT")
+	fmt.Println(" history -address ADDRESS - lists the payments to and from the address, needs the address index")
+	fmt.Println(" send -from FROM -to TO -amount AMOUNT [-fee FEE] [-feerate N] [-dust N] [-coins STRATEGY] [-locktime N] [-lockblocks N] [-peer ADDR] - send amount from FROM to TO and pay the fee to the miner, with -peer the transaction is sent to the node at ADDR instead of mined here")
+	fmt.Printf("   -locktime N - the transaction is only valid from block height N, or from unix time N when N is at least %d\n", blockchain.LockTimeThreshold)
+	fmt.Println("   -lockblocks N - TO can only spend the payment N blocks after the block of the transaction")
+	fmt.Println("   -feerate N - pays N more per 1000 bytes of the transaction on top of FEE, change too small to be worth spending goes to the miner")
+	fmt.Printf("   -dust N - change up to N goes to the miner whatever the fee rate, %d by default\n", blockchain.DefaultDustLimit)
+	fmt.Println("   -coins STRATEGY - how the coins to spend are picked: largest (fewest coins), bnb (no change when the coins match the amount, the default) or random (for privacy)")
+	// about raw transactions
+	fmt.Println(" createrawtx -from FROM -to TO -amount AMOUNT [-fee FEE] [-feerate N] [-dust N] [-coins STRATEGY] [-locktime N] [-lockblocks N] -out FILE - writes the unsigned transaction to FILE, the keys of FROM are not needed")
+	fmt.Println(" signrawtx -in FILE [-out FILE] - adds the signatures of our wallet file to the transaction, without the chain")
+	fmt.Println(" decoderawtx -in FILE - prints the transaction, the outputs it spends and its signatures")
+	fmt.Println(" sendrawtx -in FILE (-peer ADDR | -miner ADDRESS) - sends the signed transaction to the node at ADDR, or mines it here with the reward to ADDRESS")
+	// about network
+	fmt.Println(" startnode [-listen ADDR] [-peers ADDR,ADDR] [-miner ADDRESS] - start a node, with -miner it mines the received transactions to ADDRESS")
 	// about wallet
 	fmt.Println(" createwallet - Creates a new Wallet")
-	fmt.Println(" listaddresses - Lists the addresses in our wallet file")
+	fmt.Println(" listaddresses [-pubkeys] - Lists the addresses in our wallet file, with -pubkeys also their public keys")
+	fmt.Println(" createmultisig -required M -keys KEY,KEY,... - Creates an M-of-N multisig address of the public keys in hex or addresses of our wallet file, and keeps it in the wallet file")
 	// about UTXO
-	fmt.Println(" reindexutxo - rebuilds the UTXO set")
+	fmt.Println(" migratedb - converts a database stored with gob or an older encoding to the current one")
+	fmt.Println(" reindexutxo [-addrindex] - rebuilds the UTXO set and missing transaction and height indexes, with -addrindex it also builds the address index and keeps it from now on")
 }
 
 // Run start the commandLine
 func (cli *CommandLine) Run() {
-	cli.validateArgs()
+	cli.options = blockchain.DefaultOptions()
+	flag.StringVar(&cli.options.DataDir, "datadir", cli.options.DataDir, "Directory of the databases and wallet files")
+	flag.StringVar(&cli.options.NodeID, "node", cli.options.NodeID, "Node ID, every node has its own database and wallet file")
+	flag.Usage = cli.printUsage
+	flag.Parse()
+
+	args := flag.Args()
+	cli.validateArgs(args)
 
 	getBalanceCmd := flag.NewFlagSet("getbalance", flag.ExitOnError)
 	createBlockchaihCmd := flag.NewFlagSet("createblockchain", flag.ExitOnError)
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	printChainCmd := flag.NewFlagSet("printchain", flag.ExitOnError)
+	getBlockCmd := flag.NewFlagSet("getblock", flag.ExitOnError)
+	verifyChainCmd := flag.NewFlagSet("verifychain", flag.ExitOnError)
+	rollbackCmd := flag.NewFlagSet("rollback", flag.ExitOnError)
+	historyCmd := flag.NewFlagSet("history", flag.ExitOnError)
+	// about raw transactions
+	createRawTxCmd := flag.NewFlagSet("createrawtx", flag.ExitOnError)
+	signRawTxCmd := flag.NewFlagSet("signrawtx", flag.ExitOnError)
+	decodeRawTxCmd := flag.NewFlagSet("decoderawtx", flag.ExitOnError)
+	sendRawTxCmd := flag.NewFlagSet("sendrawtx", flag.ExitOnError)
 	// about wallet
 	createWalletCmd := flag.NewFlagSet("createwallet", flag.ExitOnError)
 	listAddressesCmd := flag.NewFlagSet("listaddresses", flag.ExitOnError)
+	createMultisigCmd := flag.NewFlagSet("createmultisig", flag.ExitOnError)
 	// about UTXO
 	reindexUTXOCmd := flag.NewFlagSet("reindexutxo", flag.ExitOnError)
+	migrateDBCmd := flag.NewFlagSet("migratedb", flag.ExitOnError)
+	// about network
+	startNodeCmd := flag.NewFlagSet("startnode", flag.ExitOnError)
 
 	getBalanceAddress := getBalanceCmd.String("address", "", "The address you want to check")
 	createBlockchainAddress := createBlockchaihCmd.String("address", "", "The address to send genesis block reward to")
+	createBlockchainAddrIndex := createBlockchaihCmd.Bool("addrindex", false, "Keep the address index")
 	sendFrom := sendCmd.String("from", "", "Source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
-
-	switch os.Args[1] {
+	sendFee := sendCmd.Int("fee", 0, "Fee paid to the miner")
+	rollbackTo := rollbackCmd.Int("to", -1, "The height of the new last block")
+	historyAddress := historyCmd.String("address", "", "The address you want the payments of")
+	reindexAddrIndex := reindexUTXOCmd.Bool("addrindex", false, "Build the address index and keep it from now on")
+	sendPeer := sendCmd.String("peer", "", "Send the transaction to the node at this address instead of mining it")
+	sendLockTime := sendCmd.Int64("locktime", 0, "Block height or unix time the transaction is valid from")
+	sendLockBlocks := sendCmd.Int("lockblocks", 0, "Blocks after the block of the transaction the payment can be spent")
+	sendFeeRate := sendCmd.Int("feerate", 0, "Fee per 1000 bytes of the transaction on top of the fee")
+	sendCoins := sendCmd.String("coins", blockchain.DefaultCoinSelector, "Coin selection strategy: largest, bnb or random")
+	sendDust := sendCmd.Int("dust", blockchain.DefaultDustLimit, "Change up to this value goes to the miner")
+	startNodeListen := startNodeCmd.String("listen", cli.listenAddress(), "The address the node listens on")
+	startNodePeers := startNodeCmd.String("peers", "", "Comma separated addresses of the nodes to sync with")
+	startNodeMiner := startNodeCmd.String("miner", "", "Mine the received transactions and send the rewards to this address")
+	createRawTxFrom := createRawTxCmd.String("from", "", "Source wallet address")
+	createRawTxTo := createRawTxCmd.String("to", "", "Destination wallet address")
+	createRawTxAmount := createRawTxCmd.Int("amount", 0, "Amount to send")
+	createRawTxFee := createRawTxCmd.Int("fee", 0, "Fee paid to the miner")
+	createRawTxOut := createRawTxCmd.String("out", "", "The file the transaction is written to")
+	createRawTxLockTime := createRawTxCmd.Int64("locktime", 0, "Block height or unix time the transaction is valid from")
+	createRawTxLockBlocks := createRawTxCmd.Int("lockblocks", 0, "Blocks after the block of the transaction the payment can be spent")
+	createRawTxFeeRate := createRawTxCmd.Int("feerate", 0, "Fee per 1000 bytes of the transaction on top of the fee")
+	createRawTxCoins := createRawTxCmd.String("coins", blockchain.DefaultCoinSelector, "Coin selection strategy: largest, bnb or random")
+	createRawTxDust := createRawTxCmd.Int("dust", blockchain.DefaultDustLimit, "Change up to this value goes to the miner")
+	signRawTxIn := signRawTxCmd.String("in", "", "The file of the transaction")
+	signRawTxOut := signRawTxCmd.String("out", "", "The file the signed transaction is written to, the -in file by default")
+	decodeRawTxIn := decodeRawTxCmd.String("in", "", "The file of the transaction")
+	sendRawTxIn := sendRawTxCmd.String("in", "", "The file of the transaction")
+	sendRawTxPeer := sendRawTxCmd.String("peer", "", "Send the transaction to the node at this address")
+	sendRawTxMiner := sendRawTxCmd.String("miner", "", "Mine the transaction here and send the reward to this address")
+	listAddressesPubKeys := listAddressesCmd.Bool("pubkeys", false, "Print the public key of every address")
+	createMultisigRequired := createMultisigCmd.Int("required", 0, "The number of signatures needed to spend")
+	createMultisigKeys := createMultisigCmd.String("keys", "", "Comma separated public keys in hex or addresses of our wallet file")
+
+	switch args[0] {
 	case "getbalance":
-		err := getBalanceCmd.Parse(os.Args[2:])
+		err := getBalanceCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 
 	case "createblockchain":
-		err := createBlockchaihCmd.Parse(os.Args[2:])
+		err := createBlockchaihCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "send":
-		err := sendCmd.Parse(os.Args[2:])
+		err := sendCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "printchain":
-		err := printChainCmd.Parse(os.Args[2:])
+		err := printChainCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "getblock":
+		err := getBlockCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "verifychain":
+		err := verifyChainCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "rollback":
+		err := rollbackCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "history":
+		err := historyCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+
+	// about raw transactions
+	case "createrawtx":
+		err := createRawTxCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "signrawtx":
+		err := signRawTxCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "decoderawtx":
+		err := decodeRawTxCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "sendrawtx":
+		err := sendRawTxCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 
 	// about wallet
 	case "createwallet":
-		err := createWalletCmd.Parse(os.Args[2:])
+		err := createWalletCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	case "listaddresses":
-		err := listAddressesCmd.Parse(os.Args[2:])
+		err := listAddressesCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "createmultisig":
+		err := createMultisigCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
 	// about UTXO
 	case "reindexutxo":
-		err := reindexUTXOCmd.Parse(os.Args[2:])
+		err := reindexUTXOCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	case "migratedb":
+		err := migrateDBCmd.Parse(args[1:])
+		if err != nil {
+			log.Panic(err)
+		}
+	// about network
+	case "startnode":
+		err := startNodeCmd.Parse(args[1:])
 		if err != nil {
 			log.Panic(err)
 		}
@@ -109,20 +251,108 @@ func (cli *CommandLine) Run() {
 			runtime.Goexit()
 		}
 
-		cli.createBlockchain(*createBlockchainAddress)
+		cli.createBlockchain(*createBlockchainAddress, *createBlockchainAddrIndex)
 	}
 
 	if printChainCmd.Parsed() {
 		cli.printChain()
 	}
 
+	if getBlockCmd.Parsed() {
+		if getBlockCmd.NArg() != 1 {
+			getBlockCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.getBlock(getBlockCmd.Arg(0))
+	}
+
+	if verifyChainCmd.Parsed() {
+		cli.verifyChain()
+	}
+
+	if rollbackCmd.Parsed() {
+		if *rollbackTo < 0 {
+			rollbackCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.rollback(*rollbackTo)
+	}
+
+	if historyCmd.Parsed() {
+		if *historyAddress == "" {
+			historyCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.history(*historyAddress)
+	}
+
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 || *sendFee < 0 || *sendLockTime < 0 || *sendLockBlocks < 0 ||
+			*sendFeeRate < 0 || *sendDust < 0 || blockchain.CoinSelectors[*sendCoins] == nil {
 			sendCmd.Usage()
 			runtime.Goexit()
 		}
 
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		opts := blockchain.TxOptions{
+			LockTime:   *sendLockTime,
+			LockBlocks: *sendLockBlocks,
+			FeeRate:    *sendFeeRate,
+			Selector:   blockchain.CoinSelectors[*sendCoins],
+			DustLimit:  *sendDust,
+		}
+		cli.send(*sendFrom, *sendTo, *sendAmount, *sendFee, opts, *sendPeer)
+	}
+
+	// about raw transactions
+	if createRawTxCmd.Parsed() {
+		if *createRawTxFrom == "" || *createRawTxTo == "" || *createRawTxAmount <= 0 || *createRawTxFee < 0 || *createRawTxOut == "" ||
+			*createRawTxLockTime < 0 || *createRawTxLockBlocks < 0 || *createRawTxFeeRate < 0 || *createRawTxDust < 0 ||
+			blockchain.CoinSelectors[*createRawTxCoins] == nil {
+			createRawTxCmd.Usage()
+			runtime.Goexit()
+		}
+
+		opts := blockchain.TxOptions{
+			LockTime:   *createRawTxLockTime,
+			LockBlocks: *createRawTxLockBlocks,
+			FeeRate:    *createRawTxFeeRate,
+			Selector:   blockchain.CoinSelectors[*createRawTxCoins],
+			DustLimit:  *createRawTxDust,
+		}
+		cli.createRawTx(*createRawTxFrom, *createRawTxTo, *createRawTxAmount, *createRawTxFee, opts, *createRawTxOut)
+	}
+
+	if signRawTxCmd.Parsed() {
+		if *signRawTxIn == "" {
+			signRawTxCmd.Usage()
+			runtime.Goexit()
+		}
+		if *signRawTxOut == "" {
+			*signRawTxOut = *signRawTxIn
+		}
+
+		cli.signRawTx(*signRawTxIn, *signRawTxOut)
+	}
+
+	if decodeRawTxCmd.Parsed() {
+		if *decodeRawTxIn == "" {
+			decodeRawTxCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.decodeRawTx(*decodeRawTxIn)
+	}
+
+	if sendRawTxCmd.Parsed() {
+		if *sendRawTxIn == "" || (*sendRawTxPeer == "") == (*sendRawTxMiner == "") {
+			sendRawTxCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.sendRawTx(*sendRawTxIn, *sendRawTxPeer, *sendRawTxMiner)
 	}
 
 	// about wallet
@@ -131,25 +361,55 @@ func (cli *CommandLine) Run() {
 	}
 
 	if listAddressesCmd.Parsed() {
-		cli.listAddresses()
+		cli.listAddresses(*listAddressesPubKeys)
+	}
+
+	if createMultisigCmd.Parsed() {
+		if *createMultisigRequired <= 0 || *createMultisigKeys == "" {
+			createMultisigCmd.Usage()
+			runtime.Goexit()
+		}
+
+		cli.createMultisig(*createMultisigRequired, *createMultisigKeys)
 	}
 
 	// about UTXO
 	if reindexUTXOCmd.Parsed() {
-		cli.reindexUTXO()
+		cli.reindexUTXO(*reindexAddrIndex)
+	}
+
+	if migrateDBCmd.Parsed() {
+		cli.migrateDB()
+	}
+
+	// about network
+	if startNodeCmd.Parsed() {
+		cli.startNode(*startNodeListen, *startNodePeers, *startNodeMiner)
 	}
 }
 
-func (cli *CommandLine) createBlockchain(address string) {
+// handle print the error and stop the command, deferred functions like closing the database still run
+func handle(err error) {
+	if err != nil {
+		fmt.Println("Error:", err)
+		runtime.Goexit()
+	}
+}
+
+func (cli *CommandLine) createBlockchain(address string, addrIndex bool) {
 	if !wallet.ValidateAddress(address) {
 		log.Panic("Address is not Valid")
 	}
 
-	chain := blockchain.InitBlockchain(address)
-	chain.Database.Close()
+	chain, err := blockchain.InitBlockchain(address, cli.options)
+	handle(err)
+	defer chain.Database.Close()
 
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-	UTXOSet.Reindex()
+	handle(UTXOSet.Reindex())
+	if addrIndex {
+		handle(chain.EnableAddressIndex())
+	}
 	fmt.Println("Blockchain Created!")
 }
 
@@ -158,109 +418,490 @@ func (cli *CommandLine) getBalance(address string) {
 		log.Panic("Address is not Valid")
 	}
 
-	chain := blockchain.ContinueBlockchain(address)
+	chain, err := blockchain.ContinueBlockchain(address, cli.options)
+	handle(err)
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	balance := 0
+	balance, immature := 0, 0
 
-	pubKeyHash := wallet.Base58Decode([]byte(address))
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
-	UTXOs := UTXOSet.FindUnspentTransactions(pubKeyHash)
+	coins, err := UTXOSet.FindCoins(address)
+	handle(err)
+	tip, err := chain.LastBlock()
+	handle(err)
 
-	for _, out := range UTXOs {
-		balance += out.Value
+	// 還不能花的 coinbase 另外列出來
+	for _, coin := range coins {
+		if chain.Params.Mature(coin.Coinbase, coin.Height, tip.Height+1) {
+			balance += coin.Output.Value
+		} else {
+			immature += coin.Output.Value
+		}
 	}
 
 	fmt.Printf("Balance of %s: %d\n", address, balance)
+	fmt.Printf("Immature coinbase balance: %d, spendable %d blocks after it is mined\n", immature, chain.Params.CoinbaseMaturity)
+}
+
+func (cli *CommandLine) send(from, to string, amount, fee int, opts blockchain.TxOptions, peer string) {
+	if !wallet.ValidateAddress(from) {
+		log.Panic("From address is not Valid")
+	}
+	if !wallet.ValidateAddress(to) {
+		log.Panic("To address is not Valid")
+	}
+	chain, err := blockchain.ContinueBlockchain(from, cli.options)
+	handle(err)
+	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
+	defer chain.Database.Close()
+
+	if peer != "" {
+		tx, err := blockchain.NewTransaction(from, to, amount, fee, opts, &UTXOSet)
+		handle(err)
+		handle(network.SendTx(peer, tx))
+
+		fmt.Printf("Sent transaction %x to %s\n", tx.ID, peer)
+		return
+	}
+
+	chain.Miner.HashRate = printHashRate
+
+	tx, err := blockchain.NewTransaction(from, to, amount, fee, opts, &UTXOSet)
+	handle(err)
+	pool := blockchain.NewMempool(chain)
+	handle(pool.Add(tx))
+
+	// 寄送者同時也是礦工，拿到 coinbase 的獎勵
+	block, err := chain.MineMempool(context.Background(), pool, from)
+	fmt.Println()
+	handle(err)
+
+	fmt.Printf("Success! Mined block %x at height %d\n", block.Hash, block.Height)
 }
 
-func (cli *CommandLine) send(from, to string, amount int) {
+// About raw transactions
+func (cli *CommandLine) createRawTx(from, to string, amount, fee int, opts blockchain.TxOptions, out string) {
 	if !wallet.ValidateAddress(from) {
 		log.Panic("From address is not Valid")
 	}
 	if !wallet.ValidateAddress(to) {
 		log.Panic("To address is not Valid")
 	}
-	chain := blockchain.ContinueBlockchain(from)
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
 	defer chain.Database.Close()
 
-	tx := blockchain.NewTransaction(from, to, amount, &UTXOSet)
-	block := chain.AddBlock([]*blockchain.Transaction{tx})
-	UTXOSet.Update(block)
+	raw, err := blockchain.NewRawTransaction(from, to, amount, fee, opts, &UTXOSet)
+	handle(err)
+	handle(writeRawTx(out, raw))
+
+	fmt.Printf("Wrote unsigned transaction %x to %s\n", raw.Transaction.ID, out)
+}
+
+func (cli *CommandLine) signRawTx(in, out string) {
+	raw, err := readRawTx(in)
+	handle(err)
+
+	wallets, err := wallet.CreateWallets(cli.options.WalletFile())
+	handle(err)
+
+	signed, err := raw.Sign(wallets)
+	handle(err)
+	handle(writeRawTx(out, raw))
+
+	fmt.Printf("Added %d signatures, wrote transaction %x to %s\n", signed, raw.Transaction.ID, out)
+	if err := raw.Verify(); err != nil {
+		fmt.Println("The transaction needs more signatures.")
+		return
+	}
+	fmt.Println("The transaction is fully signed.")
+}
+
+func (cli *CommandLine) decodeRawTx(in string) {
+	raw, err := readRawTx(in)
+	handle(err)
+	tx := raw.Transaction
+
+	fmt.Printf("Transaction %x\n", tx.ID)
+	for i, input := range tx.Inputs {
+		prevOut := raw.PrevOutputs[i]
+		fmt.Printf("  Input %d spends output %d of %x: %d to %s\n", i, input.Out, input.ID, prevOut.Value, prevOut.Address())
+		if input.Sequence != 0 {
+			fmt.Printf("    sequence %d\n", input.Sequence)
+		}
+
+		if have, need, ok := raw.Signatures(i); ok {
+			fmt.Printf("    %d of %d signatures\n", have, need)
+		} else {
+			fmt.Println("    custom script")
+		}
+	}
+	for i, output := range tx.Outputs {
+		fmt.Printf("  Output %d: %d to %s\n", i, output.Value, output.Address())
+		if blocks := output.RelativeLock(); blocks != 0 {
+			fmt.Printf("    spendable %d blocks after its block\n", blocks)
+		}
+	}
+	if tx.LockTime != 0 {
+		fmt.Printf("Lock time: %d\n", tx.LockTime)
+	}
+	fmt.Printf("Fee: %d\n", raw.Fee())
+
+	if err := raw.Verify(); err != nil {
+		fmt.Printf("Not fully signed: %s\n", err)
+		return
+	}
+	fmt.Println("Fully signed")
+}
+
+func (cli *CommandLine) sendRawTx(in, peer, minerAddress string) {
+	if minerAddress != "" && !wallet.ValidateAddress(minerAddress) {
+		log.Panic("Miner address is not Valid")
+	}
+
+	raw, err := readRawTx(in)
+	handle(err)
+	handle(raw.Verify())
+	tx := raw.Transaction
+
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
+	defer chain.Database.Close()
+
+	// 檔案裡的 output 不可信，要用鏈上的 UTXO 再驗證一次
+	handle(chain.ValidateTransaction(tx))
+
+	if peer != "" {
+		handle(network.SendTx(peer, tx))
+
+		fmt.Printf("Sent transaction %x to %s\n", tx.ID, peer)
+		return
+	}
+
+	chain.Miner.HashRate = printHashRate
+
+	pool := blockchain.NewMempool(chain)
+	handle(pool.Add(tx))
+
+	block, err := chain.MineMempool(context.Background(), pool, minerAddress)
+	fmt.Println()
+	handle(err)
+
+	fmt.Printf("Success! Mined block %x at height %d\n", block.Hash, block.Height)
+}
+
+// readRawTx read the raw transaction of the file, which holds it in hex
+func readRawTx(path string) (*blockchain.RawTransaction, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := hex.DecodeString(strings.TrimSpace(string(content)))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not a raw transaction: %w", path, err)
+	}
+	return blockchain.DeserializeRawTransaction(data)
+}
+
+// writeRawTx write the raw transaction to the file in hex, so it can be copied as text
+func writeRawTx(path string, raw *blockchain.RawTransaction) error {
+	return ioutil.WriteFile(path, []byte(hex.EncodeToString(raw.Serialize())+"\n"), 0600)
+}
 
-	fmt.Println("Success!")
+// printHashRate keep the miner's hash rate on a single terminal line
+func printHashRate(hashesPerSecond float64) {
+	fmt.Printf("\rMining... %.0f hashes/s", hashesPerSecond)
 }
 
-func (cli *CommandLine) validateArgs() {
-	if len(os.Args) < 2 {
+func (cli *CommandLine) validateArgs(args []string) {
+	if len(args) < 1 {
 		cli.printUsage()
 		runtime.Goexit()
 	}
 }
 
 func (cli *CommandLine) printChain() {
-	chain := blockchain.ContinueBlockchain("")
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
 	defer chain.Database.Close()
 	iter := chain.CreateIterator()
 
 	// 先印出最新的區塊，最後一個區塊是創世區塊
 	for {
-		block := iter.Next()
-		fmt.Printf("----------------\n")
-		// fmt.Printf("Previous Hash: %x\n", block.PrevHash)
+		block, err := iter.Next()
+		handle(err)
+		printBlock(chain, block)
 
-		fmt.Printf("Hash: %x\n", block.Hash)
-		// fmt.Printf("Nonce: %d\n", block.Nonce)
-		fmt.Printf("Transactions length: %d\n", len(block.Transactions))
-
-		fmt.Printf("Inputs length and Outputs length: %d, %d\n", len(block.Transactions[0].Inputs), len(block.Transactions[0].Outputs))
+		// genesis' PreHash is []byte{}
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+}
 
-		pow := blockchain.NewProof(block)
-		// fmt.Printf("Target: %x\n", pow.Target)
-		fmt.Printf("PoW: %s\n", strconv.FormatBool(pow.Validate()))
+func (cli *CommandLine) getBlock(hashOrHeight string) {
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
+	defer chain.Database.Close()
 
-		for _, tx := range block.Transactions {
-			fmt.Println(tx)
+	// 64 個 hex 字元是區塊的 hash，其他的當作高度
+	var block *blockchain.Block
+	if hash, err := hex.DecodeString(hashOrHeight); err == nil && len(hash) == 32 {
+		block, err = chain.GetBlockByHash(hash)
+		handle(err)
+	} else {
+		height, err := strconv.Atoi(hashOrHeight)
+		if err != nil || height < 0 {
+			handle(fmt.Errorf("%q is neither a block hash nor a height", hashOrHeight))
 		}
+		block, err = chain.GetBlockByHeight(height)
+		handle(err)
+	}
 
-		fmt.Println()
+	printBlock(chain, block)
+}
 
-		// genesis' PreHash is []byte{}
-		if len(block.PrevHash) == 0 {
-			break
+func printBlock(chain *blockchain.Blockchain, block *blockchain.Block) {
+	fmt.Printf("----------------\n")
+	// fmt.Printf("Previous Hash: %x\n", block.PrevHash)
+
+	fmt.Printf("Hash: %x\n", block.Hash)
+	fmt.Printf("Height: %d\n", block.Height)
+	fmt.Printf("Version: %d\n", block.Version)
+	fmt.Printf("Timestamp: %s\n", time.Unix(block.Timestamp, 0))
+	fmt.Printf("Merkle Root: %x\n", block.MerkleRoot)
+	fmt.Printf("Bits: %08x\n", block.Bits)
+	// fmt.Printf("Nonce: %d\n", block.Nonce)
+	fmt.Printf("Transactions length: %d\n", len(block.Transactions))
+
+	fmt.Printf("Inputs length and Outputs length: %d, %d\n", len(block.Transactions[0].Inputs), len(block.Transactions[0].Outputs))
+
+	// fmt.Printf("Target: %x\n", blockchain.NewProof(block).Target)
+	fmt.Printf("PoW: %s\n", strconv.FormatBool(chain.ValidateProof(block) == nil))
+
+	for _, tx := range block.Transactions {
+		fmt.Println(tx)
+	}
+
+	fmt.Println()
+}
+
+func (cli *CommandLine) verifyChain() {
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
+	defer chain.Database.Close()
+
+	block, err := chain.VerifyChain()
+	if block == nil {
+		handle(err)
+	}
+	if err != nil {
+		fmt.Printf("Invalid block %x at height %d: %s\n", block.Hash, block.Height, err)
+		return
+	}
+
+	fmt.Println("Every block is valid!")
+}
+
+func (cli *CommandLine) rollback(height int) {
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
+	defer chain.Database.Close()
+
+	handle(chain.Rollback(height))
+
+	tip, err := chain.LastBlock()
+	handle(err)
+	fmt.Printf("Last block is %x at height %d\n", tip.Hash, tip.Height)
+}
+
+func (cli *CommandLine) history(address string) {
+	if !wallet.ValidateAddress(address) {
+		log.Panic("Address is not Valid")
+	}
+
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
+	defer chain.Database.Close()
+
+	pubKeyHash := wallet.Base58Decode([]byte(address))
+	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-4]
+	history, err := chain.AddressHistory(pubKeyHash)
+	if errors.Is(err, blockchain.ErrNoAddressIndex) {
+		handle(fmt.Errorf("%w, turn it on with reindexutxo -addrindex", err))
+	}
+	handle(err)
+
+	fmt.Printf("History of %s:\n", address)
+	for _, entry := range history {
+		// 同一筆交易可能同時花掉這個地址的 output 又找零回來
+		if entry.Sent > 0 {
+			fmt.Printf("  height %d  %x  sent %d\n", entry.Height, entry.TxID, entry.Sent)
+		}
+		if entry.Received > 0 {
+			fmt.Printf("  height %d  %x  received %d\n", entry.Height, entry.TxID, entry.Received)
 		}
 	}
+	fmt.Printf("%d transactions\n", len(history))
 }
 
 // About Wallet
 func (cli *CommandLine) createWallet() {
-	wallets, _ := wallet.CreateWallets()
+	wallets, _ := wallet.CreateWallets(cli.options.WalletFile())
 	address := wallets.AddWallet()
 	wallets.SaveFile()
 
 	fmt.Printf("New address is: %s\n", address)
 }
 
-func (cli *CommandLine) listAddresses() {
-	wallets, _ := wallet.CreateWallets()
+func (cli *CommandLine) listAddresses(pubKeys bool) {
+	wallets, _ := wallet.CreateWallets(cli.options.WalletFile())
 	addresses := wallets.GetAllAddress()
 
 	for _, address := range addresses {
-		fmt.Println(address)
+		if pubKeys {
+			fmt.Printf("%s %x\n", address, wallets.GetWallet(address).PublicKey)
+		} else {
+			fmt.Println(address)
+		}
 	}
+
+	for address, multisig := range wallets.Multisigs {
+		fmt.Printf("%s (%s)\n", address, multisig)
+	}
+}
+
+func (cli *CommandLine) createMultisig(required int, keys string) {
+	wallets, err := wallet.CreateWallets(cli.options.WalletFile())
+	if err != nil && !os.IsNotExist(err) {
+		handle(err)
+	}
+
+	// 每把 key 可以是 hex 的 public key，或是自己錢包裡的地址
+	var pubKeys [][]byte
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		if w, ok := wallets.Wallets[key]; ok {
+			pubKeys = append(pubKeys, w.PublicKey)
+			continue
+		}
+
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			handle(fmt.Errorf("%q is neither a public key in hex nor an address of the wallet file", key))
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	redeemScript, err := blockchain.MultisigScript(required, pubKeys)
+	handle(err)
+
+	address := wallets.AddMultisig(&wallet.Multisig{Required: required, PublicKeys: pubKeys, RedeemScript: redeemScript})
+	wallets.SaveFile()
+
+	fmt.Printf("New %d-of-%d multisig address is: %s\n", required, len(pubKeys), address)
 }
 
 // About UTXO
-func (cli *CommandLine) reindexUTXO() {
-	chain := blockchain.ContinueBlockchain("")
+func (cli *CommandLine) reindexUTXO(addrIndex bool) {
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
 	defer chain.Database.Close()
 
 	UTXOSet := blockchain.UTXOSet{Blockchain: chain}
-	UTXOSet.Reindex()
+	handle(UTXOSet.Reindex())
 
-	count := UTXOSet.CountTransactions()
+	buildMissingIndexes(chain)
+
+	// Reindex 已經重建了開啟中的 address index
+	if addrIndex {
+		indexed, err := chain.HasAddressIndex()
+		handle(err)
+		if !indexed {
+			handle(chain.EnableAddressIndex())
+		}
+		fmt.Println("The address index is on.")
+	}
+
+	count, err := UTXOSet.CountTransactions()
+	handle(err)
 	fmt.Printf("Done! There are %d transactions in the UTXO set.\n", count)
 
 }
+
+// buildMissingIndexes build the transaction index and the height index of a chain older than them
+func buildMissingIndexes(chain *blockchain.Blockchain) {
+	txIndexed, err := chain.HasTxIndex()
+	handle(err)
+	if !txIndexed {
+		handle(chain.ReindexTransactions())
+		fmt.Println("Built the transaction index.")
+	}
+
+	heightIndexed, err := chain.HasHeightIndex()
+	handle(err)
+	if !heightIndexed {
+		handle(chain.ReindexHeights())
+		fmt.Println("Built the height index.")
+	}
+}
+
+func (cli *CommandLine) migrateDB() {
+	blocks, err := blockchain.MigrateDatabase(cli.options)
+	handle(err)
+	if blocks == 0 {
+		fmt.Println("The database already uses the current binary encoding.")
+		return
+	}
+
+	chain, err := blockchain.ContinueBlockchain("", cli.options)
+	handle(err)
+	defer chain.Database.Close()
+	buildMissingIndexes(chain)
+
+	fmt.Printf("Done! Migrated %d blocks to encoding version %d.\n", blocks, blockchain.EncodingVersion)
+}
+
+// About network
+func (cli *CommandLine) startNode(listen, peers, minerAddress string) {
+	if minerAddress != "" && !wallet.ValidateAddress(minerAddress) {
+		log.Panic("Miner address is not Valid")
+	}
+
+	chain, err := blockchain.OpenBlockchain(cli.options)
+	handle(err)
+	defer chain.Database.Close()
+
+	var peerList []string
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peerList = append(peerList, peer)
+		}
+	}
+
+	server := network.NewServer(listen, minerAddress, chain, peerList)
+
+	// Ctrl-C 時關閉 server，資料庫才會正常關閉
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		server.Close()
+	}()
+
+	fmt.Printf("Starting node %s\n", listen)
+	if minerAddress != "" {
+		fmt.Printf("Mining is on, rewards go to %s\n", minerAddress)
+	}
+	handle(server.ListenAndServe())
+}
+
+// listenAddress is the default address of startnode, every node ID listens on its own port
+func (cli *CommandLine) listenAddress() string {
+	if cli.options.NodeID != "" {
+		return "localhost:" + cli.options.NodeID
+	}
+	return "localhost:3000"
+}
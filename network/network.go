@@ -0,0 +1,249 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/go-blockchain/blockchain"
+)
+
+const (
+	protocol      = "tcp"
+	version       = 2 // version 1 encoded the messages with gob
+	commandLength = 12
+
+	// maxMessageSize limits how much is read from one connection
+	maxMessageSize = 32 << 20
+	// maxInvItems is the most block hashes sent in one inv message
+	maxInvItems = 500
+	dialTimeout = 5 * time.Second
+	readTimeout = 30 * time.Second
+)
+
+// Addr share the known nodes with a peer
+type Addr struct {
+	AddrList []string
+}
+
+// Block carry a serialized block
+type Block struct {
+	AddrFrom string
+	Block    []byte
+}
+
+// GetBlocks ask a peer for the hashes of the blocks after the locator
+type GetBlocks struct {
+	AddrFrom string
+	// Locator is hashes of the sender's chain from the tip back to genesis,
+	// the peer answers with the blocks after the first hash it also has
+	Locator [][]byte
+}
+
+// GetData ask a peer for one block or transaction
+type GetData struct {
+	AddrFrom string
+	Type     string
+	ID       []byte
+}
+
+// Inv announce blocks or transactions the sender has
+type Inv struct {
+	AddrFrom string
+	Type     string
+	Items    [][]byte
+}
+
+// Tx carry a serialized transaction
+type Tx struct {
+	AddrFrom    string
+	Transaction []byte
+}
+
+// Version is the handshake, nodes compare their best heights to know who has to sync
+type Version struct {
+	Version    int
+	BestHeight int
+	AddrFrom   string
+}
+
+// CmdToBytes turn the command into fixed commandLength bytes
+func CmdToBytes(cmd string) []byte {
+	var bytes [commandLength]byte
+
+	for i, c := range cmd {
+		bytes[i] = byte(c)
+	}
+
+	return bytes[:]
+}
+
+// BytesToCmd turn the command bytes back to the command
+func BytesToCmd(bytes []byte) string {
+	var cmd []byte
+
+	for _, b := range bytes {
+		if b != 0x0 {
+			cmd = append(cmd, b)
+		}
+	}
+
+	return fmt.Sprintf("%s", cmd)
+}
+
+// payload is the body of a message, encoded with the binary encoding of the blockchain package
+// so nodes written in other languages can read it
+type payload interface {
+	encode(e *blockchain.Encoder)
+	decode(d *blockchain.Decoder)
+}
+
+func (p *Addr) encode(e *blockchain.Encoder) {
+	writeStrings(e, p.AddrList)
+}
+
+func (p *Addr) decode(d *blockchain.Decoder) {
+	p.AddrList = readStrings(d)
+}
+
+func (p *Block) encode(e *blockchain.Encoder) {
+	e.WriteString(p.AddrFrom)
+	e.WriteBytes(p.Block)
+}
+
+func (p *Block) decode(d *blockchain.Decoder) {
+	p.AddrFrom = d.ReadString()
+	p.Block = d.ReadBytes()
+}
+
+func (p *GetBlocks) encode(e *blockchain.Encoder) {
+	e.WriteString(p.AddrFrom)
+	writeList(e, p.Locator)
+}
+
+func (p *GetBlocks) decode(d *blockchain.Decoder) {
+	p.AddrFrom = d.ReadString()
+	p.Locator = readList(d)
+}
+
+func (p *GetData) encode(e *blockchain.Encoder) {
+	e.WriteString(p.AddrFrom)
+	e.WriteString(p.Type)
+	e.WriteBytes(p.ID)
+}
+
+func (p *GetData) decode(d *blockchain.Decoder) {
+	p.AddrFrom = d.ReadString()
+	p.Type = d.ReadString()
+	p.ID = d.ReadBytes()
+}
+
+func (p *Inv) encode(e *blockchain.Encoder) {
+	e.WriteString(p.AddrFrom)
+	e.WriteString(p.Type)
+	writeList(e, p.Items)
+}
+
+func (p *Inv) decode(d *blockchain.Decoder) {
+	p.AddrFrom = d.ReadString()
+	p.Type = d.ReadString()
+	p.Items = readList(d)
+}
+
+func (p *Tx) encode(e *blockchain.Encoder) {
+	e.WriteString(p.AddrFrom)
+	e.WriteBytes(p.Transaction)
+}
+
+func (p *Tx) decode(d *blockchain.Decoder) {
+	p.AddrFrom = d.ReadString()
+	p.Transaction = d.ReadBytes()
+}
+
+func (p *Version) encode(e *blockchain.Encoder) {
+	e.WriteInt(p.Version)
+	e.WriteInt(p.BestHeight)
+	e.WriteString(p.AddrFrom)
+}
+
+func (p *Version) decode(d *blockchain.Decoder) {
+	p.Version = d.ReadInt()
+	p.BestHeight = d.ReadInt()
+	p.AddrFrom = d.ReadString()
+}
+
+func writeList(e *blockchain.Encoder, list [][]byte) {
+	e.WriteCount(len(list))
+	for _, b := range list {
+		e.WriteBytes(b)
+	}
+}
+
+func readList(d *blockchain.Decoder) [][]byte {
+	var list [][]byte
+	for n := d.ReadCount(); n > 0; n-- {
+		list = append(list, d.ReadBytes())
+	}
+	return list
+}
+
+func writeStrings(e *blockchain.Encoder, list []string) {
+	e.WriteCount(len(list))
+	for _, s := range list {
+		e.WriteString(s)
+	}
+}
+
+func readStrings(d *blockchain.Decoder) []string {
+	var list []string
+	for n := d.ReadCount(); n > 0; n-- {
+		list = append(list, d.ReadString())
+	}
+	return list
+}
+
+// decodePayload decode the payload of a message into p
+func decodePayload(data []byte, p payload) error {
+	d := blockchain.NewDecoder(data)
+	p.decode(d)
+	return d.Finish()
+}
+
+// newMessage join the command and the encoded payload
+func newMessage(cmd string, p payload) []byte {
+	e := blockchain.NewEncoder()
+	p.encode(e)
+	return append(CmdToBytes(cmd), e.Bytes()...)
+}
+
+// sendMessage open a connection to addr and write one message
+func sendMessage(addr string, msg []byte) error {
+	conn, err := net.DialTimeout(protocol, addr, dialTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetWriteDeadline(time.Now().Add(readTimeout))
+	_, err = io.Copy(conn, bytes.NewReader(msg))
+	return err
+}
+
+// readMessage read the one message of a connection
+func readMessage(conn net.Conn) (string, []byte, error) {
+	conn.SetReadDeadline(time.Now().Add(readTimeout))
+
+	req, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize))
+	if err != nil {
+		return "", nil, err
+	}
+	if len(req) < commandLength {
+		return "", nil, errors.New("message is shorter than a command")
+	}
+
+	return BytesToCmd(req[:commandLength]), req[commandLength:], nil
+}
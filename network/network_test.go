@@ -0,0 +1,48 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMessageEncoding(t *testing.T) {
+	tests := []struct {
+		payload payload
+		empty   payload
+	}{
+		{&Addr{[]string{"localhost:3000", "localhost:3001"}}, &Addr{}},
+		{&Block{"localhost:3000", []byte{1, 2}}, &Block{}},
+		{&GetBlocks{"localhost:3000", [][]byte{{1}, {2}}}, &GetBlocks{}},
+		{&GetData{"localhost:3000", "block", []byte{1}}, &GetData{}},
+		{&Inv{"localhost:3000", "tx", [][]byte{{1}, {2}, {3}}}, &Inv{}},
+		{&Tx{"", []byte{1}}, &Tx{}},
+		{&Version{version, 10, "localhost:3000"}, &Version{}},
+	}
+
+	for _, test := range tests {
+		msg := newMessage("cmd", test.payload)
+		if cmd := BytesToCmd(msg[:commandLength]); cmd != "cmd" {
+			t.Errorf("command %q, want cmd", cmd)
+		}
+
+		if err := decodePayload(msg[commandLength:], test.empty); err != nil {
+			t.Errorf("decode %T: %v", test.payload, err)
+			continue
+		}
+		if !reflect.DeepEqual(test.empty, test.payload) {
+			t.Errorf("decoded %+v, want %+v", test.empty, test.payload)
+		}
+	}
+}
+
+func TestDecodeInvalidPayload(t *testing.T) {
+	msg := newMessage("version", &Version{version, 10, "localhost:3000"})
+
+	var p Version
+	if err := decodePayload(msg[commandLength:len(msg)-1], &p); err == nil {
+		t.Error("decoded a truncated payload")
+	}
+	if err := decodePayload(append(msg[commandLength:], 0), &p); err == nil {
+		t.Error("decoded a payload with trailing bytes")
+	}
+}
@@ -0,0 +1,646 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/go-blockchain/blockchain"
+)
+
+// Server is a node of the peer-to-peer network.
+// It syncs the chain with its peers and relays new blocks and transactions,
+// a node with a MinerAddress also mines the transactions it receives.
+type Server struct {
+	Address      string
+	MinerAddress string
+	Chain        *blockchain.Blockchain
+	Mempool      *blockchain.Mempool
+
+	mu              sync.Mutex
+	knownNodes      []string
+	blocksInTransit [][]byte
+	mining          bool
+	cancelMining    context.CancelFunc
+	listener        net.Listener
+}
+
+// NewServer create a node listening on address, peers are the nodes it syncs with first
+func NewServer(address, minerAddress string, chain *blockchain.Blockchain, peers []string) *Server {
+	s := &Server{
+		Address:      address,
+		MinerAddress: minerAddress,
+		Chain:        chain,
+		Mempool:      blockchain.NewMempool(chain),
+	}
+
+	for _, peer := range peers {
+		s.addNode(peer)
+	}
+	chain.Subscribe(s.tipChanged)
+
+	return s
+}
+
+// ListenAndServe listen on s.Address, send our version to the peers and handle their messages until Close
+func (s *Server) ListenAndServe() error {
+	ln, err := net.Listen(protocol, s.Address)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.listener = ln
+	s.mu.Unlock()
+
+	for _, node := range s.KnownNodes() {
+		if err := s.sendVersion(node); err != nil {
+			log.Print(err)
+		}
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+
+		go s.handleConnection(conn)
+	}
+}
+
+// Close stop listening and mining
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cancelMining != nil {
+		s.cancelMining()
+	}
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Close()
+}
+
+// KnownNodes return the addresses of the peers
+func (s *Server) KnownNodes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.knownNodes...)
+}
+
+// SendTx send the transaction to the node at addr, which relays it to the network
+func SendTx(addr string, tx *blockchain.Transaction) error {
+	return sendMessage(addr, newMessage("tx", &Tx{"", tx.Serialize()}))
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	cmd, payload, err := readMessage(conn)
+	conn.Close()
+	if err != nil {
+		log.Printf("Read message: %v", err)
+		return
+	}
+
+	switch cmd {
+	case "addr":
+		err = s.handleAddr(payload)
+	case "block":
+		err = s.handleBlock(payload)
+	case "inv":
+		err = s.handleInv(payload)
+	case "getblocks":
+		err = s.handleGetBlocks(payload)
+	case "getdata":
+		err = s.handleGetData(payload)
+	case "tx":
+		err = s.handleTx(payload)
+	case "version":
+		err = s.handleVersion(payload)
+	default:
+		err = fmt.Errorf("unknown command %q", cmd)
+	}
+
+	if err != nil {
+		log.Printf("Handle %s: %v", cmd, err)
+	}
+}
+
+func (s *Server) handleVersion(payload []byte) error {
+	var p Version
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+	// 其他版本的節點讀不懂我們的訊息
+	if p.Version != version {
+		s.removeNode(p.AddrFrom)
+		return fmt.Errorf("peer %s has version %d, not %d", p.AddrFrom, p.Version, version)
+	}
+
+	s.mu.Lock()
+	myHeight := s.bestHeight()
+	isNew := s.addNode(p.AddrFrom)
+	s.mu.Unlock()
+
+	// 高度比較低的一方向對方要區塊
+	if myHeight < p.BestHeight {
+		if err := s.sendGetBlocks(p.AddrFrom); err != nil {
+			return err
+		}
+	} else if myHeight > p.BestHeight {
+		if err := s.sendVersion(p.AddrFrom); err != nil {
+			return err
+		}
+	}
+
+	if isNew {
+		return s.sendAddr(p.AddrFrom)
+	}
+	return nil
+}
+
+func (s *Server) handleAddr(payload []byte) error {
+	var p Addr
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+
+	var newNodes []string
+	s.mu.Lock()
+	for _, node := range p.AddrList {
+		if s.addNode(node) {
+			newNodes = append(newNodes, node)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, node := range newNodes {
+		if err := s.sendVersion(node); err != nil {
+			log.Print(err)
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) handleGetBlocks(payload []byte) error {
+	var p GetBlocks
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	hashes, err := s.blocksAfter(p.Locator)
+	s.mu.Unlock()
+	if err != nil || len(hashes) == 0 {
+		return err
+	}
+
+	return s.sendInv(p.AddrFrom, "block", hashes)
+}
+
+func (s *Server) handleInv(payload []byte) error {
+	var p Inv
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+
+	switch p.Type {
+	case "block":
+		s.mu.Lock()
+		s.blocksInTransit = nil
+		for _, hash := range p.Items {
+			if !s.hasBlock(hash) {
+				s.blocksInTransit = append(s.blocksInTransit, hash)
+			}
+		}
+		next := s.nextBlockInTransit()
+		s.mu.Unlock()
+
+		if next != nil {
+			return s.sendGetData(p.AddrFrom, "block", next)
+		}
+
+	case "tx":
+		for _, txID := range p.Items {
+			if !s.Mempool.Has(txID) {
+				if err := s.sendGetData(p.AddrFrom, "tx", txID); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (s *Server) handleGetData(payload []byte) error {
+	var p GetData
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+
+	switch p.Type {
+	case "block":
+		s.mu.Lock()
+		block, err := s.Chain.GetBlockByHash(p.ID)
+		s.mu.Unlock()
+		if err != nil {
+			return err
+		}
+
+		return s.sendBlock(p.AddrFrom, block)
+
+	case "tx":
+		tx, ok := s.Mempool.Get(p.ID)
+		if !ok {
+			return fmt.Errorf("%w: %x is not in the mempool", blockchain.ErrTxNotFound, p.ID)
+		}
+
+		return s.sendTx(p.AddrFrom, tx)
+	}
+
+	return nil
+}
+
+func (s *Server) handleBlock(payload []byte) error {
+	var p Block
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+
+	block, err := blockchain.Deserialize(p.Block)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	err = s.Chain.AcceptBlock(block)
+	accepted := err == nil
+	orphan := errors.Is(err, blockchain.ErrOrphanBlock)
+	if orphan || errors.Is(err, blockchain.ErrBlockExists) {
+		err = nil
+	}
+	next := s.nextBlockInTransit()
+	nodes := s.otherNodes(p.AddrFrom)
+	s.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// 沒有前一個區塊，先向對方同步
+	if orphan {
+		return s.sendGetBlocks(p.AddrFrom)
+	}
+
+	if accepted {
+		log.Printf("Added block %x at height %d", block.Hash, block.Height)
+		s.broadcastInv("block", [][]byte{block.Hash}, nodes)
+	}
+
+	if next != nil {
+		return s.sendGetData(p.AddrFrom, "block", next)
+	}
+
+	// 區塊都收到了，再交換一次 version 看是否還要同步
+	if accepted {
+		return s.sendVersion(p.AddrFrom)
+	}
+	return nil
+}
+
+func (s *Server) handleTx(payload []byte) error {
+	var p Tx
+	if err := decodePayload(payload, &p); err != nil {
+		return err
+	}
+
+	tx, err := blockchain.DeserializeTransaction(p.Transaction)
+	if err != nil {
+		return err
+	}
+	txID := hex.EncodeToString(tx.ID)
+
+	s.mu.Lock()
+	if err := s.Mempool.Add(&tx); err != nil {
+		s.mu.Unlock()
+		if errors.Is(err, blockchain.ErrTxInMempool) {
+			return nil
+		}
+		return err
+	}
+
+	nodes := s.otherNodes(p.AddrFrom)
+
+	startMining := s.MinerAddress != "" && !s.mining
+	if startMining {
+		s.mining = true
+	}
+	s.mu.Unlock()
+
+	log.Printf("Added transaction %s to the mempool", txID)
+	s.broadcastInv("tx", [][]byte{tx.ID}, nodes)
+
+	if startMining {
+		go s.mine()
+	}
+	return nil
+}
+
+// mine the transactions of the mempool until it is empty.
+// Mining is cancelled and started again on top of the new tip when a block arrives.
+func (s *Server) mine() {
+	for {
+		s.mu.Lock()
+		block, err := s.blockTemplate()
+		if block == nil || err != nil {
+			s.mining = false
+			s.mu.Unlock()
+			if err != nil {
+				log.Printf("Mining: %v", err)
+			}
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.cancelMining = cancel
+		s.mu.Unlock()
+
+		err = s.Chain.Miner.MineBlock(ctx, block)
+
+		s.mu.Lock()
+		s.cancelMining = nil
+		cancel()
+		if err != nil {
+			// 有新的區塊進來，重新建立 block template
+			s.mu.Unlock()
+			continue
+		}
+
+		err = s.Chain.AcceptBlock(block)
+		if errors.Is(err, blockchain.ErrInvalidTransaction) {
+			// 這些交易無法放進區塊，從 mempool 移除
+			for _, tx := range block.Transactions[1:] {
+				s.Mempool.Remove(tx.ID)
+			}
+		}
+		nodes := s.otherNodes("")
+		s.mu.Unlock()
+
+		if err != nil {
+			log.Printf("Mining: %v", err)
+			continue
+		}
+
+		log.Printf("Mined block %x at height %d", block.Hash, block.Height)
+		s.broadcastInv("block", [][]byte{block.Hash}, nodes)
+	}
+}
+
+// blockTemplate build the block with a coinbase and the valid transactions of the mempool,
+// it is nil when there is nothing to mine. s.mu must be held.
+func (s *Server) blockTemplate() (*blockchain.Block, error) {
+	if len(s.Chain.LastHash) == 0 || s.Mempool.Count() == 0 {
+		return nil, nil
+	}
+
+	block, err := s.Mempool.NewBlockTemplate(s.MinerAddress)
+	if err != nil || len(block.Transactions) == 1 {
+		// 只剩 coinbase，mempool 的交易都已經無效
+		return nil, err
+	}
+	return block, nil
+}
+
+// tipChanged update the mempool and stop mining on the old tip.
+// It is called by Chain.AcceptBlock, so s.mu is held.
+func (s *Server) tipChanged(change blockchain.TipChange) {
+	if len(change.Disconnected) > 0 {
+		log.Printf("Reorganized %d blocks, new tip %x at height %d", len(change.Disconnected), change.Tip.Hash, change.Tip.Height)
+	}
+
+	s.Mempool.TipChanged(change)
+
+	if s.cancelMining != nil {
+		s.cancelMining()
+	}
+}
+
+// bestHeight return the height of the tip, -1 for an empty chain. s.mu must be held.
+func (s *Server) bestHeight() int {
+	if len(s.Chain.LastHash) == 0 {
+		return -1
+	}
+
+	block, err := s.Chain.LastBlock()
+	if err != nil {
+		return -1
+	}
+	return block.Height
+}
+
+// hasBlock check the block is stored. s.mu must be held.
+func (s *Server) hasBlock(hash []byte) bool {
+	_, err := s.Chain.GetBlockByHash(hash)
+	return err == nil
+}
+
+// nextBlockInTransit pop the next block to request. s.mu must be held.
+func (s *Server) nextBlockInTransit() []byte {
+	if len(s.blocksInTransit) == 0 {
+		return nil
+	}
+
+	next := s.blocksInTransit[0]
+	s.blocksInTransit = s.blocksInTransit[1:]
+	return next
+}
+
+// locator return hashes of the chain from the tip back to genesis,
+// the first ten one by one and then with doubling steps. s.mu must be held.
+func (s *Server) locator() ([][]byte, error) {
+	var locator [][]byte
+
+	if len(s.Chain.LastHash) == 0 {
+		return locator, nil
+	}
+
+	step, skip := 1, 0
+	iter := s.Chain.CreateIterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if skip == 0 {
+			locator = append(locator, block.Hash)
+			if len(locator) >= 10 {
+				step *= 2
+			}
+			skip = step
+		}
+		skip--
+
+		if len(block.PrevHash) == 0 {
+			// 創世區塊一定要放進去
+			if !bytes.Equal(locator[len(locator)-1], block.Hash) {
+				locator = append(locator, block.Hash)
+			}
+			return locator, nil
+		}
+	}
+}
+
+// blocksAfter return the hashes of the blocks after the first locator hash in our chain,
+// from the oldest one, at most maxInvItems. s.mu must be held.
+func (s *Server) blocksAfter(locator [][]byte) ([][]byte, error) {
+	var hashes [][]byte
+
+	if len(s.Chain.LastHash) == 0 {
+		return nil, nil
+	}
+
+	known := make(map[string]bool)
+	for _, hash := range locator {
+		known[hex.EncodeToString(hash)] = true
+	}
+
+	iter := s.Chain.CreateIterator()
+	for {
+		block, err := iter.Next()
+		if err != nil {
+			return nil, err
+		}
+
+		if known[hex.EncodeToString(block.Hash)] {
+			break
+		}
+		hashes = append(hashes, block.Hash)
+
+		if len(block.PrevHash) == 0 {
+			break
+		}
+	}
+
+	// 從舊到新排列，對方才能一個一個接上
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+	if len(hashes) > maxInvItems {
+		hashes = hashes[:maxInvItems]
+	}
+
+	return hashes, nil
+}
+
+// addNode add addr to the known nodes and report whether it is new. s.mu must be held.
+func (s *Server) addNode(addr string) bool {
+	if addr == "" || addr == s.Address {
+		return false
+	}
+
+	for _, node := range s.knownNodes {
+		if node == addr {
+			return false
+		}
+	}
+
+	s.knownNodes = append(s.knownNodes, addr)
+	return true
+}
+
+// removeNode forget a node which cannot be reached or has another version
+func (s *Server) removeNode(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, node := range s.knownNodes {
+		if node == addr {
+			s.knownNodes = append(s.knownNodes[:i], s.knownNodes[i+1:]...)
+			return
+		}
+	}
+}
+
+// otherNodes return the known nodes except addr. s.mu must be held.
+func (s *Server) otherNodes(addr string) []string {
+	var nodes []string
+
+	for _, node := range s.knownNodes {
+		if node != addr {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes
+}
+
+// send the message to addr, a node which cannot be reached is forgotten
+func (s *Server) send(addr, cmd string, p payload) error {
+	if err := sendMessage(addr, newMessage(cmd, p)); err != nil {
+		s.removeNode(addr)
+		return fmt.Errorf("peer %s is not available: %w", addr, err)
+	}
+	return nil
+}
+
+func (s *Server) sendVersion(addr string) error {
+	s.mu.Lock()
+	bestHeight := s.bestHeight()
+	s.mu.Unlock()
+
+	return s.send(addr, "version", &Version{version, bestHeight, s.Address})
+}
+
+func (s *Server) sendAddr(addr string) error {
+	nodes := append(s.KnownNodes(), s.Address)
+	return s.send(addr, "addr", &Addr{nodes})
+}
+
+func (s *Server) sendGetBlocks(addr string) error {
+	s.mu.Lock()
+	locator, err := s.locator()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return s.send(addr, "getblocks", &GetBlocks{s.Address, locator})
+}
+
+func (s *Server) sendInv(addr, kind string, items [][]byte) error {
+	return s.send(addr, "inv", &Inv{s.Address, kind, items})
+}
+
+func (s *Server) sendGetData(addr, kind string, id []byte) error {
+	return s.send(addr, "getdata", &GetData{s.Address, kind, id})
+}
+
+func (s *Server) sendBlock(addr string, block *blockchain.Block) error {
+	return s.send(addr, "block", &Block{s.Address, block.Serialize()})
+}
+
+func (s *Server) sendTx(addr string, tx *blockchain.Transaction) error {
+	return s.send(addr, "tx", &Tx{s.Address, tx.Serialize()})
+}
+
+// broadcastInv announce the items to the nodes
+func (s *Server) broadcastInv(kind string, items [][]byte, nodes []string) {
+	for _, node := range nodes {
+		if err := s.sendInv(node, kind, items); err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+// closedAddress return the address of a listener which is closed again, nobody answers there
+func closedAddress(t *testing.T) string {
+	t.Helper()
+
+	ln, err := net.Listen(protocol, "localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+func TestSendToUnavailablePeer(t *testing.T) {
+	addr := closedAddress(t)
+	s := &Server{Address: "localhost:3000", knownNodes: []string{addr}}
+
+	if err := s.send(addr, "addr", &Addr{}); err == nil {
+		t.Error("sent a message to a closed address")
+	}
+	if nodes := s.KnownNodes(); len(nodes) != 0 {
+		t.Errorf("known nodes %v, want the unavailable peer forgotten", nodes)
+	}
+}
+
+func TestHandleOtherVersion(t *testing.T) {
+	addr := closedAddress(t)
+	s := &Server{Address: "localhost:3000", knownNodes: []string{addr}}
+
+	msg := newMessage("version", &Version{version - 1, 10, addr})
+	if err := s.handleVersion(msg[commandLength:]); err == nil {
+		t.Error("handled the version message of an older version")
+	}
+	if nodes := s.KnownNodes(); len(nodes) != 0 {
+		t.Errorf("known nodes %v, want the peer of the older version dropped", nodes)
+	}
+}
@@ -0,0 +1,21 @@
+package wallet
+
+import "fmt"
+
+// Multisig is an m-of-n multisig address kept in the wallet file, its coins are spent with signatures of
+// Required of the PublicKeys. The keys may belong to other wallet files.
+type Multisig struct {
+	Required     int
+	PublicKeys   [][]byte
+	RedeemScript []byte // the script the address is the hash of
+}
+
+// Address return the address of the multisig, the ScriptAddress of its redeem script
+func (m *Multisig) Address() []byte {
+	return ScriptAddress(PublicKeyHash(m.RedeemScript))
+}
+
+// String describe the multisig like 2-of-3 multisig
+func (m *Multisig) String() string {
+	return fmt.Sprintf("%d-of-%d multisig", m.Required, len(m.PublicKeys))
+}
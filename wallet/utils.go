@@ -12,7 +12,7 @@ func Base58Encode(input []byte) []byte {
 	return []byte(encode)
 }
 
-// Base58Decode decode base58 encoded input
+// Base58Decode decode base58 encoded input, it panics when the input is not base58
 func Base58Decode(input []byte) []byte {
 	decode, err := base58.Decode(string(input[:]))
 	if err != nil {
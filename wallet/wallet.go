@@ -8,12 +8,15 @@ import (
 	"crypto/sha256"
 	"log"
 
+	"github.com/mr-tron/base58"
 	"golang.org/x/crypto/ripemd160"
 )
 
 const (
 	checksumLength = 4
 	version        = byte(0x00)
+	// scriptVersion is the version of the addresses of a script hash, like multisig addresses
+	scriptVersion = byte(0x05)
 )
 
 // Wallet contains private key and public key
@@ -26,13 +29,51 @@ type Wallet struct {
 func (w Wallet) Address() []byte {
 	pubKeyHash := PublicKeyHash(w.PublicKey)
 
+	return makeAddress(version, pubKeyHash)
+}
+
+// PubKeyHashAddress return the address paying to the public key hash
+func PubKeyHashAddress(pubKeyHash []byte) []byte {
+	return makeAddress(version, pubKeyHash)
+}
+
+// ScriptAddress return the address paying to the hash of a script
+func ScriptAddress(scriptHash []byte) []byte {
+	return makeAddress(scriptVersion, scriptHash)
+}
+
+// IsScriptAddress report whether the address pays to the hash of a script instead of a public key
+func IsScriptAddress(address string) bool {
+	v, _, ok := decodeAddress(address)
+	return ok && v == scriptVersion
+}
+
+// decodeAddress return the version and the hash of the address,
+// ok is false when it is not the base58 of a known version, a hash and their checksum
+func decodeAddress(address string) (byte, []byte, bool) {
+	decoded, err := base58.Decode(address)
+	if err != nil || len(decoded) != 1+ripemd160.Size+checksumLength {
+		return 0, nil, false
+	}
+
+	payload := decoded[:len(decoded)-checksumLength]
+	if !bytes.Equal(decoded[len(payload):], Checksum(payload)) {
+		return 0, nil, false
+	}
+	if payload[0] != version && payload[0] != scriptVersion {
+		return 0, nil, false
+	}
+	return payload[0], payload[1:], true
+}
+
+// makeAddress encode the version and the hash with a checksum in base58
+func makeAddress(version byte, pubKeyHash []byte) []byte {
 	versionedHash := append([]byte{version}, pubKeyHash...)
 	checksum := Checksum(versionedHash)
 
 	fullHash := append(versionedHash, checksum...)
 	address := Base58Encode(fullHash)
 
-	// fmt.Printf("pub key: %x\n", w.PublicKey)
 	// fmt.Printf("pub key hash: %x\n", pubKeyHash)
 	// fmt.Printf("full hash: %x\n", fullHash)
 	// fmt.Printf("address: %s\n", address)
@@ -49,7 +90,8 @@ func NewKeyPair() (ecdsa.PrivateKey, []byte) {
 		log.Panic(err)
 	}
 
-	pub := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	// X 和 Y 各補滿 32 bytes，才能從中間切開還原
+	pub := append(padBytes(private.PublicKey.X.Bytes(), 32), padBytes(private.PublicKey.Y.Bytes(), 32)...)
 	return *private, pub
 }
 
@@ -60,6 +102,15 @@ func MakeWallet() *Wallet {
 	return &wallet
 }
 
+// padBytes left pad b with zeros to size bytes
+func padBytes(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+
+	return append(make([]byte, size-len(b)), b...)
+}
+
 // PublicKeyHash generate public key hash with public key
 func PublicKeyHash(pubKey []byte) []byte {
 	pubHash := sha256.Sum256(pubKey)
@@ -82,13 +133,8 @@ func Checksum(payload []byte) []byte {
 	return secondHash[:checksumLength]
 }
 
-// ValidateAddress validate the address
+// ValidateAddress validate the address, any string can be checked
 func ValidateAddress(address string) bool {
-	pubKeyHash := Base58Decode([]byte(address))
-	actualChecksum := pubKeyHash[len(pubKeyHash)-checksumLength:]
-	version := pubKeyHash[0]
-	pubKeyHash = pubKeyHash[1 : len(pubKeyHash)-checksumLength]
-	targetChecksum := Checksum(append([]byte{version}, pubKeyHash...))
-
-	return bytes.Compare(actualChecksum, targetChecksum) == 0
+	_, _, ok := decodeAddress(address)
+	return ok
 }
@@ -2,25 +2,39 @@ package wallet
 
 import (
 	"bytes"
+	"crypto/ecdsa"
 	"crypto/elliptic"
 	"encoding/gob"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
+	"math/big"
 	"os"
+	"path/filepath"
 )
 
-const walletFile = "./tmp/wallets.data"
-
-// Wallets mapping every wallet address to type Wallet
+// Wallets mapping every wallet address to type Wallet, and every multisig address to type Multisig
 type Wallets struct {
-	Wallets map[string]*Wallet
+	Wallets   map[string]*Wallet
+	Multisigs map[string]*Multisig
+
+	walletFile string
+}
+
+// savedWallet is how a Wallet is kept in the wallet file,
+// gob cannot encode the elliptic curve of an ecdsa.PrivateKey
+type savedWallet struct {
+	PrivateKey []byte // the private key's D
+	PublicKey  []byte
 }
 
-// CreateWallets create type Wallets
-func CreateWallets() (*Wallets, error) {
+// CreateWallets create type Wallets and load the wallets in walletFile
+func CreateWallets(walletFile string) (*Wallets, error) {
 	wallets := Wallets{}
 	wallets.Wallets = make(map[string]*Wallet)
+	wallets.Multisigs = make(map[string]*Multisig)
+	wallets.walletFile = walletFile
 
 	err := wallets.LoadFile()
 
@@ -43,6 +57,31 @@ func (ws *Wallets) GetWallet(address string) Wallet {
 	return *ws.Wallets[address]
 }
 
+// AddMultisig add a multisig into Wallets and return the address
+func (ws *Wallets) AddMultisig(multisig *Multisig) string {
+	address := string(multisig.Address())
+
+	ws.Multisigs[address] = multisig
+
+	return address
+}
+
+// GetMultisig get the multisig of the address, false when the address is not a multisig of Wallets
+func (ws *Wallets) GetMultisig(address string) (*Multisig, bool) {
+	multisig, ok := ws.Multisigs[address]
+	return multisig, ok
+}
+
+// FindWallet get the wallet of the public key, false when the key is not in Wallets
+func (ws *Wallets) FindWallet(pubKey []byte) (*Wallet, bool) {
+	for _, w := range ws.Wallets {
+		if bytes.Equal(w.PublicKey, pubKey) {
+			return w, true
+		}
+	}
+	return nil, false
+}
+
 // GetAllAddress get all address from type Wallets
 func (ws *Wallets) GetAllAddress() []string {
 	var addresses []string
@@ -54,19 +93,32 @@ func (ws *Wallets) GetAllAddress() []string {
 	return addresses
 }
 
-// SaveFile serialize type Wallets with gob and write to the walletFile
+// SaveFile serialize type Wallets with gob and write to the walletFile,
+// the multisigs follow the wallets so older wallet files without them still load
 func (ws *Wallets) SaveFile() {
 	var content bytes.Buffer
 
-	gob.Register(elliptic.P256())
+	saved := make(map[string]savedWallet)
+	for address, w := range ws.Wallets {
+		saved[address] = savedWallet{w.PrivateKey.D.Bytes(), w.PublicKey}
+	}
 
 	encoder := gob.NewEncoder(&content)
-	err := encoder.Encode(ws)
+	err := encoder.Encode(saved)
+	if err != nil {
+		log.Panic(err)
+	}
+	err = encoder.Encode(ws.Multisigs)
+	if err != nil {
+		log.Panic(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(ws.walletFile), 0755)
 	if err != nil {
 		log.Panic(err)
 	}
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0644)
+	err = ioutil.WriteFile(ws.walletFile, content.Bytes(), 0600)
 	if err != nil {
 		log.Panic(err)
 	}
@@ -75,25 +127,53 @@ func (ws *Wallets) SaveFile() {
 
 // LoadFile loading walletFile and decode it to the Wallets
 func (ws *Wallets) LoadFile() error {
-	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
+	if _, err := os.Stat(ws.walletFile); os.IsNotExist(err) {
 		return err
 	}
 
-	var wallets Wallets
+	var saved map[string]savedWallet
 
-	fileContent, err := ioutil.ReadFile(walletFile)
+	fileContent, err := ioutil.ReadFile(ws.walletFile)
 	if err != nil {
 		return err
 	}
 
-	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
+	err = decoder.Decode(&saved)
 	if err != nil {
 		return err
 	}
 
-	ws.Wallets = wallets.Wallets
+	multisigs := make(map[string]*Multisig)
+	err = decoder.Decode(&multisigs)
+	if err != nil && err != io.EOF {
+		return err
+	}
+
+	wallets := make(map[string]*Wallet)
+	for address, s := range saved {
+		wallets[address] = restoreWallet(s)
+	}
+
+	ws.Wallets = wallets
+	ws.Multisigs = multisigs
 
 	return nil
 }
+
+// restoreWallet rebuild the ecdsa key pair of a saved wallet
+func restoreWallet(s savedWallet) *Wallet {
+	curve := elliptic.P256()
+	keyLen := len(s.PublicKey)
+
+	private := ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(s.PublicKey[:keyLen/2]),
+			Y:     new(big.Int).SetBytes(s.PublicKey[keyLen/2:]),
+		},
+		D: new(big.Int).SetBytes(s.PrivateKey),
+	}
+
+	return &Wallet{private, s.PublicKey}
+}